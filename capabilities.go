@@ -0,0 +1,211 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSudoPasswordRequired is the error reported when the SCPCommand or
+// the Privilege runs scp with sudo, but sudo on the remote asks for
+// a password which is not given.
+var ErrSudoPasswordRequired = errors.New("sudo on the remote requires a password")
+
+// ShellType is the type of the shell which runs commands on the remote.
+type ShellType int
+
+const (
+	// ShellUnknown is used when the shell is not detected.
+	// Commands are built for a POSIX shell.
+	ShellUnknown ShellType = iota
+	// ShellPOSIX is a POSIX shell like sh and bash.
+	ShellPOSIX
+	// ShellCmd is cmd.exe, the default shell of Windows OpenSSH servers.
+	ShellCmd
+	// ShellPowerShell is PowerShell.
+	ShellPowerShell
+)
+
+func (t ShellType) String() string {
+	switch t {
+	case ShellPOSIX:
+		return "posix"
+	case ShellCmd:
+		return "cmd"
+	case ShellPowerShell:
+		return "powershell"
+	default:
+		return "unknown"
+	}
+}
+
+// Capabilities are the features of the remote detected by SCP.Capabilities.
+type Capabilities struct {
+	// Shell is the shell which runs commands on the remote.
+	Shell ShellType
+	// SCP is true if the scp command of SCPCommand is found.
+	SCP bool
+	// SFTP is true if the sftp subsystem is available.
+	SFTP bool
+	// Sudo is true if sudo runs without asking for a password.
+	// It is always false for shells other than ShellPOSIX.
+	Sudo bool
+}
+
+// shellProbeCommand prints a line which differs by the shell running it.
+// A POSIX shell expands $PSVersionTable to an empty string, cmd.exe expands
+// %COMSPEC% and PowerShell expands $PSVersionTable to the name of its type.
+const shellProbeCommand = `echo "$PSVersionTable %COMSPEC%"`
+
+// Capabilities probes the remote for the shell, the scp command, the sftp
+// subsystem and non-interactive sudo. The result is cached on s, and later
+// calls return it without probing again.
+func (s *SCP) Capabilities() (*Capabilities, error) {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	if s.caps != nil {
+		return s.caps, nil
+	}
+
+	caps, err := s.probe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe remote: %w", err)
+	}
+	logDebug(s.Logger, "remote capabilities detected", "shell", caps.Shell, "scp", caps.SCP, "sftp", caps.SFTP, "sudo", caps.Sudo)
+	s.caps = caps
+	return caps, nil
+}
+
+func (s *SCP) probe() (*Capabilities, error) {
+	out, err := runRemoteCommand(s.transport, shellProbeCommand)
+	if err != nil {
+		return nil, err
+	}
+	caps := &Capabilities{Shell: parseShellProbe(string(out))}
+
+	scpPath := s.scpPath()
+	switch caps.Shell {
+	case ShellPOSIX:
+		script := "command -v " + escapeShellArg(scpPath) + " >/dev/null 2>&1 && echo scp; " +
+			"sudo -n true >/dev/null 2>&1 && echo sudo; true"
+		out, err := runRemoteCommand(s.transport, script)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Fields(string(out)) {
+			switch line {
+			case "scp":
+				caps.SCP = true
+			case "sudo":
+				caps.Sudo = true
+			}
+		}
+	case ShellCmd, ShellPowerShell:
+		cmd := "where " + quoteRemoteArg(caps.Shell, scpPath)
+		if caps.Shell == ShellPowerShell {
+			cmd = "Get-Command " + quoteRemoteArg(caps.Shell, scpPath)
+		}
+		_, err := runRemoteCommand(s.transport, cmd)
+		if _, ok := exitStatus(err); err != nil && !ok {
+			return nil, err
+		}
+		caps.SCP = err == nil
+	}
+
+	caps.SFTP, err = s.probeSFTP()
+	if err != nil {
+		return nil, err
+	}
+	return caps, nil
+}
+
+// parseShellProbe returns the shell from the output of shellProbeCommand.
+func parseShellProbe(out string) ShellType {
+	out = strings.TrimSpace(out)
+	switch {
+	case strings.Contains(strings.ToLower(out), "hashtable"):
+		return ShellPowerShell
+	case strings.HasSuffix(out, "%COMSPEC%"):
+		return ShellPOSIX
+	case strings.HasPrefix(out, `"$PSVersionTable `):
+		return ShellCmd
+	default:
+		return ShellUnknown
+	}
+}
+
+// probeSFTP returns whether the sftp subsystem is available.
+func (s *SCP) probeSFTP() (bool, error) {
+	session, err := s.transport.NewSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+	ss, ok := session.(subsystemSession)
+	if !ok {
+		return false, nil
+	}
+	return ss.RequestSubsystem("sftp") == nil, nil
+}
+
+// scpPath returns the scp command in SCPCommand without the prefix.
+func (s *SCP) scpPath() string {
+	scpPath := strings.TrimSpace(strings.TrimPrefix(s.SCPCommand, s.commandPrefix()))
+	if scpPath == "" {
+		return "scp"
+	}
+	return scpPath
+}
+
+// prepareTransfer probes the remote with Capabilities if AutoDetect is set,
+// and applies the result to o. It returns whether the transfer uses SFTP.
+func (s *SCP) prepareTransfer(o *transferOptions) (useSFTP bool, err error) {
+	if !s.AutoDetect {
+		return s.usesSFTP(), nil
+	}
+	caps, err := s.Capabilities()
+	if err != nil {
+		return false, err
+	}
+	if o.shell == ShellUnknown {
+		o.shell = caps.Shell
+	}
+
+	switch s.Protocol {
+	case ProtocolSFTP:
+		return true, nil
+	case ProtocolAuto:
+		if !caps.SCP && s.Privilege == nil {
+			if !caps.SFTP {
+				return false, fmt.Errorf("%w: %s, and the sftp subsystem is not available", ErrSCPNotFound, s.scpPath())
+			}
+			return true, nil
+		}
+	}
+	if !caps.SCP {
+		return false, fmt.Errorf("%w: %s", ErrSCPNotFound, s.scpPath())
+	}
+	if caps.Shell == ShellPOSIX && !caps.Sudo && s.requiresSudoPassword() {
+		return false, ErrSudoPasswordRequired
+	}
+	return false, nil
+}
+
+// requiresSudoPassword returns whether the remote commands are run with sudo
+// which fails if it asks for a password.
+func (s *SCP) requiresSudoPassword() bool {
+	if p := s.Privilege; p != nil {
+		return p.Method == PrivilegeSudo && p.Password == nil
+	}
+	return usesSudo(s.commandPrefix())
+}
+
+// usesSudo returns whether the command prefix runs the command with sudo.
+func usesSudo(prefix string) bool {
+	for _, word := range strings.Fields(prefix) {
+		if word == "sudo" || strings.HasSuffix(word, "/sudo") {
+			return true
+		}
+	}
+	return false
+}
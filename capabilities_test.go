@@ -0,0 +1,307 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestCapabilities(t *testing.T) {
+	l, err := newTestSFTPServer()
+	if err != nil {
+		t.Fatalf("fail to create test sftp server; %s", err)
+	}
+	defer l.Close()
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sftp server; %s", err)
+	}
+	defer c.Close()
+
+	t.Run("POSIX", func(t *testing.T) {
+		s := scp.NewSCP(c)
+		caps, err := s.Capabilities()
+		if err != nil {
+			t.Fatalf("fail to probe; %s", err)
+		}
+		if caps.Shell != scp.ShellPOSIX || !caps.SCP || !caps.SFTP {
+			t.Errorf("capabilities unmatch; got=%+v", *caps)
+		}
+
+		cached, err := s.Capabilities()
+		if err != nil {
+			t.Fatalf("fail to probe; %s", err)
+		}
+		if cached != caps {
+			t.Errorf("capabilities must be cached")
+		}
+	})
+
+	t.Run("SFTP without scp", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestCapabilities-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestCapabilities-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+		err = ioutil.WriteFile(filepath.Join(localDir, "file1"), []byte("hello"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+
+		logger := &testLogger{}
+		s := scp.NewSCP(c)
+		s.SCPCommand = "/nonexistent/scp"
+		s.AutoDetect = true
+		s.Logger = logger
+		err = s.SendFile(filepath.Join(localDir, "file1"), remoteDir)
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{"file1": "hello"})
+		for _, line := range logger.lines {
+			if strings.HasPrefix(line, "scp session start") {
+				t.Errorf("scp must not be started; %s", line)
+			}
+		}
+
+		s.Protocol = scp.ProtocolSCP
+		err = s.SendFile(filepath.Join(localDir, "file1"), remoteDir)
+		if !errors.Is(err, scp.ErrSCPNotFound) {
+			t.Errorf("unexpected error; got=%v, want=%v", err, scp.ErrSCPNotFound)
+		}
+	})
+}
+
+func TestCapabilitiesWithShells(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	info := scp.NewFileInfo("file1", 5, 0644, modTime, modTime)
+
+	testCases := []struct {
+		name       string
+		shell      scp.ShellType
+		probeOut   string
+		sudo       bool
+		scpCommand string
+		wantErr    error
+		wantCmd    string
+	}{
+		{
+			name:     "POSIX",
+			shell:    scp.ShellPOSIX,
+			probeOut: " %COMSPEC%\n",
+			wantCmd:  `scp -tp '/C:/data dir'`,
+		},
+		{
+			name:     "cmd",
+			shell:    scp.ShellCmd,
+			probeOut: "\"$PSVersionTable C:\\Windows\\system32\\cmd.exe\"\r\n",
+			wantCmd:  `scp -tp "/C:/data dir"`,
+		},
+		{
+			name:     "PowerShell",
+			shell:    scp.ShellPowerShell,
+			probeOut: "System.Management.Automation.PSVersionHashTable %COMSPEC%\r\n",
+			wantCmd:  `scp -tp '/C:/data dir'`,
+		},
+		{
+			name:       "sudo with password",
+			shell:      scp.ShellPOSIX,
+			probeOut:   " %COMSPEC%\n",
+			scpCommand: "sudo scp",
+			wantErr:    scp.ErrSudoPasswordRequired,
+		},
+		{
+			name:       "non-interactive sudo",
+			shell:      scp.ShellPOSIX,
+			probeOut:   " %COMSPEC%\n",
+			sudo:       true,
+			scpCommand: "sudo scp",
+			wantCmd:    `sudo scp -tp '/C:/data dir'`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &fakeShellTransport{probeOut: tc.probeOut, sudo: tc.sudo}
+			s := scp.NewSCPWithTransport(tr)
+			s.SCPCommand = tc.scpCommand
+			s.AutoDetect = true
+
+			err := s.Send(info, ioutil.NopCloser(strings.NewReader("hello")), "/C:/data dir/file1")
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("unexpected error; got=%v, want=%v", err, tc.wantErr)
+				}
+				return
+			}
+			caps, err := s.Capabilities()
+			if err != nil {
+				t.Fatalf("fail to probe; %s", err)
+			}
+			if caps.Shell != tc.shell || !caps.SCP || caps.SFTP || caps.Sudo != tc.sudo {
+				t.Errorf("capabilities unmatch; got=%+v", *caps)
+			}
+			if got := tr.lastCommand(); got != tc.wantCmd {
+				t.Errorf("command unmatch; got=%q, want=%q", got, tc.wantCmd)
+			}
+		})
+	}
+}
+
+// fakeShellTransport is a Transport which answers the commands to probe
+// the remote. Other commands exit with status 1 without output.
+type fakeShellTransport struct {
+	probeOut string
+	sudo     bool
+
+	mu   sync.Mutex
+	cmds []string
+}
+
+func (t *fakeShellTransport) NewSession() (scp.Session, error) {
+	r, w := io.Pipe()
+	return &fakeShellSession{transport: t, stdout: r, stdoutWriter: w}, nil
+}
+
+func (t *fakeShellTransport) lastCommand() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.cmds) == 0 {
+		return ""
+	}
+	return t.cmds[len(t.cmds)-1]
+}
+
+func (t *fakeShellTransport) respond(cmd string) (stdout string, status int) {
+	switch {
+	case strings.Contains(cmd, "$PSVersionTable"):
+		return t.probeOut, 0
+	case strings.HasPrefix(cmd, "command -v "):
+		if t.sudo {
+			return "scp\nsudo\n", 0
+		}
+		return "scp\n", 0
+	case strings.HasPrefix(cmd, "where ") || strings.HasPrefix(cmd, "Get-Command "):
+		return "C:\\Windows\\System32\\OpenSSH\\scp.exe\r\n", 0
+	}
+	t.mu.Lock()
+	t.cmds = append(t.cmds, cmd)
+	t.mu.Unlock()
+	return "", 1
+}
+
+type fakeShellSession struct {
+	transport    *fakeShellTransport
+	stdout       *io.PipeReader
+	stdoutWriter *io.PipeWriter
+	status       int
+}
+
+func (s *fakeShellSession) StdinPipe() (io.WriteCloser, error) {
+	return nopWriteCloser{ioutil.Discard}, nil
+}
+
+func (s *fakeShellSession) StdoutPipe() (io.Reader, error) { return s.stdout, nil }
+
+func (s *fakeShellSession) StderrPipe() (io.Reader, error) { return strings.NewReader(""), nil }
+
+func (s *fakeShellSession) Start(cmd string) error {
+	out, status := s.transport.respond(cmd)
+	s.status = status
+	go func() {
+		io.WriteString(s.stdoutWriter, out)
+		s.stdoutWriter.Close()
+	}()
+	return nil
+}
+
+func (s *fakeShellSession) Wait() error {
+	if s.status != 0 {
+		return fakeExitError(s.status)
+	}
+	return nil
+}
+
+func (s *fakeShellSession) Close() error {
+	s.stdout.Close()
+	return nil
+}
+
+type fakeExitError int
+
+func (e fakeExitError) Error() string   { return fmt.Sprintf("exit status %d", int(e)) }
+func (e fakeExitError) ExitStatus() int { return int(e) }
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestWindowsRemotePaths(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	info := scp.NewFileInfo("file1", 5, 0644, modTime, modTime)
+
+	testCases := []struct {
+		name        string
+		shell       scp.ShellType
+		remotePath  string
+		wantSendCmd string
+		wantRecvCmd string
+	}{
+		{
+			name:        "cmd",
+			shell:       scp.ShellCmd,
+			remotePath:  `C:\data dir\file1`,
+			wantSendCmd: `scp -tp "/C:/data dir"`,
+			wantRecvCmd: `scp -fp "/C:/data dir/file1"`,
+		},
+		{
+			name:        "PowerShell",
+			shell:       scp.ShellPowerShell,
+			remotePath:  `C:\Users\o'brien\file1`,
+			wantSendCmd: `scp -tp '/C:/Users/o''brien'`,
+			wantRecvCmd: `scp -fp '/C:/Users/o''brien/file1'`,
+		},
+		{
+			name:        "drive root",
+			shell:       scp.ShellCmd,
+			remotePath:  `D:\file1`,
+			wantSendCmd: `scp -tp "/D:/"`,
+			wantRecvCmd: `scp -fp "/D:/file1"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &fakeShellTransport{}
+			s := scp.NewSCPWithTransport(tr)
+			s.Shell = tc.shell
+
+			// The fake transport fails the transfers, so only the commands
+			// are checked.
+			s.Send(info, ioutil.NopCloser(strings.NewReader("hello")), tc.remotePath)
+			if got := tr.lastCommand(); got != tc.wantSendCmd {
+				t.Errorf("send command unmatch; got=%q, want=%q", got, tc.wantSendCmd)
+			}
+			s.Receive(tc.remotePath, ioutil.Discard)
+			if got := tr.lastCommand(); got != tc.wantRecvCmd {
+				t.Errorf("receive command unmatch; got=%q, want=%q", got, tc.wantRecvCmd)
+			}
+		})
+	}
+}
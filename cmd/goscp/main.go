@@ -0,0 +1,310 @@
+// Command goscp copies files between hosts like scp using the go-scp library.
+//
+// Usage:
+//
+//	goscp [-r] [-p] [-q] [-P port] [-i identity_file] [-l limit] [-o UserKnownHostsFile=file] source... target
+//
+// Either the sources or the target is a remote path written as
+// [user@]host:path. Copying between two remote hosts is not supported.
+// The host key is verified with ~/.ssh/known_hosts, and the authentication
+// uses ssh-agent and the identity files. The limit is in Kbit/s.
+// Like scp, modification times, access times and modes are preserved only
+// with -p.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func main() {
+	err := run(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "goscp: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+type options struct {
+	recursive      bool
+	preserve       bool
+	quiet          bool
+	port           int
+	identityFile   string
+	limitKbps      int64
+	knownHostsFile string
+}
+
+// location is a local path or a remote path.
+type location struct {
+	user string
+	host string
+	path string
+}
+
+func (l location) isRemote() bool {
+	return l.host != ""
+}
+
+func run(args []string, stderr io.Writer) error {
+	var o options
+	fs := flag.NewFlagSet("goscp", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.BoolVar(&o.recursive, "r", false, "copy directories recursively")
+	fs.BoolVar(&o.preserve, "p", false, "preserve modification times, access times and modes")
+	fs.BoolVar(&o.quiet, "q", false, "do not show the progress bar")
+	fs.IntVar(&o.port, "P", 22, "port of the remote host")
+	fs.StringVar(&o.identityFile, "i", "", "identity file for public key authentication")
+	fs.Int64Var(&o.limitKbps, "l", 0, "bandwidth limit in Kbit/s")
+	fs.Func("o", "ssh option; only UserKnownHostsFile=file is supported", func(v string) error {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], "UserKnownHostsFile") {
+			return fmt.Errorf("unsupported option %q", v)
+		}
+		o.knownHostsFile = kv[1]
+		return nil
+	})
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: goscp [-r] [-p] [-q] [-P port] [-i identity_file] [-l limit] [-o UserKnownHostsFile=file] source... target")
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("source and target are required")
+	}
+
+	var srcs []location
+	for _, arg := range fs.Args()[:fs.NArg()-1] {
+		srcs = append(srcs, parseLocation(arg))
+	}
+	dest := parseLocation(fs.Arg(fs.NArg() - 1))
+
+	remote := dest
+	if !dest.isRemote() {
+		remote = srcs[0]
+		if !remote.isRemote() {
+			return errors.New("either sources or target must be remote")
+		}
+	}
+	for _, src := range srcs {
+		if src.isRemote() == dest.isRemote() {
+			return errors.New("copying between remote hosts or between local paths is not supported")
+		}
+		if src.isRemote() && (src.user != remote.user || src.host != remote.host) {
+			return errors.New("sources must be on the same remote host")
+		}
+	}
+
+	client, err := dial(remote, &o)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	s := scp.NewSCP(client)
+	var opts []scp.Option
+	if !o.preserve {
+		opts = append(opts, scp.WithPreserve(scp.PreserveNone))
+	}
+	if o.limitKbps > 0 {
+		opts = append(opts, scp.WithRateLimit(rateLimitBytes(o.limitKbps)))
+	}
+	var bar *progressBar
+	if !o.quiet && isTerminal(stderr) {
+		bar = &progressBar{w: stderr}
+		opts = append(opts, scp.WithProgress(bar.update))
+	}
+
+	for _, src := range srcs {
+		err = copyOne(s, src, dest, &o, opts)
+		if bar != nil {
+			bar.finish()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rateLimitBytes converts the -l limit in Kbit/s to bytes per second.
+// A Kbit is 1024 bits like scp.
+func rateLimitBytes(kbps int64) int64 {
+	return kbps * 1024 / 8
+}
+
+func copyOne(s *scp.SCP, src, dest location, o *options, opts []scp.Option) error {
+	if dest.isRemote() {
+		fi, err := os.Stat(src.path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if !o.recursive {
+				return fmt.Errorf("%s: not a regular file", src.path)
+			}
+			return s.SendDir(src.path, dest.path, nil, opts...)
+		}
+		return s.SendFile(src.path, dest.path, opts...)
+	}
+
+	if o.recursive {
+		return s.ReceiveDir(src.path, dest.path, nil, opts...)
+	}
+	return s.ReceiveFile(src.path, dest.path, opts...)
+}
+
+// parseLocation parses [user@]host:path. An argument is a local path if
+// it has no colon, a slash appears before the first colon, or it starts
+// with a drive letter on Windows. An IPv6 address is enclosed in brackets.
+func parseLocation(arg string) location {
+	local := location{path: arg}
+	var l location
+	rest := arg
+	if i := strings.IndexAny(rest, "@:/\\"); i > 0 && rest[i] == '@' {
+		l.user, rest = rest[:i], rest[i+1:]
+	}
+
+	if strings.HasPrefix(rest, "[") {
+		i := strings.Index(rest, "]:")
+		if i < 0 {
+			return local
+		}
+		l.host, l.path = rest[1:i], rest[i+2:]
+	} else {
+		i := strings.IndexByte(rest, ':')
+		if i <= 0 || strings.ContainsAny(rest[:i], "/\\") || (runtime.GOOS == "windows" && l.user == "" && i == 1) {
+			return local
+		}
+		l.host, l.path = rest[:i], rest[i+1:]
+	}
+	if l.path == "" {
+		l.path = "."
+	}
+	return l
+}
+
+func dial(remote location, o *options) (*ssh.Client, error) {
+	userName := remote.user
+	if userName == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current user: %w", err)
+		}
+		userName = u.Username
+		if i := strings.LastIndexByte(userName, '\\'); i >= 0 {
+			// Strip the domain on Windows.
+			userName = userName[i+1:]
+		}
+	}
+
+	knownHostsFile := o.knownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts: %w", err)
+	}
+
+	var auths []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			defer conn.Close()
+			auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	signers, err := loadSigners(o.identityFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(signers) > 0 {
+		auths = append(auths, ssh.PublicKeys(signers...))
+	}
+
+	config := &ssh.ClientConfig{
+		User:            userName,
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+	addr := net.JoinHostPort(remote.host, strconv.Itoa(o.port))
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	return client, nil
+}
+
+// loadSigners loads identityFile or, if it is empty, the default identity
+// files which exist and are not encrypted.
+func loadSigners(identityFile string) ([]ssh.Signer, error) {
+	if identityFile != "" {
+		signer, err := loadSigner(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.Signer{signer}, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, nil
+	}
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		signer, err := loadSigner(filepath.Join(home, ".ssh", name))
+		if err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	return signers, nil
+}
+
+func loadSigner(filename string) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity file: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity file %s: %w", filename, err)
+	}
+	return signer, nil
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
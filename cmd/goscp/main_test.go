@@ -0,0 +1,254 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sshd "github.com/hnakamur/go-sshd"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const testUser = "user1"
+
+func TestRun(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "goscp-TestRun")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("fail to generate client key; %s", err)
+	}
+	clientPubKey, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	if err != nil {
+		t.Fatalf("fail to convert client key; %s", err)
+	}
+	identityFile := filepath.Join(tmpDir, "id_rsa")
+	pemData := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(clientKey),
+	})
+	err = ioutil.WriteFile(identityFile, pemData, 0600)
+	if err != nil {
+		t.Fatalf("fail to write identity file; %s", err)
+	}
+
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("fail to generate host key; %s", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("fail to create host signer; %s", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == testUser && bytes.Equal(key.Marshal(), clientPubKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("public key rejected for %q", c.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+	server := sshd.NewServer("sh", config, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen; %s", err)
+	}
+	defer server.Close()
+	go server.Serve(l)
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to get port; %s", err)
+	}
+
+	knownHostsFile := filepath.Join(tmpDir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(l.Addr().String())}, hostSigner.PublicKey())
+	err = ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("fail to write known_hosts; %s", err)
+	}
+	emptyKnownHostsFile := filepath.Join(tmpDir, "empty_known_hosts")
+	err = ioutil.WriteFile(emptyKnownHostsFile, nil, 0600)
+	if err != nil {
+		t.Fatalf("fail to write known_hosts; %s", err)
+	}
+
+	// NOTE: The test sshd does not forward the environment, so the agent is not used.
+	os.Unsetenv("SSH_AUTH_SOCK")
+	commonArgs := []string{"-q", "-P", port, "-i", identityFile, "-o", "UserKnownHostsFile=" + knownHostsFile}
+	remote := testUser + "@127.0.0.1:"
+
+	localDir := filepath.Join(tmpDir, "local")
+	remoteDir := filepath.Join(tmpDir, "remote")
+	for _, dir := range []string{filepath.Join(localDir, "dir1", "sub"), remoteDir} {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+	}
+	files := map[string]string{
+		"file1":          "hello",
+		"dir1/file2":     "world",
+		"dir1/sub/file3": "nested",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(localDir, filepath.FromSlash(name)), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+	}
+
+	runGoscp := func(t *testing.T, args ...string) error {
+		var stderr bytes.Buffer
+		err := run(append(append([]string{}, commonArgs...), args...), &stderr)
+		if err != nil {
+			t.Logf("stderr: %s", stderr.String())
+		}
+		return err
+	}
+
+	t.Run("Upload file", func(t *testing.T) {
+		err := runGoscp(t, filepath.Join(localDir, "file1"), remote+remoteDir)
+		if err != nil {
+			t.Fatalf("fail to run; %s", err)
+		}
+		checkTestFile(t, filepath.Join(remoteDir, "file1"), "hello")
+	})
+
+	t.Run("Upload directory", func(t *testing.T) {
+		err := runGoscp(t, filepath.Join(localDir, "dir1"), remote+remoteDir)
+		if err == nil {
+			t.Error("unexpected success of copying a directory without -r")
+		}
+		err = runGoscp(t, "-r", "-l", "100000", filepath.Join(localDir, "dir1"), remote+remoteDir)
+		if err != nil {
+			t.Fatalf("fail to run; %s", err)
+		}
+		checkTestFile(t, filepath.Join(remoteDir, "dir1", "file2"), "world")
+		checkTestFile(t, filepath.Join(remoteDir, "dir1", "sub", "file3"), "nested")
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		downloadDir := filepath.Join(tmpDir, "download")
+		err := os.Mkdir(downloadDir, 0755)
+		if err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		err = runGoscp(t, remote+filepath.Join(remoteDir, "file1"), downloadDir)
+		if err != nil {
+			t.Fatalf("fail to run; %s", err)
+		}
+		checkTestFile(t, filepath.Join(downloadDir, "file1"), "hello")
+
+		err = runGoscp(t, "-r", remote+filepath.Join(remoteDir, "dir1"), downloadDir)
+		if err != nil {
+			t.Fatalf("fail to run; %s", err)
+		}
+		checkTestFile(t, filepath.Join(downloadDir, "dir1", "sub", "file3"), "nested")
+	})
+
+	t.Run("Preserve", func(t *testing.T) {
+		modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		err := os.Chtimes(filepath.Join(localDir, "file1"), modTime, modTime)
+		if err != nil {
+			t.Fatalf("fail to change time; %s", err)
+		}
+		for _, preserve := range []bool{false, true} {
+			destDir := filepath.Join(remoteDir, fmt.Sprintf("preserve-%v", preserve))
+			err := os.Mkdir(destDir, 0755)
+			if err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+			args := []string{filepath.Join(localDir, "file1"), remote + destDir}
+			if preserve {
+				args = append([]string{"-p"}, args...)
+			}
+			err = runGoscp(t, args...)
+			if err != nil {
+				t.Fatalf("fail to run; %s", err)
+			}
+			fi, err := os.Stat(filepath.Join(destDir, "file1"))
+			if err != nil {
+				t.Fatalf("fail to stat file; %s", err)
+			}
+			if got := fi.ModTime().Equal(modTime); got != preserve {
+				t.Errorf("modTime unmatch with preserve=%v; got=%s", preserve, fi.ModTime())
+			}
+		}
+	})
+
+	t.Run("Unknown host key", func(t *testing.T) {
+		var stderr bytes.Buffer
+		err := run([]string{"-q", "-P", port, "-i", identityFile, "-o", "UserKnownHostsFile=" + emptyKnownHostsFile,
+			filepath.Join(localDir, "file1"), remote + remoteDir}, &stderr)
+		if err == nil || !strings.Contains(err.Error(), "key is unknown") {
+			t.Errorf("unexpected error; got=%v, want unknown key error", err)
+		}
+	})
+}
+
+func TestParseLocation(t *testing.T) {
+	testCases := []struct {
+		arg  string
+		want location
+	}{
+		{arg: "file1", want: location{path: "file1"}},
+		{arg: "/tmp/a:b", want: location{path: "/tmp/a:b"}},
+		{arg: "./a:b", want: location{path: "./a:b"}},
+		{arg: "host:", want: location{host: "host", path: "."}},
+		{arg: "host:/tmp/file1", want: location{host: "host", path: "/tmp/file1"}},
+		{arg: "user@host:file1", want: location{user: "user", host: "host", path: "file1"}},
+		{arg: "[::1]:file1", want: location{host: "::1", path: "file1"}},
+		{arg: "user@[::1]:file1", want: location{user: "user", host: "::1", path: "file1"}},
+	}
+	for _, tc := range testCases {
+		if got := parseLocation(tc.arg); got != tc.want {
+			t.Errorf("location unmatch for %q; got=%+v, want=%+v", tc.arg, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimitBytes(t *testing.T) {
+	testCases := []struct {
+		kbps int64
+		want int64
+	}{
+		{kbps: 8, want: 1024},
+		{kbps: 100, want: 12800},
+		{kbps: 100000, want: 12800000},
+	}
+	for _, tc := range testCases {
+		if got := rateLimitBytes(tc.kbps); got != tc.want {
+			t.Errorf("rate limit unmatch for %d Kbit/s; got=%d, want=%d", tc.kbps, got, tc.want)
+		}
+	}
+}
+
+func checkTestFile(t *testing.T, filename, want string) {
+	t.Helper()
+	got, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("fail to read file; %s", err)
+	}
+	if string(got) != want {
+		t.Errorf("content unmatch for %s; got=%q, want=%q", filename, got, want)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const progressBarWidth = 30
+
+// progressBar shows the progress of the file being transferred in a line.
+type progressBar struct {
+	w       io.Writer
+	name    string
+	start   time.Time
+	last    time.Time
+	started bool
+}
+
+func (b *progressBar) update(name string, transferred, size int64) {
+	now := time.Now()
+	if !b.started || name != b.name || transferred == 0 {
+		b.finish()
+		b.name = name
+		b.start = now
+		b.started = true
+	} else if transferred < size && now.Sub(b.last) < 100*time.Millisecond {
+		return
+	}
+	b.last = now
+
+	ratio := 1.0
+	if size > 0 {
+		ratio = float64(transferred) / float64(size)
+	}
+	filled := int(ratio * progressBarWidth)
+	var rate float64
+	if elapsed := now.Sub(b.start).Seconds(); elapsed > 0 {
+		rate = float64(transferred) / elapsed
+	}
+	fmt.Fprintf(b.w, "\r%-20.20s [%s%s] %3d%% %9s %9s/s",
+		name, strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+		int(ratio*100), formatBytes(float64(transferred)), formatBytes(rate))
+}
+
+// finish ends the line of the current file.
+func (b *progressBar) finish() {
+	if b.started {
+		fmt.Fprintln(b.w)
+		b.started = false
+	}
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
@@ -0,0 +1,251 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DialConfig connects to hostAlias with the settings in DefaultSSHConfigFiles
+// like the ssh command, and returns an SCP which owns the connection.
+// The caller must call Close of the returned SCP after using it.
+func DialConfig(hostAlias string) (*SCP, error) {
+	c, err := LoadSSHConfig(DefaultSSHConfigFiles()...)
+	if err != nil {
+		return nil, err
+	}
+	return c.Dial(hostAlias)
+}
+
+// Dial connects to hostAlias with the settings in c through the jump hosts
+// of ProxyJump, and returns an SCP which owns the connections.
+// The jump hosts are resolved with c too, but their ProxyJump is not used.
+// The caller must call Close of the returned SCP after using it.
+func (c *SSHConfig) Dial(hostAlias string) (*SCP, error) {
+	target, err := c.Resolve(hostAlias)
+	if err != nil {
+		return nil, err
+	}
+
+	var hops []*HostConfig
+	for _, jump := range target.ProxyJump {
+		userName, host, port, err := splitJumpHost(jump)
+		if err != nil {
+			return nil, err
+		}
+		h, err := c.Resolve(host)
+		if err != nil {
+			return nil, err
+		}
+		if userName != "" {
+			h.User = userName
+		}
+		if port != 0 {
+			h.Port = port
+		}
+		hops = append(hops, h)
+	}
+	hops = append(hops, target)
+
+	// The connections to the ssh-agent are used to sign while connecting,
+	// so they are closed after DialJump returns.
+	var agents []io.Closer
+	defer func() {
+		for _, a := range agents {
+			a.Close()
+		}
+	}()
+	jumpHops := make([]Hop, 0, len(hops))
+	for _, h := range hops {
+		config, agentConn, err := h.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, agentConn)
+		jumpHops = append(jumpHops, Hop{Addr: h.Addr(), Config: config})
+	}
+	return DialJump(jumpHops...)
+}
+
+// splitJumpHost splits a jump host in the form of [user@]host[:port].
+// port is zero if it is not specified.
+func splitJumpHost(jump string) (userName, host string, port int, err error) {
+	host = jump
+	if i := strings.LastIndexByte(host, '@'); i >= 0 {
+		userName, host = host[:i], host[i+1:]
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		port, err = strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return "", "", 0, fmt.Errorf("invalid port in jump host %q", jump)
+		}
+		host = h
+	} else {
+		host = strings.Trim(host, "[]")
+	}
+	if host == "" {
+		return "", "", 0, fmt.Errorf("invalid jump host %q", jump)
+	}
+	return userName, host, port, nil
+}
+
+// Addr returns the address of the host in the form of host:port.
+func (h *HostConfig) Addr() string {
+	return net.JoinHostPort(h.HostName, strconv.Itoa(h.Port))
+}
+
+// ClientConfig returns the client config for the host. The authentication
+// uses the ssh-agent at SSH_AUTH_SOCK and the identity files which exist
+// and are not protected with passphrases.
+// The host key is verified with UserKnownHostsFiles according to
+// StrictHostKeyChecking. With "accept-new", unknown host keys are added to
+// the first known_hosts file. With "no", unknown host keys are added too,
+// and changed host keys are accepted.
+//
+// The connection to the ssh-agent is kept open since the agent signs
+// while connecting with the returned config. The caller must close
+// agentConn after connecting. It is not nil even if no agent is used.
+func (h *HostConfig) ClientConfig() (config *ssh.ClientConfig, agentConn io.Closer, err error) {
+	var conn agentCloser
+	var agentClient agent.ExtendedAgent
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if c, err := net.Dial("unix", sock); err == nil {
+			conn.conn = c
+			agentClient = agent.NewClient(c)
+		}
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	var signers []ssh.Signer
+	for _, file := range h.IdentityFiles {
+		key, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to read identity file: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			var passErr *ssh.PassphraseMissingError
+			if errors.As(err, &passErr) {
+				continue
+			}
+			return nil, nil, fmt.Errorf("failed to parse identity file %s: %w", file, err)
+		}
+		signers = append(signers, signer)
+	}
+	// The keys of the agent and the identity files are tried by a single
+	// method since the ssh client does not try another publickey method.
+	var auths []ssh.AuthMethod
+	if agentClient != nil || len(signers) > 0 {
+		auths = append(auths, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			var all []ssh.Signer
+			if agentClient != nil {
+				agentSigners, err := agentClient.Signers()
+				if err == nil {
+					all = append(all, agentSigners...)
+				}
+			}
+			return append(all, signers...), nil
+		}))
+	}
+
+	hostKeyCallback, err := h.hostKeyCallback()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            h.User,
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, conn, nil
+}
+
+// agentCloser closes the connection to the ssh-agent if it is opened.
+type agentCloser struct {
+	conn net.Conn
+}
+
+func (c agentCloser) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (h *HostConfig) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	var files []string
+	for _, file := range h.UserKnownHostsFiles {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	verify := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return &knownhosts.KeyError{}
+	}
+	if len(files) > 0 {
+		callback, err := knownhosts.New(files...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read known_hosts: %w", err)
+		}
+		verify = callback
+	}
+	if h.StrictHostKeyChecking == "yes" {
+		return verify, nil
+	}
+
+	var mu sync.Mutex
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := verify(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			if h.StrictHostKeyChecking == "no" {
+				return nil
+			}
+			return err
+		}
+		if len(h.UserKnownHostsFiles) == 0 {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return appendKnownHost(h.UserKnownHostsFiles[0], hostname, key)
+	}, nil
+}
+
+func appendKnownHost(file, hostname string, key ssh.PublicKey) error {
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create directory for known_hosts: %w", err)
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known_hosts: %w", err)
+	}
+	_, err = io.WriteString(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)+"\n")
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write known_hosts: %w", err)
+	}
+	return f.Close()
+}
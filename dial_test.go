@@ -0,0 +1,515 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+	sshd "github.com/hnakamur/go-sshd"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestSSHConfigResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-scp-TestSSHConfigResolve")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := `# comment
+Host web? !web9
+    HostName %h.example.com
+    Port=2222
+    IdentityFile /keys/%r@%h
+
+Host web*
+    User deploy
+    Port 22
+    IdentityFile "/keys/with space"
+
+Host bastion
+    HostName 192.0.2.1
+    ProxyJump none
+
+Match user foo
+    User ignored
+
+Include ` + filepath.Join(dir, "conf.d", "*") + `
+
+Host *
+    User default
+    ProxyJump admin@bastion:2200,bastion2
+    UserKnownHostsFile /kh/known_hosts /kh/known_hosts2
+    StrictHostKeyChecking accept-new
+`
+	err = os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	if err != nil {
+		t.Fatalf("fail to create directory; %s", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "conf.d", "db"), []byte("Host db\n  HostName 192.0.2.2\n  StrictHostKeyChecking no\n"), 0644)
+	if err != nil {
+		t.Fatalf("fail to write config; %s", err)
+	}
+	configFile := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(configFile, []byte(config), 0644)
+	if err != nil {
+		t.Fatalf("fail to write config; %s", err)
+	}
+
+	c, err := scp.LoadSSHConfig(configFile, filepath.Join(dir, "no-such-config"))
+	if err != nil {
+		t.Fatalf("fail to load config; %s", err)
+	}
+	testCases := []scp.HostConfig{
+		{
+			Alias:                 "web1",
+			HostName:              "web1.example.com",
+			Port:                  2222,
+			User:                  "deploy",
+			IdentityFiles:         []string{"/keys/deploy@web1.example.com", "/keys/with space"},
+			ProxyJump:             []string{"admin@bastion:2200", "bastion2"},
+			UserKnownHostsFiles:   []string{"/kh/known_hosts", "/kh/known_hosts2"},
+			StrictHostKeyChecking: "accept-new",
+		},
+		{
+			Alias:                 "web9",
+			HostName:              "web9",
+			Port:                  22,
+			User:                  "deploy",
+			IdentityFiles:         []string{"/keys/with space"},
+			ProxyJump:             []string{"admin@bastion:2200", "bastion2"},
+			UserKnownHostsFiles:   []string{"/kh/known_hosts", "/kh/known_hosts2"},
+			StrictHostKeyChecking: "accept-new",
+		},
+		{
+			Alias:                 "bastion",
+			HostName:              "192.0.2.1",
+			Port:                  22,
+			User:                  "default",
+			UserKnownHostsFiles:   []string{"/kh/known_hosts", "/kh/known_hosts2"},
+			StrictHostKeyChecking: "accept-new",
+		},
+		{
+			Alias:                 "db",
+			HostName:              "192.0.2.2",
+			Port:                  22,
+			User:                  "default",
+			ProxyJump:             []string{"admin@bastion:2200", "bastion2"},
+			UserKnownHostsFiles:   []string{"/kh/known_hosts", "/kh/known_hosts2"},
+			StrictHostKeyChecking: "no",
+		},
+	}
+	for _, want := range testCases {
+		got, err := c.Resolve(want.Alias)
+		if err != nil {
+			t.Errorf("fail to resolve %s; %s", want.Alias, err)
+			continue
+		}
+		if want.IdentityFiles == nil {
+			// The default identity files are used.
+			if len(got.IdentityFiles) != 3 {
+				t.Errorf("default identity files unmatch for %s; got=%v", want.Alias, got.IdentityFiles)
+			}
+			got.IdentityFiles = nil
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("config unmatch for %s;\ngot= %+v\nwant=%+v", want.Alias, *got, want)
+		}
+	}
+}
+
+func TestDialConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-scp-TestDialConfig")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	clientKey, identityFile := generateTestIdentityFile(t, dir)
+	server, hostKey, err := newTestKeyAuthSshdServer(clientKey.PublicKey())
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer server.Close()
+	jump, jumpHostKey, err := newTestJumpServer(clientKey.PublicKey())
+	if err != nil {
+		t.Fatalf("fail to create test jump server; %s", err)
+	}
+	defer jump.Close()
+
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	writeKnownHosts(t, knownHostsFile, map[string]ssh.PublicKey{
+		server.Addr().String(): hostKey,
+		jump.Addr().String():   jumpHostKey,
+	})
+
+	_, port, _ := net.SplitHostPort(server.Addr().String())
+	_, jumpPort, _ := net.SplitHostPort(jump.Addr().String())
+	config := fmt.Sprintf(`Host target
+    HostName 127.0.0.1
+    Port %s
+
+Host jump
+    HostName 127.0.0.1
+    Port %s
+
+Host via-jump
+    HostName 127.0.0.1
+    Port %s
+    ProxyJump jump
+
+# go-sshd stops serving after a failed handshake, so the host key checks
+# are done against the jump server.
+Host unknown accept-new
+    HostName 127.0.0.1
+    Port %s
+    UserKnownHostsFile %s
+
+Host accept-new
+    StrictHostKeyChecking accept-new
+
+Host *
+    User %s
+    IdentityFile %s
+    UserKnownHostsFile %s
+`, port, jumpPort, port, jumpPort, filepath.Join(dir, "new_known_hosts"), testSshdUser, identityFile, knownHostsFile)
+	configFile := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(configFile, []byte(config), 0644)
+	if err != nil {
+		t.Fatalf("fail to write config; %s", err)
+	}
+	c, err := scp.LoadSSHConfig(configFile)
+	if err != nil {
+		t.Fatalf("fail to load config; %s", err)
+	}
+
+	sendAndCheck := func(t *testing.T, s *scp.SCP) {
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestDialConfig-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+		info := scp.NewFileInfo("file1", 5, 0644, time.Now(), time.Now())
+		err = s.Send(info, ioutil.NopCloser(strings.NewReader("hello")), filepath.Join(remoteDir, "file1"))
+		if err != nil {
+			t.Fatalf("fail to send; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{"file1": "hello"})
+	}
+
+	t.Run("Direct", func(t *testing.T) {
+		s, err := c.Dial("target")
+		if err != nil {
+			t.Fatalf("fail to dial; %s", err)
+		}
+		defer s.Close()
+		sendAndCheck(t, s)
+	})
+
+	t.Run("ProxyJump", func(t *testing.T) {
+		s, err := c.Dial("via-jump")
+		if err != nil {
+			t.Fatalf("fail to dial; %s", err)
+		}
+		defer s.Close()
+		sendAndCheck(t, s)
+	})
+
+	t.Run("Unknown host key", func(t *testing.T) {
+		_, err := c.Dial("unknown")
+		if err == nil || !strings.Contains(err.Error(), "key is unknown") {
+			t.Errorf("unexpected error; got=%v, want unknown key error", err)
+		}
+	})
+
+	t.Run("Accept new host key", func(t *testing.T) {
+		s, err := c.Dial("accept-new")
+		if err != nil {
+			t.Fatalf("fail to dial; %s", err)
+		}
+		s.Close()
+
+		// The key is added to known_hosts.
+		s, err = c.Dial("unknown")
+		if err != nil {
+			t.Fatalf("fail to dial with added key; %s", err)
+		}
+		s.Close()
+	})
+}
+
+func TestDialConfigAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-scp-TestDialConfigAgent")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The key is only in the agent.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("fail to generate key; %s", err)
+	}
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: key})
+	if err != nil {
+		t.Fatalf("fail to add key to agent; %s", err)
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	agentListener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("fail to listen agent socket; %s", err)
+	}
+	defer agentListener.Close()
+	served := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := agentListener.Accept()
+			if err != nil {
+				return
+			}
+			agent.ServeAgent(keyring, conn)
+			conn.Close()
+			served <- struct{}{}
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("fail to create signer; %s", err)
+	}
+	server, hostKey, err := newTestKeyAuthSshdServer(signer.PublicKey())
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer server.Close()
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	writeKnownHosts(t, knownHostsFile, map[string]ssh.PublicKey{server.Addr().String(): hostKey})
+
+	_, port, _ := net.SplitHostPort(server.Addr().String())
+	config := fmt.Sprintf(`Host target
+    HostName 127.0.0.1
+    Port %s
+    User %s
+    IdentityFile %s
+    UserKnownHostsFile %s
+`, port, testSshdUser, filepath.Join(dir, "id_missing"), knownHostsFile)
+	configFile := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(configFile, []byte(config), 0644)
+	if err != nil {
+		t.Fatalf("fail to write config; %s", err)
+	}
+	c, err := scp.LoadSSHConfig(configFile)
+	if err != nil {
+		t.Fatalf("fail to load config; %s", err)
+	}
+
+	s, err := c.Dial("target")
+	if err != nil {
+		t.Fatalf("fail to dial with agent; %s", err)
+	}
+	defer s.Close()
+
+	// The connection to the agent is closed after dialing.
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Error("connection to agent is not closed")
+	}
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestDialConfigAgent-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+	info := scp.NewFileInfo("file1", 5, 0644, time.Now(), time.Now())
+	err = s.Send(info, ioutil.NopCloser(strings.NewReader("hello")), filepath.Join(remoteDir, "file1"))
+	if err != nil {
+		t.Fatalf("fail to send; %s", err)
+	}
+	checkFileContents(t, remoteDir, map[string]string{"file1": "hello"})
+
+	// ClientConfig returns the connection to the agent for the caller to
+	// close after connecting.
+	h, err := c.Resolve("target")
+	if err != nil {
+		t.Fatalf("fail to resolve host; %s", err)
+	}
+	clientConfig, agentConn, err := h.ClientConfig()
+	if err != nil {
+		t.Fatalf("fail to get client config; %s", err)
+	}
+	client, err := ssh.Dial("tcp", h.Addr(), clientConfig)
+	if err != nil {
+		t.Fatalf("fail to dial with client config; %s", err)
+	}
+	client.Close()
+	err = agentConn.Close()
+	if err != nil {
+		t.Errorf("fail to close agent connection; %s", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Error("connection to agent is not closed")
+	}
+}
+
+func generateTestIdentityFile(t *testing.T, dir string) (ssh.Signer, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("fail to generate key; %s", err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	identityFile := filepath.Join(dir, "id_rsa")
+	err = ioutil.WriteFile(identityFile, pemData, 0600)
+	if err != nil {
+		t.Fatalf("fail to write identity file; %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("fail to create signer; %s", err)
+	}
+	return signer, identityFile
+}
+
+func writeKnownHosts(t *testing.T, file string, keys map[string]ssh.PublicKey) {
+	var b bytes.Buffer
+	for addr, key := range keys {
+		b.WriteString(knownhosts.Line([]string{knownhosts.Normalize(addr)}, key) + "\n")
+	}
+	err := ioutil.WriteFile(file, b.Bytes(), 0600)
+	if err != nil {
+		t.Fatalf("fail to write known_hosts; %s", err)
+	}
+}
+
+// newTestKeyAuthServerConfig returns the server config which accepts clientKey
+// of testSshdUser.
+func newTestKeyAuthServerConfig(clientKey ssh.PublicKey) (*ssh.ServerConfig, ssh.PublicKey, error) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == testSshdUser && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("public key rejected for %q", c.User())
+		},
+	}
+	key, err := generateTestSshdKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	private, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.AddHostKey(private)
+	return config, private.PublicKey(), nil
+}
+
+// newTestKeyAuthSshdServer starts a test sshd server with public key authentication.
+func newTestKeyAuthSshdServer(clientKey ssh.PublicKey) (l net.Listener, hostKey ssh.PublicKey, err error) {
+	config, hostKey, err := newTestKeyAuthServerConfig(clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	go sshd.NewServer(testSshdShell, config, nil).Serve(l)
+	return l, hostKey, nil
+}
+
+// newTestJumpServer starts an ssh server which only forwards direct-tcpip channels.
+func newTestJumpServer(clientKey ssh.PublicKey) (l net.Listener, hostKey ssh.PublicKey, err error) {
+	config, hostKey, err := newTestKeyAuthServerConfig(clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newCh := range chans {
+					if newCh.ChannelType() != "direct-tcpip" {
+						newCh.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+						continue
+					}
+					go forwardTestDirectTCPIP(newCh)
+				}
+			}()
+		}
+	}()
+	return l, hostKey, nil
+}
+
+func forwardTestDirectTCPIP(newCh ssh.NewChannel) {
+	// The payload starts with the host as a string and the port as uint32.
+	data := newCh.ExtraData()
+	if len(data) < 4 {
+		newCh.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint32(len(data)) < 8+n {
+		newCh.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+	host := string(data[4 : 4+n])
+	port := binary.BigEndian.Uint32(data[4+n:])
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(ch, target)
+		ch.Close()
+	}()
+	io.Copy(target, ch)
+	target.Close()
+}
@@ -0,0 +1,100 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestDirectoryTimes(t *testing.T) {
+	// dirs are the directories of the tree from the deepest, so that their
+	// times are set after their entries are created.
+	dirs := []string{"sub1/sub2", "sub1", "."}
+	modTimes := map[string]time.Time{
+		".":         time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		"sub1":      time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC),
+		"sub1/sub2": time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+	makeTree := func(t *testing.T, root string) {
+		t.Helper()
+		err := os.MkdirAll(filepath.Join(root, "sub1", "sub2"), 0755)
+		if err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		for _, name := range []string{"file1", "sub1/file2", "sub1/sub2/file3"} {
+			err = ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(name)), []byte("hello"), 0644)
+			if err != nil {
+				t.Fatalf("fail to write file; %s", err)
+			}
+		}
+		for _, dir := range dirs {
+			err = os.Chtimes(filepath.Join(root, filepath.FromSlash(dir)), modTimes[dir], modTimes[dir])
+			if err != nil {
+				t.Fatalf("fail to change times; %s", err)
+			}
+		}
+	}
+	checkTree := func(t *testing.T, root string) {
+		t.Helper()
+		for _, dir := range dirs {
+			fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(dir)))
+			if err != nil {
+				t.Fatalf("fail to stat directory; %s", err)
+			}
+			if got, want := fi.ModTime(), modTimes[dir]; !got.Equal(want) {
+				t.Errorf("modTime of %s unmatch; got=%s, want=%s", dir, got, want)
+			}
+		}
+	}
+
+	forEachTestBackend(t, func(t *testing.T, s *scp.SCP, localDir, remoteDir string) {
+		makeTree(t, filepath.Join(localDir, "src"))
+		makeTree(t, filepath.Join(remoteDir, "src"))
+		testCases := []struct {
+			name string
+			// destExists is true if the destination directory exists,
+			// so the source directory is copied into it.
+			destExists bool
+			receive    bool
+		}{
+			{name: "SendDir to new directory"},
+			{name: "SendDir to existing directory", destExists: true},
+			{name: "ReceiveDir to new directory", receive: true},
+			{name: "ReceiveDir to existing directory", destExists: true, receive: true},
+		}
+		for i, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				srcDir := filepath.Join(localDir, "src")
+				destDir := filepath.Join(remoteDir, fmt.Sprintf("dest%d", i))
+				transfer := s.SendDir
+				if tc.receive {
+					srcDir = filepath.Join(remoteDir, "src")
+					destDir = filepath.Join(localDir, fmt.Sprintf("dest%d", i))
+					transfer = s.ReceiveDir
+				}
+				copiedDir := destDir
+				if tc.destExists {
+					err := os.Mkdir(destDir, 0755)
+					if err != nil {
+						t.Fatalf("fail to create directory; %s", err)
+					}
+					copiedDir = filepath.Join(destDir, "src")
+				}
+
+				err := transfer(srcDir, destDir, nil)
+				if err != nil {
+					t.Fatalf("fail to copy directory; %s", err)
+				}
+				checkTree(t, copiedDir)
+			})
+		}
+	})
+}
@@ -1,4 +1,19 @@
 // Package scp provides functions to copy a single file or
 // to copy files and directories under a directory recursively
 // between the localhost and a remote server.
+//
+// # Timestamps
+//
+// The scp protocol carries modification and access times in microseconds.
+// Times of sent files are truncated to microseconds, and the remote scp
+// command sets them with that precision. Times of received files have the
+// precision sent by the remote scp command, which is seconds with OpenSSH.
+// SFTP carries times in seconds, so they are truncated to seconds with
+// ProtocolSFTP. Local times are read with the precision of the platform,
+// which is nanoseconds on Linux and macOS and 100 nanoseconds on Windows,
+// and remote times listed with the find command have nanosecond precision.
+//
+// The overwrite policies compare modification times in seconds by default
+// because of the precision of received times. WithModTimeTolerance changes
+// the comparison.
 package scp
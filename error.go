@@ -1,5 +1,32 @@
 package scp
 
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrFileChanged is the error reported when the content of a file being
+// sent does not match the size announced to the remote.
+// The remote file is padded with zeros or truncated to the announced size.
+var ErrFileChanged = errors.New("file changed size during transfer")
+
+// ErrSCPNotFound is the error reported when the scp command is not found
+// on the remote.
+var ErrSCPNotFound = errors.New("scp command not found on the remote")
+
+// exitStatusCommandNotFound is the exit status of POSIX shells
+// when a command is not found.
+const exitStatusCommandNotFound = 127
+
+// scpNotFoundError returns an error wrapping ErrSCPNotFound if err from
+// the scp command shows that the command is not found. Otherwise it returns err.
+func scpNotFoundError(err error, scpPath string) error {
+	if status, ok := exitStatus(err); ok && status == exitStatusCommandNotFound {
+		return fmt.Errorf("%w: %s", ErrSCPNotFound, scpPath)
+	}
+	return err
+}
+
 type protocolError struct {
 	msg   string
 	fatal bool
@@ -5,3 +5,40 @@ import "strings"
 func escapeShellArg(arg string) string {
 	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
 }
+
+// quoteRemoteArg quotes arg for the remote shell.
+func quoteRemoteArg(shell ShellType, arg string) string {
+	switch shell {
+	case ShellCmd:
+		return escapeCmdArg(arg)
+	case ShellPowerShell:
+		return escapePowerShellArg(arg)
+	default:
+		return escapeShellArg(arg)
+	}
+}
+
+// escapeCmdArg quotes arg for cmd.exe. Special characters like & and ^
+// are literal in double quotes. Double quotes cannot be in Windows file
+// names, and they are doubled as most programs read them.
+// NOTE: cmd.exe has no way to escape % in double quotes, so %NAME% in arg
+// is expanded if the environment variable NAME is defined.
+func escapeCmdArg(arg string) string {
+	return `"` + strings.Replace(arg, `"`, `""`, -1) + `"`
+}
+
+// powerShellSingleQuotes are the characters which PowerShell treats as
+// a single quote.
+var powerShellSingleQuotes = strings.NewReplacer(
+	"'", "''",
+	"\u2018", "\u2018\u2018",
+	"\u2019", "\u2019\u2019",
+	"\u201a", "\u201a\u201a",
+	"\u201b", "\u201b\u201b",
+)
+
+// escapePowerShellArg quotes arg in single quotes for PowerShell, in which
+// nothing but single quotes is special.
+func escapePowerShellArg(arg string) string {
+	return "'" + powerShellSingleQuotes.Replace(arg) + "'"
+}
@@ -1,6 +1,7 @@
 package scp
 
 import (
+	"fmt"
 	"os"
 	"syscall"
 	"time"
@@ -25,3 +26,21 @@ func newFileInfoFromOS(fi os.FileInfo, replaceName string) *FileInfo {
 
 	return NewFileInfo(name, fi.Size(), fi.Mode(), modTime, accessTime)
 }
+
+// localOwner returns the user and group IDs of fi as an argument of chown.
+func localOwner(fi os.FileInfo) (string, error) {
+	sysStat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("no owner for %s", fi.Name())
+	}
+	return fmt.Sprintf("%d:%d", sysStat.Uid, sysStat.Gid), nil
+}
+
+// localFileID returns the ID of fi if it has other hard links.
+func localFileID(fi os.FileInfo) (fileID, bool) {
+	sysStat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || sysStat.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(sysStat.Dev), ino: uint64(sysStat.Ino)}, true
+}
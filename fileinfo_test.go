@@ -0,0 +1,50 @@
+package scp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNewFileInfoFromOS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-scp-TestNewFileInfoFromOS")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file1")
+	err = ioutil.WriteFile(name, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	atime := time.Date(2021, 2, 3, 4, 5, 6, 987654321, time.UTC)
+	err = os.Chtimes(name, atime, mtime)
+	if err != nil {
+		t.Fatalf("fail to change times; %s", err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("fail to stat file; %s", err)
+	}
+
+	precision := time.Nanosecond
+	if runtime.GOOS == "windows" {
+		precision = 100 * time.Nanosecond
+	}
+	if !fi.ModTime().Equal(mtime.Truncate(precision)) {
+		t.Skipf("file system does not keep precise times; got=%s", fi.ModTime())
+	}
+
+	info := newFileInfoFromOS(fi, "")
+	if got, want := info.ModTime(), mtime.Truncate(precision); !got.Equal(want) {
+		t.Errorf("modTime unmatch; got=%s, want=%s", got, want)
+	}
+	if got, want := info.AccessTime(), atime.Truncate(precision); !got.Equal(want) {
+		t.Errorf("accessTime unmatch; got=%s, want=%s", got, want)
+	}
+}
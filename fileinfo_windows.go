@@ -1,6 +1,7 @@
 package scp
 
 import (
+	"errors"
 	"os"
 	"syscall"
 	"time"
@@ -24,3 +25,14 @@ func newFileInfoFromOS(fi os.FileInfo, replaceName string) *FileInfo {
 
 	return NewFileInfo(name, fi.Size(), fi.Mode(), modTime, accessTime)
 }
+
+// localOwner returns an error since local files have no user and group IDs
+// on Windows.
+func localOwner(fi os.FileInfo) (string, error) {
+	return "", errors.New("local owners are not supported on windows")
+}
+
+// localFileID returns false since hard links are not detected on Windows.
+func localFileID(fi os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,123 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// notExistMarker is printed by the remote scripts in this file
+// when the target file does not exist.
+const notExistMarker = "go-scp: not exist"
+
+// Stat returns the information of the remote file. If name is a symbolic
+// link, the information of the link target is returned.
+// If the file does not exist, the error satisfies os.IsNotExist.
+// The remote must have the find command with the -printf action like GNU findutils.
+func (s *SCP) Stat(name string) (*FileInfo, error) {
+	infos, err := s.findRemote(name, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	info := infos[""]
+	if info == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return info, nil
+}
+
+// ReadDir returns the information of the entries in the remote directory
+// sorted by name. If the directory does not exist, the error satisfies
+// os.IsNotExist.
+// The remote must have the find command with the -printf action like GNU findutils.
+func (s *SCP) ReadDir(name string) ([]*FileInfo, error) {
+	infos, err := s.findRemote(name, true, 1)
+	if err != nil {
+		return nil, err
+	}
+	root := infos[""]
+	if root == nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	if !root.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	entries := make([]*FileInfo, 0, len(infos)-1)
+	for rel, info := range infos {
+		if rel != "" {
+			entries = append(entries, info)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// MkdirAll creates the remote directory name along with any necessary
+// parents like mkdir -p. The perm is set to the directory name only if it
+// is created, and the parents are created with the remote umask.
+// It does nothing if name is already a directory.
+func (s *SCP) MkdirAll(name string, perm os.FileMode) error {
+	script := fmt.Sprintf("mkdir -p -m %o -- %s", perm&os.ModePerm, escapeShellArg(name))
+	_, err := runRemoteCommand(s.commandTransport(), s.shellCommand(script))
+	if err != nil {
+		return fmt.Errorf("failed to create remote directory %s: %w", name, err)
+	}
+	return nil
+}
+
+// Remove removes the remote file or empty directory.
+// If the file does not exist, the error satisfies os.IsNotExist.
+func (s *SCP) Remove(name string) error {
+	arg := escapeShellArg(name)
+	script := "if [ -d " + arg + " ] && [ ! -L " + arg + " ]; then rmdir -- " + arg +
+		"; else rm -- " + arg + "; fi"
+	err := s.runRemoteFileScript(name, script)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+		}
+		return fmt.Errorf("failed to remove remote file %s: %w", name, err)
+	}
+	return nil
+}
+
+// Rename renames the remote file oldname to newname in the same way as
+// mv. If newname exists and is not a directory, it is replaced.
+// Unlike mv, it fails if newname is an existing directory instead of
+// moving oldname into it.
+// If oldname does not exist, the error satisfies os.IsNotExist.
+func (s *SCP) Rename(oldname, newname string) error {
+	newArg := escapeShellArg(newname)
+	script := "if [ -d " + newArg + " ] && [ ! -L " + newArg + " ]; then echo " +
+		escapeShellArg(newname+": is a directory") + " >&2; exit 1; fi; mv -f -- " +
+		escapeShellArg(oldname) + " " + newArg
+	err := s.runRemoteFileScript(oldname, script)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+		}
+		return fmt.Errorf("failed to rename remote file %s to %s: %w", oldname, newname, err)
+	}
+	return nil
+}
+
+// runRemoteFileScript runs script if the remote file name exists.
+// It returns os.ErrNotExist if name does not exist.
+func (s *SCP) runRemoteFileScript(name, script string) error {
+	arg := escapeShellArg(name)
+	script = "if [ ! -e " + arg + " ] && [ ! -L " + arg + " ]; then echo " +
+		escapeShellArg(notExistMarker) + "; exit 0; fi; " + script
+	out, err := runRemoteCommand(s.commandTransport(), s.shellCommand(script))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(out)) == notExistMarker {
+		return os.ErrNotExist
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestRemoteFileSystem(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestRemoteFileSystem-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = writeFileWithModTime(filepath.Join(remoteDir, "file1"), []byte("hello"), modTime)
+	if err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
+	err = os.Chmod(filepath.Join(remoteDir, "file1"), 0640)
+	if err != nil {
+		t.Fatalf("fail to chmod file; %s", err)
+	}
+	err = os.Symlink("file1", filepath.Join(remoteDir, "link1"))
+	if err != nil {
+		t.Fatalf("fail to create symlink; %s", err)
+	}
+	err = os.Mkdir(filepath.Join(remoteDir, "dir1"), 0755)
+	if err != nil {
+		t.Fatalf("fail to create directory; %s", err)
+	}
+
+	sc := scp.NewSCP(c)
+
+	t.Run("Stat", func(t *testing.T) {
+		for _, name := range []string{"file1", "link1"} {
+			info, err := sc.Stat(filepath.Join(remoteDir, name))
+			if err != nil {
+				t.Fatalf("fail to stat %s; %s", name, err)
+			}
+			if info.Name() != name || info.Size() != 5 || info.Mode() != 0640 || !info.ModTime().Equal(modTime) {
+				t.Errorf("file info unmatch for %s; name=%s, size=%d, mode=%s, modTime=%s",
+					name, info.Name(), info.Size(), info.Mode(), info.ModTime())
+			}
+		}
+
+		info, err := sc.Stat(filepath.Join(remoteDir, "dir1"))
+		if err != nil {
+			t.Fatalf("fail to stat dir1; %s", err)
+		}
+		if !info.IsDir() {
+			t.Errorf("dir1 must be a directory; mode=%s", info.Mode())
+		}
+
+		_, err = sc.Stat(filepath.Join(remoteDir, "no-such-file"))
+		if !os.IsNotExist(err) {
+			t.Errorf("unexpected error; got=%v, want not exist error", err)
+		}
+	})
+
+	t.Run("Stat with command prefix", func(t *testing.T) {
+		sc := scp.NewSCP(c)
+		sc.SCPCommand = "env LC_ALL=C scp"
+		info, err := sc.Stat(filepath.Join(remoteDir, "file1"))
+		if err != nil {
+			t.Fatalf("fail to stat; %s", err)
+		}
+		if info.Size() != 5 {
+			t.Errorf("size unmatch; got=%d, want=5", info.Size())
+		}
+	})
+
+	t.Run("ReadDir", func(t *testing.T) {
+		entries, err := sc.ReadDir(remoteDir)
+		if err != nil {
+			t.Fatalf("fail to read directory; %s", err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if len(names) != 3 || names[0] != "dir1" || names[1] != "file1" || names[2] != "link1" {
+			t.Errorf("entries unmatch; got=%v", names)
+		}
+		if entries[2].Mode()&os.ModeSymlink == 0 {
+			t.Errorf("link1 must be a symbolic link; mode=%s", entries[2].Mode())
+		}
+
+		_, err = sc.ReadDir(filepath.Join(remoteDir, "file1"))
+		if err == nil {
+			t.Errorf("read directory of a file must fail")
+		}
+		_, err = sc.ReadDir(filepath.Join(remoteDir, "no-such-dir"))
+		if !os.IsNotExist(err) {
+			t.Errorf("unexpected error; got=%v, want not exist error", err)
+		}
+	})
+
+	t.Run("MkdirAll", func(t *testing.T) {
+		name := filepath.Join(remoteDir, "a", "b", "c")
+		err := sc.MkdirAll(name, 0750)
+		if err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("fail to stat directory; %s", err)
+		}
+		if !fi.IsDir() || fi.Mode().Perm() != 0750 {
+			t.Errorf("directory mode unmatch; got=%s", fi.Mode())
+		}
+
+		err = sc.MkdirAll(name, 0750)
+		if err != nil {
+			t.Errorf("fail to create existing directory; %s", err)
+		}
+		err = sc.MkdirAll(filepath.Join(remoteDir, "file1"), 0750)
+		if err == nil {
+			t.Errorf("create directory on a file must fail")
+		}
+	})
+
+	t.Run("SendDir after MkdirAll", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestRemoteFileSystem-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+		err = ioutil.WriteFile(filepath.Join(localDir, "file2"), []byte("world"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+
+		parent := filepath.Join(remoteDir, "x", "y")
+		err = sc.MkdirAll(parent, 0755)
+		if err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		err = sc.SendDir(localDir, filepath.Join(parent, "dest"), nil)
+		if err != nil {
+			t.Fatalf("fail to send directory; %s", err)
+		}
+		checkFileContents(t, filepath.Join(parent, "dest"), map[string]string{"file2": "world"})
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		oldname := filepath.Join(remoteDir, "rename-old")
+		newname := filepath.Join(remoteDir, "rename-new")
+		err := ioutil.WriteFile(oldname, []byte("old"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		err = ioutil.WriteFile(newname, []byte("new"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+
+		err = sc.Rename(oldname, newname)
+		if err != nil {
+			t.Fatalf("fail to rename; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{"rename-new": "old"})
+		if _, err := os.Lstat(oldname); !os.IsNotExist(err) {
+			t.Errorf("old file must not exist; %v", err)
+		}
+
+		err = sc.Rename(newname, filepath.Join(remoteDir, "dir1"))
+		if err == nil {
+			t.Errorf("rename to a directory must fail")
+		}
+		err = sc.Rename(oldname, newname)
+		if !os.IsNotExist(err) {
+			t.Errorf("unexpected error; got=%v, want not exist error", err)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		err := sc.Remove(filepath.Join(remoteDir, "link1"))
+		if err != nil {
+			t.Fatalf("fail to remove symlink; %s", err)
+		}
+		if _, err := os.Stat(filepath.Join(remoteDir, "file1")); err != nil {
+			t.Errorf("link target must not be removed; %s", err)
+		}
+
+		err = sc.Remove(filepath.Join(remoteDir, "a"))
+		if err == nil {
+			t.Errorf("remove of non-empty directory must fail")
+		}
+		err = sc.Remove(filepath.Join(remoteDir, "a", "b", "c"))
+		if err != nil {
+			t.Fatalf("fail to remove directory; %s", err)
+		}
+		err = sc.Remove(filepath.Join(remoteDir, "file1"))
+		if err != nil {
+			t.Fatalf("fail to remove file; %s", err)
+		}
+		err = sc.Remove(filepath.Join(remoteDir, "file1"))
+		if !os.IsNotExist(err) {
+			t.Errorf("unexpected error; got=%v, want not exist error", err)
+		}
+	})
+}
@@ -4,11 +4,13 @@ go 1.17
 
 require (
 	github.com/hnakamur/go-sshd v0.0.0-20170228152141-dccc3399d26a
-	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
+	github.com/pkg/sftp v1.13.5
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
 )
 
 require (
 	github.com/creack/pty v1.1.7 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/kr/pty v1.1.8 // indirect
-	golang.org/x/sys v0.0.0-20200828081204-131dc92a58d5 // indirect
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
 )
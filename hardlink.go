@@ -0,0 +1,216 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// HardLinkFallbackFunc is the type of the function called by SendDir for
+// each hard link which is copied since it cannot be created on the remote.
+// link and target are the remote paths of the link and the file which has
+// the same content, and err is the reason.
+type HardLinkFallbackFunc func(link, target string, err error)
+
+// WithHardLinks makes SendDir send the content of hard linked local files
+// once and create the other links to it on the remote, with ln for the scp
+// protocol or with the hardlink extension for SFTP. Hard links are detected
+// by the device and inode numbers of the local files, which is not
+// supported on Windows. If a link cannot be created, the file is copied
+// instead and fallback is called if it is not nil.
+func WithHardLinks(fallback HardLinkFallbackFunc) Option {
+	return func(o *transferOptions) {
+		o.hardLinks = true
+		o.hardLinkFallback = fallback
+	}
+}
+
+// fileID identifies a local file by its device and inode numbers.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardLink is a remote hard link to be created.
+type hardLink struct {
+	// link and target are the remote paths.
+	link   string
+	target string
+	// local and info are the local file and its information which are
+	// used to copy the file if the link is not created.
+	local string
+	info  *FileInfo
+}
+
+// linkFunc creates the remote hard links and returns the errors of the
+// links which are not created, keyed by the remote link paths.
+type linkFunc func(links []hardLink) (map[string]error, error)
+
+// hardLinkSender is a dirSender which sends the content of hard linked
+// files once. The other links in a directory are created before the
+// directory is ended, so the times of the directory are set after them.
+type hardLinkSender struct {
+	dirSender
+	o        *transferOptions
+	link     linkFunc
+	srcDir   string
+	destRoot string
+	// dirs are the slash separated paths of the started directories
+	// relative to srcDir.
+	dirs []string
+	// targets are the remote paths of the sent files by their local IDs.
+	targets map[fileID]string
+	// pending are the links in the current directory to be created.
+	pending []hardLink
+}
+
+func newHardLinkSender(ds dirSender, o *transferOptions, link linkFunc, srcDir, destRoot string) *hardLinkSender {
+	return &hardLinkSender{
+		dirSender: ds,
+		o:         o,
+		link:      link,
+		srcDir:    srcDir,
+		destRoot:  destRoot,
+		targets:   make(map[fileID]string),
+	}
+}
+
+func (h *hardLinkSender) StartDirectory(dirInfo *FileInfo) error {
+	err := h.flush()
+	if err != nil {
+		return err
+	}
+	err = h.dirSender.StartDirectory(dirInfo)
+	if err != nil {
+		return err
+	}
+	rel := ""
+	if n := len(h.dirs); n > 0 {
+		rel = path.Join(h.dirs[n-1], dirInfo.name)
+	}
+	h.dirs = append(h.dirs, rel)
+	return nil
+}
+
+func (h *hardLinkSender) WriteFile(fileInfo *FileInfo, body io.ReadCloser) error {
+	rel := path.Join(h.dirs[len(h.dirs)-1], fileInfo.name)
+	local := filepath.Join(h.srcDir, filepath.FromSlash(rel))
+	remote := path.Join(h.destRoot, rel)
+	fi, err := os.Lstat(local)
+	if err != nil {
+		body.Close()
+		return fmt.Errorf("failed to stat local file: %w", err)
+	}
+	id, ok := localFileID(fi)
+	if !ok {
+		return h.dirSender.WriteFile(fileInfo, body)
+	}
+	if target, ok := h.targets[id]; ok {
+		body.Close()
+		h.pending = append(h.pending, hardLink{link: remote, target: target, local: local, info: fileInfo})
+		return nil
+	}
+	err = h.dirSender.WriteFile(fileInfo, body)
+	if err == nil || errors.Is(err, ErrFileChanged) {
+		h.targets[id] = remote
+	}
+	return err
+}
+
+func (h *hardLinkSender) EndDirectory() error {
+	err := h.flush()
+	if err != nil {
+		return err
+	}
+	h.dirs = h.dirs[:len(h.dirs)-1]
+	return h.dirSender.EndDirectory()
+}
+
+// flush creates the pending links in the current directory. The files are
+// copied instead if their links are not created.
+func (h *hardLinkSender) flush() error {
+	if len(h.pending) == 0 {
+		return nil
+	}
+	links := h.pending
+	h.pending = nil
+	failures, err := h.link(links)
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		reason, ok := failures[l.link]
+		if !ok {
+			continue
+		}
+		if h.o.hardLinkFallback != nil {
+			h.o.hardLinkFallback(l.link, l.target, reason)
+		}
+		file, err := os.Open(l.local)
+		if err != nil {
+			return fmt.Errorf("failed to open source file: %w", err)
+		}
+		// NOTE: file will be closed by WriteFile.
+		err = h.dirSender.WriteFile(l.info, file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkRemote creates the remote hard links with an ln command per batch
+// of links.
+func (s *SCP) linkRemote(o *transferOptions, links []hardLink) (map[string]error, error) {
+	failures := make(map[string]error)
+	if isWindowsShell(o.shell) {
+		for _, l := range links {
+			failures[l.link] = errors.New("hard links are not supported by the remote shell")
+		}
+		return failures, nil
+	}
+
+	args := make([]string, 0, 2*len(links))
+	for _, l := range links {
+		args = append(args, l.target, l.link)
+	}
+	for _, batch := range quotedArgGroupBatches(args, 2) {
+		// Each failure is printed as the link and the message of ln
+		// terminated with NUL.
+		script := "set -- " + batch + "; " +
+			"while [ $# -gt 1 ]; do " +
+			`e=$(ln -f -- "$1" "$2" 2>&1) || printf '%s\000%s\000' "$2" "$e"; shift 2; ` +
+			"done"
+		out, err := runRemoteCommand(s.commandTransport(), s.shellCommand(script))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create remote hard links: %w", err)
+		}
+		fields := strings.Split(string(out), "\x00")
+		for i := 0; i+1 < len(fields); i += 2 {
+			failures[fields[i]] = errors.New(strings.TrimSpace(fields[i+1]))
+		}
+	}
+	return failures, nil
+}
+
+// link creates the remote hard links with SFTP.
+func (c *sftpSession) link(links []hardLink) (map[string]error, error) {
+	failures := make(map[string]error)
+	for _, l := range links {
+		// An existing file is replaced like ln -f.
+		err := c.Remove(l.link)
+		if err != nil && !os.IsNotExist(err) {
+			failures[l.link] = err
+			continue
+		}
+		err = c.Link(l.target, l.link)
+		if err != nil {
+			failures[l.link] = err
+		}
+	}
+	return failures, nil
+}
@@ -0,0 +1,145 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestHardLinks(t *testing.T) {
+	// makeTree creates file1 and its hard links file2 and sub/file3.
+	makeTree := func(t *testing.T, root string) {
+		t.Helper()
+		err := os.MkdirAll(filepath.Join(root, "sub"), 0755)
+		if err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		for name, content := range map[string]string{"file1": "hello", "other": "world"} {
+			err = ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0644)
+			if err != nil {
+				t.Fatalf("fail to write file; %s", err)
+			}
+		}
+		for _, name := range []string{"file2", "sub/file3"} {
+			err = os.Link(filepath.Join(root, "file1"), filepath.Join(root, filepath.FromSlash(name)))
+			if err != nil {
+				t.Fatalf("fail to create hard link; %s", err)
+			}
+		}
+	}
+	links := []string{"file1", "file2", "sub/file3"}
+
+	inode := func(t *testing.T, name string) uint64 {
+		t.Helper()
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		return fi.Sys().(*syscall.Stat_t).Ino
+	}
+	checkContents := func(t *testing.T, remoteDir string) {
+		t.Helper()
+		for name, want := range map[string]string{"file1": "hello", "file2": "hello", "sub/file3": "hello", "other": "world"} {
+			got, err := ioutil.ReadFile(filepath.Join(remoteDir, filepath.FromSlash(name)))
+			if err != nil {
+				t.Fatalf("fail to read file; %s", err)
+			}
+			if string(got) != want {
+				t.Errorf("contents of %s unmatch; got=%q, want=%q", name, got, want)
+			}
+		}
+	}
+	countInodes := func(t *testing.T, remoteDir string) int {
+		t.Helper()
+		inodes := make(map[uint64]bool)
+		for _, name := range links {
+			inodes[inode(t, filepath.Join(remoteDir, filepath.FromSlash(name)))] = true
+		}
+		return len(inodes)
+	}
+
+	forEachTestBackend(t, func(t *testing.T, s *scp.SCP, localDir, remoteDir string) {
+		srcDir := filepath.Join(localDir, "src")
+		makeTree(t, srcDir)
+
+		t.Run("Links", func(t *testing.T) {
+			destDir := filepath.Join(remoteDir, "links")
+			var fallbacks []string
+			err := s.SendDir(srcDir, destDir, nil, scp.WithHardLinks(func(link, target string, err error) {
+				fallbacks = append(fallbacks, link)
+			}))
+			if err != nil {
+				t.Fatalf("fail to send directory; %s", err)
+			}
+			checkContents(t, destDir)
+			if got := countInodes(t, destDir); got != 1 {
+				t.Errorf("links are not preserved; inodes=%d", got)
+			}
+			if len(fallbacks) != 0 {
+				t.Errorf("unexpected fallbacks; %v", fallbacks)
+			}
+		})
+
+		t.Run("Without option", func(t *testing.T) {
+			destDir := filepath.Join(remoteDir, "copies")
+			err := s.SendDir(srcDir, destDir, nil)
+			if err != nil {
+				t.Fatalf("fail to send directory; %s", err)
+			}
+			checkContents(t, destDir)
+			if got := countInodes(t, destDir); got != len(links) {
+				t.Errorf("links are preserved; inodes=%d", got)
+			}
+		})
+	})
+
+	t.Run("Fallback to copy", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir("", "go-scp-TestHardLinks")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(tempDir)
+		srcDir := filepath.Join(tempDir, "src")
+		makeTree(t, srcDir)
+
+		// binDir has an ln command which always fails.
+		binDir := filepath.Join(tempDir, "bin")
+		err = os.Mkdir(binDir, 0755)
+		if err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(binDir, "ln"), []byte("#!/bin/sh\necho 'ln: not permitted' >&2\nexit 1\n"), 0755)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+
+		destDir := filepath.Join(tempDir, "dest")
+		env := append(os.Environ(), "PATH="+binDir+":"+os.Getenv("PATH"))
+		s := scp.NewSCPWithTransport(&scp.ExecTransport{Env: env})
+		var fallbacks []string
+		err = s.SendDir(srcDir, destDir, nil, scp.WithHardLinks(func(link, target string, err error) {
+			if err.Error() != "ln: not permitted" {
+				t.Errorf("fallback reason unmatch; got=%q", err)
+			}
+			rel, _ := filepath.Rel(destDir, link)
+			fallbacks = append(fallbacks, filepath.ToSlash(rel))
+		}))
+		if err != nil {
+			t.Fatalf("fail to send directory; %s", err)
+		}
+		checkContents(t, destDir)
+		if got := countInodes(t, destDir); got != len(links) {
+			t.Errorf("files are not copied; inodes=%d", got)
+		}
+		if len(fallbacks) != 2 || fallbacks[0] != "file2" || fallbacks[1] != "sub/file3" {
+			t.Errorf("fallbacks unmatch; got=%v", fallbacks)
+		}
+	})
+}
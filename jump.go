@@ -0,0 +1,81 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Hop is a host in a chain of connections made by DialJump.
+type Hop struct {
+	// Addr is the address of the host in the form of host:port.
+	Addr string
+	// Config is the client config for the host, which has the user,
+	// the authentication methods and the host key callback for the host.
+	Config *ssh.ClientConfig
+}
+
+// DialJump connects to the last hop through the preceding hops as jump hosts
+// like ProxyJump of the ssh command, and returns an SCP for the last hop
+// which owns all the connections.
+// The first hop is connected directly, and each following hop is connected
+// with a direct-tcpip channel opened on the connection to the previous hop.
+// The caller must call Close of the returned SCP after using it.
+func DialJump(hops ...Hop) (*SCP, error) {
+	return DialJumpVia(nil, hops...)
+}
+
+// DialJumpVia is like DialJump, but the first hop is connected through
+// client, which is not owned by the returned SCP. If client is nil, the
+// first hop is connected directly.
+func DialJumpVia(client *ssh.Client, hops ...Hop) (*SCP, error) {
+	if len(hops) == 0 {
+		return nil, errors.New("no hop to connect to")
+	}
+
+	var clients []*ssh.Client
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+	prev := client
+	for _, h := range hops {
+		c, err := dialVia(prev, h.Addr, h.Config)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		clients = append(clients, c)
+		prev = c
+	}
+
+	s := NewSCP(prev)
+	for i := len(clients) - 1; i >= 0; i-- {
+		s.closers = append(s.closers, clients[i])
+	}
+	return s, nil
+}
+
+// dialVia connects to addr through prev. If prev is nil, it connects directly.
+func dialVia(prev *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if prev == nil {
+		client, err := ssh.Dial("tcp", addr, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+		}
+		return client, nil
+	}
+
+	conn, err := prev.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel to %s: %w", addr, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
@@ -0,0 +1,126 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDialJump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-scp-TestDialJump")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientKey, _ := generateTestIdentityFile(t, dir)
+	server, hostKey, err := newTestKeyAuthSshdServer(clientKey.PublicKey())
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer server.Close()
+	jump1, jump1HostKey, err := newTestJumpServer(clientKey.PublicKey())
+	if err != nil {
+		t.Fatalf("fail to create test jump server; %s", err)
+	}
+	defer jump1.Close()
+	jump2, jump2HostKey, err := newTestJumpServer(clientKey.PublicKey())
+	if err != nil {
+		t.Fatalf("fail to create test jump server; %s", err)
+	}
+	defer jump2.Close()
+
+	hop := func(addr string, hostKey ssh.PublicKey) scp.Hop {
+		return scp.Hop{
+			Addr: addr,
+			Config: &ssh.ClientConfig{
+				User:            testSshdUser,
+				Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+				HostKeyCallback: ssh.FixedHostKey(hostKey),
+			},
+		}
+	}
+
+	t.Run("Two jump hosts", func(t *testing.T) {
+		s, err := scp.DialJump(
+			hop(jump1.Addr().String(), jump1HostKey),
+			hop(jump2.Addr().String(), jump2HostKey),
+			hop(server.Addr().String(), hostKey),
+		)
+		if err != nil {
+			t.Fatalf("fail to dial; %s", err)
+		}
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestDialJump-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+		info := scp.NewFileInfo("file1", 5, 0644, time.Now(), time.Now())
+		err = s.Send(info, ioutil.NopCloser(strings.NewReader("hello")), filepath.Join(remoteDir, "file1"))
+		if err != nil {
+			t.Fatalf("fail to send; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{"file1": "hello"})
+
+		err = s.Close()
+		if err != nil {
+			t.Fatalf("fail to close; %s", err)
+		}
+		err = s.Send(info, ioutil.NopCloser(strings.NewReader("hello")), filepath.Join(remoteDir, "file2"))
+		if err == nil {
+			t.Errorf("send must fail after close")
+		}
+	})
+
+	t.Run("Via existing client", func(t *testing.T) {
+		client, err := ssh.Dial("tcp", jump1.Addr().String(), hop("", jump1HostKey).Config)
+		if err != nil {
+			t.Fatalf("fail to dial; %s", err)
+		}
+		defer client.Close()
+
+		s, err := scp.DialJumpVia(client, hop(jump2.Addr().String(), jump2HostKey))
+		if err != nil {
+			t.Fatalf("fail to dial; %s", err)
+		}
+		err = s.Close()
+		if err != nil {
+			t.Fatalf("fail to close; %s", err)
+		}
+
+		// client is not closed by the SCP.
+		s, err = scp.DialJumpVia(client, hop(jump2.Addr().String(), jump2HostKey))
+		if err != nil {
+			t.Fatalf("fail to dial again; %s", err)
+		}
+		s.Close()
+	})
+
+	t.Run("Wrong host key of jump host", func(t *testing.T) {
+		_, err := scp.DialJump(
+			hop(jump1.Addr().String(), jump1HostKey),
+			hop(jump2.Addr().String(), jump1HostKey),
+			hop(server.Addr().String(), hostKey),
+		)
+		if err == nil || !strings.Contains(err.Error(), jump2.Addr().String()) {
+			t.Errorf("unexpected error; got=%v, want error for %s", err, jump2.Addr())
+		}
+	})
+
+	t.Run("No hop", func(t *testing.T) {
+		_, err := scp.DialJump()
+		if err == nil {
+			t.Errorf("dial must fail without hops")
+		}
+	})
+}
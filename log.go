@@ -0,0 +1,38 @@
+package scp
+
+// Logger is the interface to log the scp protocol traffic.
+// The args are alternating keys and values. *slog.Logger of Go 1.21 or later
+// implements this interface.
+//
+// Each session start with the remote command, every header and reply sent or
+// received, and the exit status of each session are logged. File bodies are
+// not logged.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+}
+
+// maxLoggedUnexpectedBytes is the maximum number of bytes which follow an
+// unexpected reply or message type in the log.
+const maxLoggedUnexpectedBytes = 256
+
+// logDebug logs msg with args if l is not nil.
+func logDebug(l Logger, msg string, args ...interface{}) {
+	if l != nil {
+		l.Debug(msg, args...)
+	}
+}
+
+// logSessionEnd logs the exit status of a session which is returned as err
+// from Session.Wait.
+func logSessionEnd(l Logger, err error) {
+	if l == nil {
+		return
+	}
+	if err == nil {
+		l.Debug("scp session end", "exitStatus", 0)
+	} else if status, ok := exitStatus(err); ok {
+		l.Debug("scp session end", "exitStatus", status)
+	} else {
+		l.Debug("scp session end", "error", err)
+	}
+}
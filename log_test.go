@@ -0,0 +1,139 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	line := msg
+	for i := 0; i+1 < len(args); i += 2 {
+		line += fmt.Sprintf(" %v=%q", args[i], fmt.Sprint(args[i+1]))
+	}
+	l.lines = append(l.lines, line)
+}
+
+func TestLogger(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestLogger-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestLogger-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localPath := filepath.Join(localDir, "file1")
+	err = ioutil.WriteFile(localPath, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
+	err = os.Chmod(localPath, 0644)
+	if err != nil {
+		t.Fatalf("fail to change file mode; %s", err)
+	}
+	remotePath := filepath.Join(remoteDir, "file1")
+
+	t.Run("SendFile", func(t *testing.T) {
+		logger := &testLogger{}
+		sc := scp.NewSCP(c)
+		sc.Logger = logger
+		err := sc.SendFile(localPath, remotePath)
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		checkLogLines(t, logger.lines, []string{
+			`scp session start command="scp -tp '` + remoteDir + `/file1'"`,
+			`scp reply received type="0"`,
+			`scp header sent header="T`,
+			`scp reply received type="0"`,
+			`scp header sent header="C0644 5 file1"`,
+			`scp reply received type="0"`,
+			`scp reply sent type="0"`,
+			`scp reply received type="0"`,
+			`scp session end exitStatus="0"`,
+		})
+	})
+
+	t.Run("ReceiveFile", func(t *testing.T) {
+		logger := &testLogger{}
+		sc := scp.NewSCP(c)
+		sc.Logger = logger
+		err := sc.ReceiveFile(remotePath, filepath.Join(localDir, "file2"))
+		if err != nil {
+			t.Fatalf("fail to receive file; %s", err)
+		}
+		checkLogLines(t, logger.lines, []string{
+			`scp session start command="scp -fp '` + remoteDir + `/file1'"`,
+			`scp reply sent type="0"`,
+			`scp header received header="T`,
+			`scp reply sent type="0"`,
+			`scp header received header="C0644 5 file1"`,
+			`scp reply sent type="0"`,
+			`scp reply sent type="0"`,
+			`scp reply received type="0"`,
+			`scp session end exitStatus="0"`,
+		})
+	})
+
+	t.Run("Remote error", func(t *testing.T) {
+		logger := &testLogger{}
+		sc := scp.NewSCP(c)
+		sc.Logger = logger
+		err := sc.ReceiveFile(filepath.Join(remoteDir, "no-such-file"), filepath.Join(localDir, "file3"))
+		if err == nil {
+			t.Fatal("unexpected success of receiving a nonexistent file")
+		}
+		checkLogLines(t, logger.lines, []string{
+			`scp session start command="scp -fp '` + remoteDir + `/no-such-file'"`,
+			`scp reply sent type="0"`,
+			`scp reply received type="1" message="scp: ` + remoteDir + `/no-such-file: No such file or directory"`,
+			`scp reply sent type="0"`,
+		})
+	})
+}
+
+// checkLogLines checks each line of got starts with the corresponding prefix.
+func checkLogLines(t *testing.T, got, prefixes []string) {
+	t.Helper()
+	if len(got) != len(prefixes) {
+		t.Fatalf("log lines count unmatch; got=%d, want=%d\n%s", len(got), len(prefixes), strings.Join(got, "\n"))
+	}
+	for i, prefix := range prefixes {
+		if !strings.HasPrefix(got[i], prefix) {
+			t.Errorf("log line %d unmatch; got=%s, want prefix=%s", i, got[i], prefix)
+		}
+	}
+}
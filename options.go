@@ -0,0 +1,92 @@
+package scp
+
+import (
+	"os"
+	"time"
+)
+
+// Option is the type for an option of a single transfer.
+// An option passed to a method takes precedence over the corresponding
+// field of SCP.
+type Option func(o *transferOptions)
+
+type transferOptions struct {
+	overwrite OverwritePolicy
+	delete    bool
+	// plan is not nil in a dry run.
+	plan        *[]PlanEntry
+	rateLimit   int64
+	limiters    rateLimiters
+	retryPolicy RetryPolicy
+	logger      Logger
+	recorder    *Recorder
+	progress    ProgressFunc
+	// owner is the owner of the sent files set by WithOwner.
+	owner string
+	// localOwner is true if the owners of the sent files are those of
+	// the local files.
+	localOwner bool
+	preserve   Preserve
+	// umask is set by WithUmask, and setsUmask is true if it is set.
+	umask     os.FileMode
+	setsUmask bool
+	// fileMode and dirMode are set by WithFileMode and WithDirMode.
+	// They are zero if they are not set.
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	// modTimeTolerance is set by WithModTimeTolerance, and
+	// setsModTimeTolerance is true if it is set.
+	modTimeTolerance     time.Duration
+	setsModTimeTolerance bool
+	// hardLinks is true if WithHardLinks is used.
+	hardLinks        bool
+	hardLinkFallback HardLinkFallbackFunc
+	// sparse is true if WithSparse is used.
+	sparse bool
+	// shell is SCP.Shell or the remote shell detected by prepareTransfer.
+	shell ShellType
+}
+
+func (s *SCP) newTransferOptions(opts []Option) *transferOptions {
+	o := &transferOptions{
+		overwrite:   s.Overwrite,
+		retryPolicy: s.Retry,
+		logger:      s.Logger,
+		recorder:    s.Recorder,
+		shell:       s.Shell,
+		preserve:    PreserveAll,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if l := s.sharedRateLimiter(); l != nil {
+		o.limiters = append(o.limiters, l)
+	}
+	if o.rateLimit > 0 {
+		o.limiters = append(o.limiters, newRateLimiter(o.rateLimit))
+	}
+	return o
+}
+
+// WithOverwrite sets the policy for existing destination files.
+func WithOverwrite(policy OverwritePolicy) Option {
+	return func(o *transferOptions) {
+		o.overwrite = policy
+	}
+}
+
+// WithDelete makes SyncDir remove remote files and directories which do not
+// exist locally.
+func WithDelete() Option {
+	return func(o *transferOptions) {
+		o.delete = true
+	}
+}
+
+// WithRateLimit limits the bandwidth of file bodies of a single transfer
+// in bytes per second. It is applied in addition to SCP.RateLimit.
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(o *transferOptions) {
+		o.rateLimit = bytesPerSecond
+	}
+}
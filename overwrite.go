@@ -0,0 +1,105 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// OverwritePolicy is the type for the policy to decide whether an existing
+// destination file is overwritten or skipped.
+// Directories are always created or reused regardless of the policy.
+type OverwritePolicy int
+
+const (
+	// OverwriteAlways overwrites existing files. This is the default.
+	OverwriteAlways OverwritePolicy = iota
+	// OverwriteNever skips existing files.
+	OverwriteNever
+	// OverwriteIfNewer overwrites an existing file only if the source file
+	// has a later modification time.
+	OverwriteIfNewer
+	// OverwriteIfDifferent overwrites an existing file only if the source file
+	// has a different size or modification time.
+	OverwriteIfDifferent
+)
+
+// shouldWrite returns whether the destination dest is written with src.
+// dest is nil if it does not exist. Modification times are compared with
+// compare, which is transferOptions.compareModTimes. If the modification
+// time of src is unknown, the policies comparing them always overwrite.
+func (p OverwritePolicy) shouldWrite(src, dest *FileInfo, compare func(src, dest time.Time) int) bool {
+	if dest == nil {
+		return true
+	}
+	switch p {
+	case OverwriteNever:
+		return false
+	case OverwriteIfNewer:
+		return src.ModTime().IsZero() || compare(src.ModTime(), dest.ModTime()) > 0
+	case OverwriteIfDifferent:
+		return src.ModTime().IsZero() || src.Size() != dest.Size() || compare(src.ModTime(), dest.ModTime()) != 0
+	default:
+		return true
+	}
+}
+
+// WithModTimeTolerance makes the overwrite policies treat modification
+// times as the same if they differ by tolerance at most. The times are
+// truncated to microseconds, which is the precision of the scp protocol,
+// before comparing. Zero tolerance compares them exactly, which suits
+// tools like build caches depending on exact times when both times have
+// microsecond precision, like files sent with the scp protocol. Without
+// this option, the times are compared in seconds.
+func WithModTimeTolerance(tolerance time.Duration) Option {
+	return func(o *transferOptions) {
+		o.modTimeTolerance = tolerance
+		o.setsModTimeTolerance = true
+	}
+}
+
+// compareModTimes returns -1, 0 or +1 if the modification time src is
+// older than, the same as or newer than dest.
+func (o *transferOptions) compareModTimes(src, dest time.Time) int {
+	precision := time.Second
+	if o.setsModTimeTolerance {
+		precision = time.Microsecond
+	}
+	src, dest = src.Truncate(precision), dest.Truncate(precision)
+	d := src.Sub(dest)
+	switch {
+	case d > o.modTimeTolerance:
+		return 1
+	case d < -o.modTimeTolerance:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// shouldSend returns whether the local file src is sent to the remote file dest.
+// The remote is checked only if the policy needs it.
+func (s *SCP) shouldSend(o *transferOptions, src *FileInfo, dest string) (bool, error) {
+	if o.overwrite == OverwriteAlways {
+		return true, nil
+	}
+	info, err := s.statRemote(dest)
+	if err != nil {
+		return false, err
+	}
+	return o.overwrite.shouldWrite(src, info, o.compareModTimes), nil
+}
+
+// shouldReceive returns whether the remote file src is written to the local file dest.
+func shouldReceive(o *transferOptions, src *FileInfo, dest string) (bool, error) {
+	if o.overwrite == OverwriteAlways {
+		return true, nil
+	}
+	fi, err := os.Stat(dest)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get information of destination file: %w", err)
+	}
+	return o.overwrite.shouldWrite(src, newFileInfoFromOS(fi, ""), o.compareModTimes), nil
+}
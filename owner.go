@@ -0,0 +1,180 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WithOwner makes SendFile and SendDir change the owner of the sent files
+// and directories on the remote after the transfer. owner is an argument
+// of chown like "app" or "app:app". chown is run with the command prefix
+// of SCPCommand like sudo or with the Privilege.
+func WithOwner(owner string) Option {
+	return func(o *transferOptions) {
+		o.owner = owner
+		o.localOwner = false
+	}
+}
+
+// WithLocalOwner is like WithOwner, but the owner of each file is the user
+// and group IDs of the local file. It is not supported on Windows.
+func WithLocalOwner() Option {
+	return func(o *transferOptions) {
+		o.owner = ""
+		o.localOwner = true
+	}
+}
+
+// changesOwner returns whether the owners of the sent files are changed.
+func (o *transferOptions) changesOwner() bool {
+	return o.owner != "" || o.localOwner
+}
+
+// ChownError is the error reported when the owners of some remote files
+// are not changed with WithOwner or WithLocalOwner. The files are sent.
+type ChownError struct {
+	// Failures are the remote files whose owners are not changed.
+	Failures []ChownFailure
+}
+
+// ChownFailure is a remote file whose owner is not changed.
+type ChownFailure struct {
+	// Path is the path of the remote file.
+	Path string
+	// Owner is the owner to which it is changed.
+	Owner string
+	// Message is the error message of chown.
+	Message string
+}
+
+func (e *ChownError) Error() string {
+	msgs := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		msgs[i] = fmt.Sprintf("%s: %s", f.Path, f.Message)
+	}
+	return fmt.Sprintf("failed to change owner of %d remote files: %s", len(e.Failures), strings.Join(msgs, "; "))
+}
+
+// sentFile is a file or directory sent to the remote.
+type sentFile struct {
+	remote string
+	local  string
+}
+
+// changeOwners changes the owners of the sent files after the transfer
+// which ends with err. It returns err if it is not nil, or the error of
+// changing the owners. The owners are changed for files which are sent
+// before ErrFileChanged too.
+func (s *SCP) changeOwners(o *transferOptions, sent []sentFile, err error) error {
+	if !o.changesOwner() || (err != nil && !errors.Is(err, ErrFileChanged)) {
+		return err
+	}
+	chownErr := s.chownRemote(o, sent)
+	if err != nil {
+		return err
+	}
+	return chownErr
+}
+
+// chownRemote changes the owners of the remote files with a chown command
+// per batch of files with the same owner. It returns *ChownError if chown
+// fails for some files.
+func (s *SCP) chownRemote(o *transferOptions, sent []sentFile) error {
+	var owners []string
+	pathsByOwner := make(map[string][]string)
+	for _, f := range sent {
+		owner := o.owner
+		if o.localOwner {
+			fi, err := os.Lstat(f.local)
+			if err != nil {
+				return fmt.Errorf("failed to stat local file: %w", err)
+			}
+			owner, err = localOwner(fi)
+			if err != nil {
+				return err
+			}
+		}
+		if _, ok := pathsByOwner[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		pathsByOwner[owner] = append(pathsByOwner[owner], f.remote)
+	}
+
+	var failures []ChownFailure
+	for _, owner := range owners {
+		for _, args := range quotedArgBatches(pathsByOwner[owner]) {
+			// Each failure is printed as the path and the message of chown
+			// terminated with NUL.
+			script := "for p in " + args + "; do " +
+				"e=$(chown -h -- " + escapeShellArg(owner) + ` "$p" 2>&1) || printf '%s\000%s\000' "$p" "$e"; ` +
+				"done"
+			out, err := runRemoteCommand(s.commandTransport(), s.shellCommand(script))
+			if err != nil {
+				return fmt.Errorf("failed to change owner of remote files: %w", err)
+			}
+			fields := strings.Split(string(out), "\x00")
+			for i := 0; i+1 < len(fields); i += 2 {
+				failures = append(failures, ChownFailure{
+					Path:    fields[i],
+					Owner:   owner,
+					Message: strings.TrimSpace(fields[i+1]),
+				})
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return &ChownError{Failures: failures}
+	}
+	return nil
+}
+
+// sentRecorder is a dirSender which records the sent files and directories
+// to change their owners.
+type sentRecorder struct {
+	dirSender
+	srcDir   string
+	destRoot string
+	// dirs are the slash separated paths of the started directories
+	// relative to srcDir.
+	dirs []string
+	sent []sentFile
+}
+
+func (r *sentRecorder) StartDirectory(dirInfo *FileInfo) error {
+	err := r.dirSender.StartDirectory(dirInfo)
+	if err != nil {
+		return err
+	}
+	rel := ""
+	if n := len(r.dirs); n > 0 {
+		rel = path.Join(r.dirs[n-1], dirInfo.name)
+	}
+	r.dirs = append(r.dirs, rel)
+	r.add(rel)
+	return nil
+}
+
+func (r *sentRecorder) WriteFile(fileInfo *FileInfo, body io.ReadCloser) error {
+	err := r.dirSender.WriteFile(fileInfo, body)
+	if err == nil || errors.Is(err, ErrFileChanged) {
+		r.add(path.Join(r.dirs[len(r.dirs)-1], fileInfo.name))
+	}
+	return err
+}
+
+func (r *sentRecorder) EndDirectory() error {
+	r.dirs = r.dirs[:len(r.dirs)-1]
+	return r.dirSender.EndDirectory()
+}
+
+func (r *sentRecorder) add(rel string) {
+	r.sent = append(r.sent, sentFile{
+		remote: path.Join(r.destRoot, rel),
+		local:  filepath.Join(r.srcDir, filepath.FromSlash(rel)),
+	})
+}
@@ -0,0 +1,114 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+	localDir, err := ioutil.TempDir("", "go-scp-TestOwner-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestOwner-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	srcDir := filepath.Join(localDir, "src")
+	err = os.MkdirAll(filepath.Join(srcDir, "sub"), 0755)
+	if err != nil {
+		t.Fatalf("fail to create directory; %s", err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"file1", "sub/file2"} {
+		err := writeFileWithModTime(filepath.Join(srcDir, filepath.FromSlash(name)), []byte("hello"), modTime)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+	}
+
+	sc := scp.NewSCPWithTransport(&scp.ExecTransport{})
+
+	checkOwners := func(t *testing.T, dir string, names []string, uid, gid uint32) {
+		t.Helper()
+		for _, name := range names {
+			fi, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil {
+				t.Fatalf("fail to stat %s; %s", name, err)
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			if st.Uid != uid || st.Gid != gid {
+				t.Errorf("owner of %s unmatch; got=%d:%d, want=%d:%d", name, st.Uid, st.Gid, uid, gid)
+			}
+		}
+	}
+
+	t.Run("SendDir with owner", func(t *testing.T) {
+		destDir := filepath.Join(remoteDir, "dest1")
+		err := sc.SendDir(srcDir, destDir, nil, scp.WithOwner("1234:2345"))
+		if err != nil {
+			t.Fatalf("fail to send directory; %s", err)
+		}
+		checkOwners(t, destDir, []string{".", "file1", "sub", "sub/file2"}, 1234, 2345)
+	})
+
+	t.Run("SendDir into existing directory", func(t *testing.T) {
+		destDir := filepath.Join(remoteDir, "dest2")
+		err := os.Mkdir(destDir, 0755)
+		if err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		err = sc.SendDir(srcDir, destDir, nil, scp.WithOwner("1234"))
+		if err != nil {
+			t.Fatalf("fail to send directory; %s", err)
+		}
+		checkOwners(t, destDir, []string{"."}, 0, 0)
+		checkOwners(t, destDir, []string{"src", "src/file1", "src/sub", "src/sub/file2"}, 1234, 0)
+	})
+
+	t.Run("SendFile with local owner", func(t *testing.T) {
+		err := os.Lchown(filepath.Join(srcDir, "file1"), 3456, 4567)
+		if err != nil {
+			t.Fatalf("fail to change owner; %s", err)
+		}
+		err = sc.SendFile(filepath.Join(srcDir, "file1"), remoteDir, scp.WithLocalOwner())
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		checkOwners(t, remoteDir, []string{"file1"}, 3456, 4567)
+	})
+
+	t.Run("Unknown owner", func(t *testing.T) {
+		destDir := filepath.Join(remoteDir, "dest3")
+		err := sc.SendDir(srcDir, destDir, nil, scp.WithOwner("go-scp-no-such-user"))
+		var chownErr *scp.ChownError
+		if !errors.As(err, &chownErr) {
+			t.Fatalf("unexpected error; got=%v, want ChownError", err)
+		}
+		if len(chownErr.Failures) != 4 {
+			t.Errorf("failures count unmatch; got=%d, want=4", len(chownErr.Failures))
+		}
+		for _, f := range chownErr.Failures {
+			if f.Owner != "go-scp-no-such-user" || f.Message == "" {
+				t.Errorf("unexpected failure; %+v", f)
+			}
+		}
+		checkFileContents(t, destDir, map[string]string{"file1": "hello", "sub/file2": "hello"})
+	})
+}
@@ -0,0 +1,183 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// PlanAction is the type for the action to an entry in a transfer plan.
+type PlanAction int
+
+const (
+	// PlanCreate means that the destination entry will be created.
+	PlanCreate PlanAction = iota
+	// PlanOverwrite means that the existing destination entry will be overwritten.
+	// For a directory, its time and permission will be updated.
+	PlanOverwrite
+	// PlanSkip means that the entry will be skipped by AcceptFunc or
+	// the overwrite policy.
+	PlanSkip
+	// PlanRemove means that the destination entry will be removed by SyncDir.
+	PlanRemove
+	// PlanWrite means that the destination entry will be written whether
+	// it exists or not. It is reported by a dry run of SendDir with
+	// OverwriteAlways, which does not access the remote.
+	PlanWrite
+)
+
+func (a PlanAction) String() string {
+	switch a {
+	case PlanCreate:
+		return "create"
+	case PlanOverwrite:
+		return "overwrite"
+	case PlanSkip:
+		return "skip"
+	case PlanRemove:
+		return "remove"
+	case PlanWrite:
+		return "write"
+	default:
+		return fmt.Sprintf("PlanAction(%d)", int(a))
+	}
+}
+
+// PlanEntry is an entry in a transfer plan reported in a dry run.
+type PlanEntry struct {
+	// Path is the destination path of the entry.
+	Path   string
+	Action PlanAction
+	// Size and Mode are the ones of the source entry.
+	// For an entry to be removed, they are the ones of the destination entry.
+	Size int64
+	Mode os.FileMode
+}
+
+// WithDryRun makes SendDir, ReceiveDir and SyncDir append the entries which
+// would be created, overwritten, skipped or removed to plan without transferring.
+// Entries are appended in the order of the transfer, and entries under
+// a directory skipped by AcceptFunc are not reported.
+//
+// In a dry run of SendDir and SyncDir, no scp session is started and nothing
+// is written to the remote. The remote tree is only listed with the find
+// command to know which entries exist. With OverwriteAlways, SendDir does
+// not access the remote at all and reports the entries under destDir with
+// PlanWrite, although they are copied under destDir/filepath.Base(srcDir)
+// if destDir is an existing directory. In a dry run of ReceiveDir, the file
+// bodies are received and discarded without writing local files.
+//
+// Other methods return an error when a dry run is requested.
+func WithDryRun(plan *[]PlanEntry) Option {
+	return func(o *transferOptions) {
+		o.plan = plan
+	}
+}
+
+func (o *transferOptions) addPlan(path string, action PlanAction, info os.FileInfo) {
+	*o.plan = append(*o.plan, PlanEntry{
+		Path:   path,
+		Action: action,
+		Size:   info.Size(),
+		Mode:   info.Mode(),
+	})
+}
+
+// checkNoDryRun returns an error if a dry run is requested to a method
+// which does not support it.
+func (o *transferOptions) checkNoDryRun(method string) error {
+	if o.plan != nil {
+		return fmt.Errorf("dry run is not supported by %s", method)
+	}
+	return nil
+}
+
+// planSendDir reports the plan for sending files under srcDir to the remote
+// destRoot whose entries are destInfos. If destInfos is nil, the remote is
+// not listed and the entries to be written are reported with PlanWrite.
+func (o *transferOptions) planSendDir(srcDir, destRoot string, destInfos map[string]*FileInfo, acceptFn AcceptFunc, policy OverwritePolicy) error {
+	recordingAcceptFn := func(parentDir string, info os.FileInfo) (bool, error) {
+		accepted, err := acceptFn(parentDir, info)
+		if err != nil || accepted {
+			return accepted, err
+		}
+		rel, err := filepath.Rel(srcDir, filepath.Join(parentDir, info.Name()))
+		if err != nil {
+			return false, err
+		}
+		o.addPlan(path.Join(destRoot, filepath.ToSlash(rel)), PlanSkip, info)
+		return false, nil
+	}
+
+	shouldSend := func(relPath string, info *FileInfo) bool {
+		dest := destInfos[relPath]
+		write := policy.shouldWrite(info, dest, o.compareModTimes)
+		action := PlanSkip
+		if write {
+			action = planWriteAction(destInfos, relPath)
+		}
+		o.addPlan(path.Join(destRoot, relPath), action, info)
+		return write
+	}
+
+	p := &planSender{
+		o:         o,
+		destRoot:  destRoot,
+		destInfos: destInfos,
+	}
+	return sendDir(p, srcDir, "", recordingAcceptFn, shouldSend)
+}
+
+// planWriteAction returns the action for writing to the remote entry
+// relPath in destInfos.
+func planWriteAction(destInfos map[string]*FileInfo, relPath string) PlanAction {
+	if destInfos == nil {
+		return PlanWrite
+	}
+	if destInfos[relPath] != nil {
+		return PlanOverwrite
+	}
+	return PlanCreate
+}
+
+// planSender is a dirSender which reports directories to the plan.
+// Files are reported by the shouldSend function passed to sendDir.
+type planSender struct {
+	o         *transferOptions
+	destRoot  string
+	destInfos map[string]*FileInfo
+	// dirs is the stack of the relative paths of the current directories.
+	dirs []string
+}
+
+func (p *planSender) StartDirectory(dirInfo *FileInfo) error {
+	var rel string
+	if len(p.dirs) > 0 {
+		rel = path.Join(p.dirs[len(p.dirs)-1], dirInfo.name)
+	}
+	p.dirs = append(p.dirs, rel)
+	p.o.addPlan(path.Join(p.destRoot, rel), planWriteAction(p.destInfos, rel), dirInfo)
+	return nil
+}
+
+func (p *planSender) WriteFile(fileInfo *FileInfo, body io.ReadCloser) error {
+	return body.Close()
+}
+
+func (p *planSender) EndDirectory() error {
+	p.dirs = p.dirs[:len(p.dirs)-1]
+	return nil
+}
+
+// localPlanAction returns the action for writing to the local file name.
+func localPlanAction(name string) (PlanAction, error) {
+	_, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return PlanCreate, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get information of destination file: %w", err)
+	}
+	return PlanOverwrite, nil
+}
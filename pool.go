@@ -0,0 +1,286 @@
+package scp
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrPoolClosed is returned by Pool.Do after the pool is closed.
+var ErrPoolClosed = errors.New("scp: pool is closed")
+
+// Pool manages ssh.Client connections per host and limits the number of
+// concurrent sessions on each of them. A client which is disconnected is
+// removed from the pool and a new one is dialed when it is needed.
+// The zero value is not usable; Dial must be set.
+type Pool struct {
+	// Dial connects to addr. It must be set.
+	Dial func(addr string) (*ssh.Client, error)
+	// NewSCP creates the SCP for a pooled client. If it is nil, NewSCP of
+	// this package is used. It can be used to set fields like SCPCommand.
+	NewSCP func(client *ssh.Client) *SCP
+	// MaxClientsPerHost is the maximum number of clients per host.
+	// If it is zero or negative, 1 is used.
+	MaxClientsPerHost int
+	// MaxSessionsPerClient is the maximum number of concurrent sessions
+	// on a client. It should not exceed MaxSessions of the sshd, which is 10
+	// by default. If it is zero or negative, 10 is used.
+	MaxSessionsPerClient int
+	// KeepaliveTimeout is the time to wait for the response to a keepalive
+	// request which checks whether a client is connected after fn fails.
+	// If it is zero or negative, 10 seconds is used.
+	KeepaliveTimeout time.Duration
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	hosts  map[string]*poolHost
+	closed bool
+}
+
+type poolHost struct {
+	clients []*poolClient
+	// dialing is the number of dials in progress.
+	dialing int
+}
+
+type poolClient struct {
+	scp    *SCP
+	client *ssh.Client
+	// opened is the number of sessions opened on the client. It is
+	// accessed atomically.
+	opened   int64
+	sessions int
+	// maxSessions is lowered when the server refuses to open more sessions.
+	maxSessions int
+	// dead is set when the client is removed from the pool.
+	dead bool
+}
+
+// Do runs fn with an SCP using a pooled client for addr.
+// fn should run one transfer at a time since each transfer occupies a session
+// of the client while fn runs, and it must not use the SCP after returning.
+//
+// If fn fails before opening any session and a client reused from the pool
+// turns out to be disconnected, the client is removed and fn is called again
+// with another client. fn is not called again once a session is opened on
+// the client, since the transfer may have partially written the destination.
+// If the server refuses to open a session with "administratively prohibited",
+// the limit of sessions for the client is lowered, and fn is called again
+// only if the refused session was the first one.
+func (p *Pool) Do(addr string, fn func(s *SCP) error) error {
+	for {
+		pc, dialed, err := p.acquire(addr)
+		if err != nil {
+			return err
+		}
+		opened := atomic.LoadInt64(&pc.opened)
+		err = fn(pc.scp)
+		lowered := p.release(pc, err)
+		if err == nil || atomic.LoadInt64(&pc.opened) != opened {
+			return err
+		}
+		if lowered {
+			continue
+		}
+		if dialed || pc.alive(p.keepaliveTimeout()) {
+			return err
+		}
+		p.remove(addr, pc)
+	}
+}
+
+// Close closes all clients in the pool. Do waiting for a client returns
+// ErrPoolClosed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	p.closed = true
+	var firstErr error
+	for _, h := range p.hosts {
+		for _, pc := range h.clients {
+			err := pc.client.Close()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		h.clients = nil
+	}
+	p.cond.Broadcast()
+	return firstErr
+}
+
+// init initializes p. p.mu must be held.
+func (p *Pool) init() {
+	if p.cond == nil {
+		p.cond = sync.NewCond(&p.mu)
+		p.hosts = make(map[string]*poolHost)
+	}
+}
+
+func (p *Pool) maxClients() int {
+	if p.MaxClientsPerHost <= 0 {
+		return 1
+	}
+	return p.MaxClientsPerHost
+}
+
+func (p *Pool) keepaliveTimeout() time.Duration {
+	if p.KeepaliveTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return p.KeepaliveTimeout
+}
+
+func (p *Pool) maxSessions() int {
+	if p.MaxSessionsPerClient <= 0 {
+		return 10
+	}
+	return p.MaxSessionsPerClient
+}
+
+// acquire returns a client for addr with a session reserved. dialed is true
+// if the client was dialed for this call.
+func (p *Pool) acquire(addr string) (pc *poolClient, dialed bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	for {
+		if p.closed {
+			return nil, false, ErrPoolClosed
+		}
+		h := p.hosts[addr]
+		if h == nil {
+			h = &poolHost{}
+			p.hosts[addr] = h
+		}
+
+		var best *poolClient
+		for _, pc := range h.clients {
+			if pc.sessions < pc.maxSessions && (best == nil || pc.sessions < best.sessions) {
+				best = pc
+			}
+		}
+		if best != nil {
+			best.sessions++
+			return best, false, nil
+		}
+
+		if len(h.clients)+h.dialing < p.maxClients() {
+			h.dialing++
+			p.mu.Unlock()
+			client, err := p.Dial(addr)
+			p.mu.Lock()
+			h.dialing--
+			if err != nil {
+				p.cond.Broadcast()
+				return nil, false, err
+			}
+			if p.closed {
+				client.Close()
+				return nil, false, ErrPoolClosed
+			}
+			pc = p.newPoolClient(client)
+			pc.sessions++
+			h.clients = append(h.clients, pc)
+			go p.watch(addr, pc)
+			return pc, true, nil
+		}
+
+		p.cond.Wait()
+	}
+}
+
+func (p *Pool) newPoolClient(client *ssh.Client) *poolClient {
+	newSCP := p.NewSCP
+	if newSCP == nil {
+		newSCP = NewSCP
+	}
+	pc := &poolClient{
+		scp:         newSCP(client),
+		client:      client,
+		maxSessions: p.maxSessions(),
+	}
+	pc.scp.transport = &poolTransport{transport: pc.scp.transport, pc: pc}
+	return pc
+}
+
+// poolTransport is the Transport of a pooled client which counts the
+// opened sessions.
+type poolTransport struct {
+	transport Transport
+	pc        *poolClient
+}
+
+func (t *poolTransport) NewSession() (Session, error) {
+	session, err := t.transport.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&t.pc.opened, 1)
+	return session, nil
+}
+
+// watch removes pc from the pool when its connection is closed.
+func (p *Pool) watch(addr string, pc *poolClient) {
+	pc.client.Wait()
+	p.remove(addr, pc)
+}
+
+// remove removes pc from the pool and closes it.
+func (p *Pool) remove(addr string, pc *poolClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc.dead {
+		return
+	}
+	pc.dead = true
+	pc.client.Close()
+	if h := p.hosts[addr]; h != nil {
+		for i, c := range h.clients {
+			if c == pc {
+				h.clients = append(h.clients[:i], h.clients[i+1:]...)
+				break
+			}
+		}
+	}
+	p.cond.Broadcast()
+}
+
+// alive reports whether the connection of pc responds to a keepalive request
+// within timeout.
+func (pc *poolClient) alive(timeout time.Duration) bool {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := pc.client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-timer.C:
+		// The request is abandoned. It returns when the client is closed
+		// by remove.
+		return false
+	}
+}
+
+// release releases the session reserved for pc. It returns true if err is
+// a refusal to open a session and the limit of sessions for pc is lowered.
+func (p *Pool) release(pc *poolClient, err error) (lowered bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.sessions--
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) && openErr.Reason == ssh.Prohibited && pc.maxSessions > 1 {
+		pc.maxSessions--
+		lowered = true
+	}
+	p.cond.Broadcast()
+	return lowered
+}
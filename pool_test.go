@@ -0,0 +1,352 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPool(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	var mu sync.Mutex
+	var clients []*ssh.Client
+	pool := &scp.Pool{
+		Dial: func(addr string) (*ssh.Client, error) {
+			c, err := newTestSshClient(addr)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			clients = append(clients, c)
+			mu.Unlock()
+			return c, nil
+		},
+		MaxClientsPerHost:    2,
+		MaxSessionsPerClient: 2,
+	}
+	defer pool.Close()
+	addr := l.Addr().String()
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestPool-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	send := func(name string) error {
+		return pool.Do(addr, func(s *scp.SCP) error {
+			content := []byte(name)
+			info := scp.NewFileInfo(name, int64(len(content)), 0644, time.Now(), time.Now())
+			return s.Send(info, ioutil.NopCloser(bytes.NewReader(content)), filepath.Join(remoteDir, name))
+		})
+	}
+
+	t.Run("Concurrent sends", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- send(fmt.Sprintf("file%d", i))
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("fail to send; %s", err)
+			}
+		}
+		for i := 0; i < 20; i++ {
+			name := fmt.Sprintf("file%d", i)
+			got, err := ioutil.ReadFile(filepath.Join(remoteDir, name))
+			if err != nil {
+				t.Fatalf("fail to read file; %s", err)
+			}
+			if string(got) != name {
+				t.Errorf("content unmatch for %s; got=%q", name, got)
+			}
+		}
+		mu.Lock()
+		dialed := len(clients)
+		mu.Unlock()
+		if dialed > 2 {
+			t.Errorf("too many clients; got=%d, want<=2", dialed)
+		}
+	})
+
+	t.Run("Reconnect", func(t *testing.T) {
+		mu.Lock()
+		for _, c := range clients {
+			c.Close()
+		}
+		dialed := len(clients)
+		mu.Unlock()
+
+		err := send("after-reconnect")
+		if err != nil {
+			t.Fatalf("fail to send after reconnect; %s", err)
+		}
+		mu.Lock()
+		redialed := len(clients)
+		mu.Unlock()
+		if redialed <= dialed {
+			t.Errorf("client was not redialed; got=%d, want>%d", redialed, dialed)
+		}
+	})
+
+	closeClients := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range clients {
+			c.Close()
+		}
+	}
+
+	t.Run("Retry without sessions", func(t *testing.T) {
+		err := send("before-retry")
+		if err != nil {
+			t.Fatalf("fail to send; %s", err)
+		}
+		calls := 0
+		err = pool.Do(addr, func(s *scp.SCP) error {
+			calls++
+			if calls == 1 {
+				closeClients()
+				return errors.New("failed before opening sessions")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("unexpected error; %s", err)
+		}
+		if calls != 2 {
+			t.Errorf("calls unmatch; got=%d, want=2", calls)
+		}
+	})
+
+	t.Run("No retry after a session is opened", func(t *testing.T) {
+		err := send("before-no-retry")
+		if err != nil {
+			t.Fatalf("fail to send; %s", err)
+		}
+		calls := 0
+		wantErr := errors.New("failed after sending")
+		err = pool.Do(addr, func(s *scp.SCP) error {
+			calls++
+			content := []byte("partial")
+			info := scp.NewFileInfo("partial", int64(len(content)), 0644, time.Now(), time.Now())
+			err := s.Send(info, ioutil.NopCloser(bytes.NewReader(content)), filepath.Join(remoteDir, "partial"))
+			if err != nil {
+				return err
+			}
+			closeClients()
+			return wantErr
+		})
+		if err != wantErr {
+			t.Errorf("unexpected error; got=%v, want=%v", err, wantErr)
+		}
+		if calls != 1 {
+			t.Errorf("calls unmatch; got=%d, want=1", calls)
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		pool.Close()
+		err := send("after-close")
+		if err != scp.ErrPoolClosed {
+			t.Errorf("unexpected error; got=%v, want=%v", err, scp.ErrPoolClosed)
+		}
+	})
+}
+
+func TestPoolNoRetryAfterRefusal(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	pool := &scp.Pool{
+		Dial: newTestSshClient,
+		// The server refuses every second session like the one for chown
+		// after a file is sent with WithOwner.
+		NewSCP: func(client *ssh.Client) *scp.SCP {
+			return scp.NewSCPWithTransport(&refusingTransport{client: client})
+		},
+		MaxSessionsPerClient: 2,
+	}
+	defer pool.Close()
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestPoolNoRetryAfterRefusal-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	calls := 0
+	err = pool.Do(l.Addr().String(), func(s *scp.SCP) error {
+		calls++
+		for _, name := range []string{"file1", "file2"} {
+			content := []byte(name)
+			info := scp.NewFileInfo(name, int64(len(content)), 0644, time.Now(), time.Now())
+			err := s.Send(info, ioutil.NopCloser(bytes.NewReader(content)), filepath.Join(remoteDir, name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.Prohibited {
+		t.Errorf("unexpected error; %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("calls unmatch; got=%d, want=1", calls)
+	}
+}
+
+// refusingTransport opens sessions on client, refusing every second one
+// with "administratively prohibited".
+type refusingTransport struct {
+	client *ssh.Client
+	mu     sync.Mutex
+	count  int
+}
+
+func (t *refusingTransport) NewSession() (scp.Session, error) {
+	t.mu.Lock()
+	t.count++
+	refused := t.count%2 == 0
+	t.mu.Unlock()
+	if refused {
+		return nil, &ssh.OpenChannelError{Reason: ssh.Prohibited, Message: "open failed"}
+	}
+	return t.client.NewSession()
+}
+
+func TestPoolKeepaliveTimeout(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	var mu sync.Mutex
+	var conns []*stallingConn
+	pool := &scp.Pool{
+		Dial: func(addr string) (*ssh.Client, error) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			sc := newStallingConn(conn)
+			mu.Lock()
+			conns = append(conns, sc)
+			mu.Unlock()
+			config := &ssh.ClientConfig{
+				User:            testSshdUser,
+				Auth:            []ssh.AuthMethod{ssh.Password(testSshdPassword)},
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			}
+			c, chans, reqs, err := ssh.NewClientConn(sc, addr, config)
+			if err != nil {
+				return nil, err
+			}
+			return ssh.NewClient(c, chans, reqs), nil
+		},
+		KeepaliveTimeout: 100 * time.Millisecond,
+	}
+	defer pool.Close()
+	addr := l.Addr().String()
+
+	err = pool.Do(addr, func(s *scp.SCP) error { return nil })
+	if err != nil {
+		t.Fatalf("fail to dial; %s", err)
+	}
+
+	// The first connection stops receiving like a half-open TCP connection,
+	// so the keepalive request after the failure is not answered.
+	mu.Lock()
+	conns[0].stall()
+	mu.Unlock()
+	calls := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- pool.Do(addr, func(s *scp.SCP) error {
+			calls++
+			if calls == 1 {
+				return errors.New("failed before opening sessions")
+			}
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error; %s", err)
+		}
+		if calls != 2 {
+			t.Errorf("calls unmatch; got=%d, want=2", calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Do hangs on a stalled connection")
+	}
+}
+
+// stallingConn is a connection which stops delivering the received data
+// after stall is called, until it is closed.
+type stallingConn struct {
+	net.Conn
+	stallOnce sync.Once
+	stalled   chan struct{}
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStallingConn(conn net.Conn) *stallingConn {
+	return &stallingConn{Conn: conn, stalled: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *stallingConn) stall() {
+	c.stallOnce.Do(func() { close(c.stalled) })
+}
+
+func (c *stallingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	select {
+	case <-c.stalled:
+		<-c.closed
+		return 0, io.EOF
+	default:
+		return n, err
+	}
+}
+
+func (c *stallingConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,150 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Preserve is the set of attributes of files and directories which are
+// copied to the destination by a transfer.
+type Preserve int
+
+const (
+	// PreserveMode sets the permission of the destination files and
+	// directories to that of the source, even if they exist.
+	PreserveMode Preserve = 1 << iota
+	// PreserveTimes sets the modification and access times of the
+	// destination files and directories to those of the source.
+	PreserveTimes
+
+	// PreserveNone preserves no attributes like scp without -p.
+	// New files and directories are created with the permission of the
+	// source masked by the umask, and existing ones keep their permission.
+	PreserveNone Preserve = 0
+	// PreserveAll preserves the permission and the times like scp -p.
+	// It is the default.
+	PreserveAll = PreserveMode | PreserveTimes
+)
+
+// WithPreserve sets the attributes preserved by a transfer.
+func WithPreserve(p Preserve) Option {
+	return func(o *transferOptions) {
+		o.preserve = p
+	}
+}
+
+// WithUmask masks the permission of the destination files and directories
+// with mask, like 022 or 027, in addition to the permission set with
+// WithFileMode or WithDirMode. With PreserveNone, the remote umask is
+// also applied to new remote files by the scp command, while new local
+// files are created with the masked permission exactly.
+func WithUmask(mask os.FileMode) Option {
+	return func(o *transferOptions) {
+		o.umask = mask & os.ModePerm
+		o.setsUmask = true
+	}
+}
+
+// WithFileMode sets the permission of the destination files to mode
+// regardless of the source and the Preserve option. Since the scp command
+// applies permissions to all the files and directories with -p, the
+// permission of the sent directories is also set exactly to that of the
+// source masked by WithUmask unless WithDirMode is used.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *transferOptions) {
+		o.fileMode = mode & os.ModePerm
+	}
+}
+
+// WithDirMode is like WithFileMode, but for the destination directories.
+func WithDirMode(mode os.FileMode) Option {
+	return func(o *transferOptions) {
+		o.dirMode = mode & os.ModePerm
+	}
+}
+
+// preservesTimes returns whether the times of the destination are set.
+func (o *transferOptions) preservesTimes() bool {
+	return o.preserve&PreserveTimes != 0
+}
+
+// explicitMode returns the permission set with WithFileMode or WithDirMode,
+// or zero if it is not set.
+func (o *transferOptions) explicitMode(isDir bool) os.FileMode {
+	if isDir {
+		return o.dirMode
+	}
+	return o.fileMode
+}
+
+// setsMode returns whether the permission of the destination files or
+// directories is set even if they exist.
+func (o *transferOptions) setsMode(isDir bool) bool {
+	return o.preserve&PreserveMode != 0 || o.explicitMode(isDir) != 0
+}
+
+// setsRemoteMode returns whether the scp command on the remote is run
+// with -p to set the permission of the files and directories it writes.
+func (o *transferOptions) setsRemoteMode() bool {
+	return o.setsMode(false) || o.setsMode(true)
+}
+
+// destMode returns the mode of the destination for the source mode.
+func (o *transferOptions) destMode(mode os.FileMode, isDir bool) os.FileMode {
+	perm := o.explicitMode(isDir)
+	if perm == 0 {
+		perm = mode & os.ModePerm
+	}
+	return mode&^os.ModePerm | perm&^o.umask
+}
+
+// destFileInfo returns info with the mode of the destination.
+func (o *transferOptions) destFileInfo(info *FileInfo) *FileInfo {
+	fi := *info
+	fi.mode = o.destMode(info.mode, info.IsDir())
+	return &fi
+}
+
+// setLocalMode sets the permission of the local file or directory name
+// for the source mode. created is true if name is created by the transfer.
+func (o *transferOptions) setLocalMode(name string, mode os.FileMode, isDir, created bool) error {
+	if !o.setsMode(isDir) && !(created && o.setsUmask) {
+		return nil
+	}
+	err := os.Chmod(name, o.destMode(mode, isDir)&os.ModePerm)
+	if err != nil {
+		if isDir {
+			return fmt.Errorf("failed to change directory mode: %w", err)
+		}
+		return fmt.Errorf("failed to change file mode: %w", err)
+	}
+	return nil
+}
+
+// setLocalTimes sets the times of the local file or directory name if
+// they are preserved and known.
+func (o *transferOptions) setLocalTimes(name string, atime, mtime time.Time, isDir bool) error {
+	if !o.preservesTimes() || (atime.IsZero() && mtime.IsZero()) {
+		return nil
+	}
+	err := os.Chtimes(name, atime, mtime)
+	if err != nil {
+		if isDir {
+			return fmt.Errorf("failed to change directory time: %w", err)
+		}
+		return fmt.Errorf("failed to change file time: %w", err)
+	}
+	return nil
+}
+
+// localExists returns whether the local file name exists.
+func localExists(name string) (bool, error) {
+	_, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to get information of destination file: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,138 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestPreserve(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	checkMode := func(t *testing.T, name string, want os.FileMode, wantModTime bool) {
+		t.Helper()
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if got := fi.Mode() & os.ModePerm; got != want {
+			t.Errorf("mode of %s unmatch; got=%#o, want=%#o", filepath.Base(name), got, want)
+		}
+		if got := fi.ModTime().Equal(modTime); got != wantModTime {
+			t.Errorf("modTime of %s unmatch; got=%s, preserved=%v", filepath.Base(name), fi.ModTime(), wantModTime)
+		}
+	}
+	writeFile := func(t *testing.T, name string, mode os.FileMode) {
+		t.Helper()
+		err := writeFileWithModTime(name, []byte("hello"), modTime)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		err = os.Chmod(name, mode)
+		if err != nil {
+			t.Fatalf("fail to change mode; %s", err)
+		}
+	}
+
+	forEachTestBackend(t, func(t *testing.T, s *scp.SCP, localDir, remoteDir string) {
+		t.Run("File mode", func(t *testing.T) {
+			writeFile(t, filepath.Join(localDir, "file1"), 0755)
+			err := s.SendFile(filepath.Join(localDir, "file1"), filepath.Join(remoteDir, "file1"), scp.WithFileMode(0640))
+			if err != nil {
+				t.Fatalf("fail to send file; %s", err)
+			}
+			checkMode(t, filepath.Join(remoteDir, "file1"), 0640, true)
+		})
+
+		t.Run("PreserveNone keeps existing mode", func(t *testing.T) {
+			writeFile(t, filepath.Join(localDir, "file2"), 0644)
+			err := ioutil.WriteFile(filepath.Join(remoteDir, "file2"), nil, 0600)
+			if err != nil {
+				t.Fatalf("fail to write file; %s", err)
+			}
+			err = os.Chmod(filepath.Join(remoteDir, "file2"), 0600)
+			if err != nil {
+				t.Fatalf("fail to change mode; %s", err)
+			}
+			err = s.SendFile(filepath.Join(localDir, "file2"), filepath.Join(remoteDir, "file2"), scp.WithPreserve(scp.PreserveNone))
+			if err != nil {
+				t.Fatalf("fail to send file; %s", err)
+			}
+			checkMode(t, filepath.Join(remoteDir, "file2"), 0600, false)
+			checkFileContents(t, remoteDir, map[string]string{"file2": "hello"})
+		})
+
+		t.Run("SendDir with modes", func(t *testing.T) {
+			srcDir := filepath.Join(localDir, "src")
+			err := os.Mkdir(srcDir, 0755)
+			if err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+			writeFile(t, filepath.Join(srcDir, "file3"), 0666)
+			err = s.SendDir(srcDir, filepath.Join(remoteDir, "dest"), nil, scp.WithDirMode(0750), scp.WithFileMode(0640))
+			if err != nil {
+				t.Fatalf("fail to send directory; %s", err)
+			}
+			fi, err := os.Stat(filepath.Join(remoteDir, "dest"))
+			if err != nil {
+				t.Fatalf("fail to stat directory; %s", err)
+			}
+			if got := fi.Mode() & os.ModePerm; got != 0750 {
+				t.Errorf("directory mode unmatch; got=%#o, want=%#o", got, 0750)
+			}
+			checkMode(t, filepath.Join(remoteDir, "dest", "file3"), 0640, true)
+		})
+
+		t.Run("ReceiveDir with umask", func(t *testing.T) {
+			srcDir := filepath.Join(remoteDir, "src2")
+			err := os.Mkdir(srcDir, 0755)
+			if err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+			writeFile(t, filepath.Join(srcDir, "file4"), 0644)
+			writeFile(t, filepath.Join(srcDir, "exec1"), 0755)
+			destDir := filepath.Join(localDir, "received")
+			err = os.Mkdir(destDir, 0755)
+			if err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+			err = s.ReceiveDir(srcDir, destDir, nil, scp.WithPreserve(scp.PreserveTimes), scp.WithUmask(027))
+			if err != nil {
+				t.Fatalf("fail to receive directory; %s", err)
+			}
+			fi, err := os.Stat(filepath.Join(destDir, "src2"))
+			if err != nil {
+				t.Fatalf("fail to stat directory; %s", err)
+			}
+			if got := fi.Mode() & os.ModePerm; got != 0750 {
+				t.Errorf("directory mode unmatch; got=%#o, want=%#o", got, 0750)
+			}
+			checkMode(t, filepath.Join(destDir, "src2", "file4"), 0640, true)
+			checkMode(t, filepath.Join(destDir, "src2", "exec1"), 0750, true)
+		})
+
+		t.Run("ReceiveFile preserving times only", func(t *testing.T) {
+			writeFile(t, filepath.Join(remoteDir, "file5"), 0644)
+			destFile := filepath.Join(localDir, "file5")
+			err := ioutil.WriteFile(destFile, nil, 0600)
+			if err != nil {
+				t.Fatalf("fail to write file; %s", err)
+			}
+			err = os.Chmod(destFile, 0600)
+			if err != nil {
+				t.Fatalf("fail to change mode; %s", err)
+			}
+			err = s.ReceiveFile(filepath.Join(remoteDir, "file5"), destFile, scp.WithPreserve(scp.PreserveTimes))
+			if err != nil {
+				t.Fatalf("fail to receive file; %s", err)
+			}
+			checkMode(t, destFile, 0600, true)
+		})
+	})
+}
@@ -0,0 +1,351 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// ErrSudoPasswordIncorrect is the error reported when sudo on the remote
+// rejects the password returned by Privilege.Password.
+var ErrSudoPasswordIncorrect = errors.New("sudo on the remote rejected the password")
+
+// PrivilegeMethod is the command to run remote commands as another user.
+type PrivilegeMethod int
+
+const (
+	// PrivilegeSudo runs commands with sudo, which can be given a password.
+	PrivilegeSudo PrivilegeMethod = iota
+	// PrivilegeDoas runs commands with doas. It must not ask for a password.
+	PrivilegeDoas
+	// PrivilegeSu runs commands with su. It must not ask for a password,
+	// which is the case when the login user is root.
+	PrivilegeSu
+)
+
+func (m PrivilegeMethod) String() string {
+	switch m {
+	case PrivilegeSudo:
+		return "sudo"
+	case PrivilegeDoas:
+		return "doas"
+	case PrivilegeSu:
+		return "su"
+	default:
+		return fmt.Sprintf("PrivilegeMethod(%d)", int(m))
+	}
+}
+
+// Privilege is the way to run the scp command and the other remote commands
+// as another user. It is for a POSIX shell on the remote.
+type Privilege struct {
+	// Method is the command to switch the user.
+	Method PrivilegeMethod
+	// User is the user to run commands as. If it is empty, root is used.
+	User string
+	// Password returns the password of the login user for sudo. It is
+	// called each time sudo asks for the password, which is not the case
+	// with NOPASSWD or cached credentials. If it is nil, the commands fail
+	// with ErrSudoPasswordRequired when sudo asks for a password.
+	// It is not supported by the other methods.
+	Password func() (string, error)
+}
+
+const (
+	// privilegePrompt is the password prompt of sudo. It ends with a
+	// newline so that it is read as a line from the standard error.
+	privilegePrompt = "[go-scp] sudo password:\n"
+	// privilegeReadyMarker is the line written to the standard output
+	// before the command runs with the privilege.
+	privilegeReadyMarker = "go-scp-privilege-ready"
+)
+
+// command returns the command line to run cmd with the privilege.
+// The privileged shell writes privilegeReadyMarker before running cmd.
+func (p *Privilege) command(cmd string) (string, error) {
+	script := "echo " + privilegeReadyMarker + " && " + cmd
+	switch p.Method {
+	case PrivilegeSudo:
+		c := "sudo -S -p " + escapeShellArg(privilegePrompt)
+		if p.User != "" {
+			c += " -u " + escapeShellArg(p.User)
+		}
+		return c + " -- sh -c " + escapeShellArg(script), nil
+	case PrivilegeDoas:
+		if p.Password != nil {
+			return "", errors.New("password is not supported with doas")
+		}
+		c := "doas -n"
+		if p.User != "" {
+			c += " -u " + escapeShellArg(p.User)
+		}
+		return c + " sh -c " + escapeShellArg(script), nil
+	case PrivilegeSu:
+		if p.Password != nil {
+			return "", errors.New("password is not supported with su")
+		}
+		user := p.User
+		if user == "" {
+			user = "root"
+		}
+		return "su -c " + escapeShellArg(script) + " " + escapeShellArg(user), nil
+	default:
+		return "", fmt.Errorf("unknown privilege method: %s", p.Method)
+	}
+}
+
+// commandTransport returns the transport to run the scp command and the
+// other remote commands which need the privilege of the SCPCommand.
+func (s *SCP) commandTransport() Transport {
+	if s.Privilege == nil {
+		return s.transport
+	}
+	return &privilegeTransport{transport: s.transport, privilege: s.Privilege}
+}
+
+// privilegeTransport is a Transport which runs commands with a Privilege.
+type privilegeTransport struct {
+	transport Transport
+	privilege *Privilege
+}
+
+func (t *privilegeTransport) NewSession() (Session, error) {
+	session, err := t.transport.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return &privilegeSession{session: session, privilege: t.privilege}, nil
+}
+
+// privilegeSession is a session which switches the user before running the
+// command. The password is written to the standard input and the output is
+// read until privilegeReadyMarker in Start, so the caller reads and writes
+// only the data of the command.
+type privilegeSession struct {
+	session   Session
+	privilege *Privilege
+
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr *bufio.Reader
+	// requested* are true if the pipes are requested by the caller.
+	requestedStdin  bool
+	requestedStdout bool
+	// stderrWriter passes the standard error after the handshake to the
+	// reader returned by StderrPipe.
+	stderrWriter *io.PipeWriter
+	stderrReader *io.PipeReader
+}
+
+func (s *privilegeSession) StdinPipe() (io.WriteCloser, error) {
+	if err := s.requestStdin(); err != nil {
+		return nil, err
+	}
+	s.requestedStdin = true
+	return s.stdin, nil
+}
+
+func (s *privilegeSession) StdoutPipe() (io.Reader, error) {
+	if err := s.requestStdout(); err != nil {
+		return nil, err
+	}
+	s.requestedStdout = true
+	return s.stdout, nil
+}
+
+func (s *privilegeSession) StderrPipe() (io.Reader, error) {
+	if err := s.requestStderr(); err != nil {
+		return nil, err
+	}
+	s.stderrReader, s.stderrWriter = io.Pipe()
+	return s.stderrReader, nil
+}
+
+func (s *privilegeSession) requestStdin() error {
+	if s.stdin != nil {
+		return nil
+	}
+	stdin, err := s.session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	s.stdin = stdin
+	return nil
+}
+
+func (s *privilegeSession) requestStdout() error {
+	if s.stdout != nil {
+		return nil
+	}
+	stdout, err := s.session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	s.stdout = bufio.NewReader(stdout)
+	return nil
+}
+
+func (s *privilegeSession) requestStderr() error {
+	if s.stderr != nil {
+		return nil
+	}
+	stderr, err := s.session.StderrPipe()
+	if err != nil {
+		return err
+	}
+	s.stderr = bufio.NewReader(stderr)
+	return nil
+}
+
+func (s *privilegeSession) Start(cmd string) error {
+	// All the pipes are needed for the handshake.
+	if err := s.requestStdin(); err != nil {
+		return err
+	}
+	if err := s.requestStdout(); err != nil {
+		return err
+	}
+	if err := s.requestStderr(); err != nil {
+		return err
+	}
+
+	privCmd, err := s.privilege.command(cmd)
+	if err != nil {
+		return err
+	}
+	err = s.session.Start(privCmd)
+	if err != nil {
+		return err
+	}
+	err = s.handshake()
+	if err != nil {
+		return fmt.Errorf("failed to run command with %s: %w", s.privilege.Method, err)
+	}
+
+	if !s.requestedStdin {
+		s.stdin.Close()
+	}
+	if !s.requestedStdout {
+		go io.Copy(ioutil.Discard, s.stdout)
+	}
+	return nil
+}
+
+// handshake answers the password prompts until privilegeReadyMarker is
+// read from the standard output.
+func (s *privilegeSession) handshake() error {
+	ready := make(chan error, 1)
+	go func() {
+		line, err := s.stdout.ReadString('\n')
+		if err == nil && strings.TrimRight(line, "\r\n") != privilegeReadyMarker {
+			err = fmt.Errorf("unexpected output: %q", line)
+		}
+		ready <- err
+	}()
+
+	// The standard error is read by a goroutine which reports the prompts
+	// until the command is ready, and then passes the rest to the caller.
+	var (
+		mu       sync.Mutex
+		started  bool
+		messages bytes.Buffer
+	)
+	prompts := make(chan struct{})
+	stderrDone := make(chan struct{})
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		defer close(stderrDone)
+		var out io.Writer = ioutil.Discard
+		if s.stderrWriter != nil {
+			out = s.stderrWriter
+			defer s.stderrWriter.Close()
+		}
+		for {
+			line, err := s.stderr.ReadString('\n')
+			mu.Lock()
+			if started {
+				mu.Unlock()
+				io.WriteString(out, line)
+				if err == nil {
+					_, err = io.Copy(out, s.stderr)
+				}
+				return
+			}
+			if line == privilegePrompt {
+				mu.Unlock()
+				select {
+				case prompts <- struct{}{}:
+				case <-handshakeDone:
+					return
+				}
+			} else {
+				messages.WriteString(line)
+				mu.Unlock()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	failure := func(err error) error {
+		if err == io.EOF {
+			// The command exited without running, and the reason is in
+			// the standard error.
+			<-stderrDone
+			mu.Lock()
+			defer mu.Unlock()
+			if msg := strings.TrimSpace(messages.String()); msg != "" {
+				return errors.New(msg)
+			}
+		}
+		return err
+	}
+
+	sentPassword := false
+	for {
+		select {
+		case err := <-ready:
+			if err != nil {
+				return failure(err)
+			}
+			mu.Lock()
+			started = true
+			mu.Unlock()
+			return nil
+		case <-prompts:
+			if s.privilege.Password == nil {
+				return ErrSudoPasswordRequired
+			}
+			if sentPassword {
+				return ErrSudoPasswordIncorrect
+			}
+			password, err := s.privilege.Password()
+			if err != nil {
+				return fmt.Errorf("failed to get password: %w", err)
+			}
+			_, err = io.WriteString(s.stdin, password+"\n")
+			if err != nil {
+				return fmt.Errorf("failed to write password: %w", err)
+			}
+			sentPassword = true
+		}
+	}
+}
+
+func (s *privilegeSession) Wait() error {
+	return s.session.Wait()
+}
+
+func (s *privilegeSession) Close() error {
+	if s.stderrReader != nil {
+		s.stderrReader.Close()
+	}
+	return s.session.Close()
+}
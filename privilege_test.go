@@ -0,0 +1,175 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+// fakeSudo is a sudo which asks for $FAKE_SUDO_PASSWORD three times at most,
+// or runs the command without asking if it is empty.
+const fakeSudo = `#!/bin/sh
+prompt='Password:'
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-S) shift ;;
+	-p) prompt=$2; shift 2 ;;
+	-u) shift 2 ;;
+	--) shift; break ;;
+	*) break ;;
+	esac
+done
+if [ -n "$FAKE_SUDO_PASSWORD" ]; then
+	tries=0
+	while :; do
+		printf '%s' "$prompt" >&2
+		IFS= read -r password || exit 1
+		[ "$password" = "$FAKE_SUDO_PASSWORD" ] && break
+		tries=$((tries + 1))
+		if [ $tries -ge 3 ]; then
+			echo "sudo: 3 incorrect password attempts" >&2
+			exit 1
+		fi
+		echo "Sorry, try again." >&2
+	done
+fi
+exec "$@"
+`
+
+// fakeDoas is a doas which denies all the commands.
+const fakeDoas = `#!/bin/sh
+echo "doas: Authorization required" >&2
+exit 1
+`
+
+func TestPrivilege(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "go-scp-TestPrivilege-bin")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(binDir)
+	for name, script := range map[string]string{"sudo": fakeSudo, "doas": fakeDoas} {
+		err := ioutil.WriteFile(filepath.Join(binDir, name), []byte(script), 0755)
+		if err != nil {
+			t.Fatalf("fail to write %s; %s", name, err)
+		}
+	}
+	localDir, err := ioutil.TempDir("", "go-scp-TestPrivilege-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestPrivilege-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = writeFileWithModTime(filepath.Join(localDir, "file1"), []byte("hello"), modTime)
+	if err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
+
+	newSCP := func(sudoPassword string, privilege *scp.Privilege) *scp.SCP {
+		env := append(os.Environ(),
+			"PATH="+binDir+":"+os.Getenv("PATH"),
+			"FAKE_SUDO_PASSWORD="+sudoPassword)
+		sc := scp.NewSCPWithTransport(&scp.ExecTransport{Env: env})
+		sc.Privilege = privilege
+		return sc
+	}
+	passwordFunc := func(password string, calls *int) func() (string, error) {
+		return func() (string, error) {
+			*calls++
+			return password, nil
+		}
+	}
+
+	t.Run("sudo with password", func(t *testing.T) {
+		var calls int
+		sc := newSCP("secret", &scp.Privilege{Password: passwordFunc("secret", &calls)})
+		remotePath := filepath.Join(remoteDir, "file1")
+		err := sc.SendFile(filepath.Join(localDir, "file1"), remotePath)
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{"file1": "hello"})
+
+		err = sc.ReceiveFile(remotePath, filepath.Join(localDir, "file2"))
+		if err != nil {
+			t.Fatalf("fail to receive file; %s", err)
+		}
+		checkFileContents(t, localDir, map[string]string{"file2": "hello"})
+
+		fi, err := sc.Stat(remotePath)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if fi.Size() != 5 || !fi.ModTime().Equal(modTime) {
+			t.Errorf("file info unmatch; size=%d, modTime=%s", fi.Size(), fi.ModTime())
+		}
+		if calls != 3 {
+			t.Errorf("password calls unmatch; got=%d, want=3", calls)
+		}
+	})
+
+	t.Run("sudo without asking", func(t *testing.T) {
+		var calls int
+		sc := newSCP("", &scp.Privilege{Password: passwordFunc("secret", &calls)})
+		err := sc.ReceiveFile(filepath.Join(remoteDir, "file1"), filepath.Join(localDir, "file3"))
+		if err != nil {
+			t.Fatalf("fail to receive file; %s", err)
+		}
+		checkFileContents(t, localDir, map[string]string{"file3": "hello"})
+		if calls != 0 {
+			t.Errorf("password calls unmatch; got=%d, want=0", calls)
+		}
+	})
+
+	t.Run("sudo password required", func(t *testing.T) {
+		sc := newSCP("secret", &scp.Privilege{})
+		err := sc.ReceiveFile(filepath.Join(remoteDir, "file1"), filepath.Join(localDir, "file4"))
+		if !errors.Is(err, scp.ErrSudoPasswordRequired) {
+			t.Errorf("unexpected error; got=%v, want=%v", err, scp.ErrSudoPasswordRequired)
+		}
+	})
+
+	t.Run("sudo password incorrect", func(t *testing.T) {
+		var calls int
+		sc := newSCP("secret", &scp.Privilege{Password: passwordFunc("wrong", &calls)})
+		err := sc.SendFile(filepath.Join(localDir, "file1"), filepath.Join(remoteDir, "file5"))
+		if !errors.Is(err, scp.ErrSudoPasswordIncorrect) {
+			t.Errorf("unexpected error; got=%v, want=%v", err, scp.ErrSudoPasswordIncorrect)
+		}
+		if _, err := os.Stat(filepath.Join(remoteDir, "file5")); !os.IsNotExist(err) {
+			t.Errorf("file should not exist; err=%v", err)
+		}
+	})
+
+	t.Run("doas denied", func(t *testing.T) {
+		sc := newSCP("", &scp.Privilege{Method: scp.PrivilegeDoas})
+		err := sc.ReceiveFile(filepath.Join(remoteDir, "file1"), filepath.Join(localDir, "file6"))
+		if err == nil || !strings.Contains(err.Error(), "doas: Authorization required") {
+			t.Errorf("unexpected error; got=%v", err)
+		}
+	})
+
+	t.Run("doas with password", func(t *testing.T) {
+		var calls int
+		sc := newSCP("", &scp.Privilege{Method: scp.PrivilegeDoas, Password: passwordFunc("secret", &calls)})
+		err := sc.ReceiveFile(filepath.Join(remoteDir, "file1"), filepath.Join(localDir, "file7"))
+		if err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Errorf("unexpected error; got=%v", err)
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package scp
+
+import "io"
+
+// ProgressFunc is the type of the function called while a file body is
+// transferred. name is the base name of the file, transferred is the number
+// of bytes transferred so far and size is the size of the file.
+// It is called at least once for each file including empty ones.
+type ProgressFunc func(name string, transferred, size int64)
+
+// WithProgress sets the function to report the progress of file bodies.
+// It is not used by SendOpen and ReceiveOpen since their callers read or
+// write the bodies.
+func WithProgress(fn ProgressFunc) Option {
+	return func(o *transferOptions) {
+		o.progress = fn
+	}
+}
+
+// progressWriter reports the number of bytes written to w.
+type progressWriter struct {
+	w           io.Writer
+	fn          ProgressFunc
+	name        string
+	transferred int64
+	size        int64
+}
+
+// newProgressWriter returns w as is if fn is nil.
+func newProgressWriter(w io.Writer, fn ProgressFunc, name string, size int64) io.Writer {
+	if fn == nil {
+		return w
+	}
+	fn(name, 0, size)
+	return &progressWriter{w: w, fn: fn, name: name, size: size}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if n > 0 {
+		p.transferred += int64(n)
+		p.fn(p.name, p.transferred, p.size)
+	}
+	return n, err
+}
@@ -2,8 +2,10 @@ package scp
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -27,36 +29,54 @@ type sourceProtocol struct {
 	remIn     io.WriteCloser
 	remOut    io.Reader
 	remReader *bufio.Reader
+	limiters  rateLimiters
+	logger    Logger
+	progress  ProgressFunc
+	// preservesTimes is true if the times are sent.
+	preservesTimes bool
+	// destFileInfo returns the information with the mode sent to the remote.
+	destFileInfo func(info *FileInfo) *FileInfo
 }
 
-func newSourceProtocol(remIn io.WriteCloser, remOut io.Reader) (*sourceProtocol, error) {
+func newSourceProtocol(remIn io.WriteCloser, remOut io.Reader, o *transferOptions) (*sourceProtocol, error) {
 	s := &sourceProtocol{
 		remIn:     remIn,
 		remOut:    remOut,
 		remReader: bufio.NewReader(remOut),
+		limiters:  o.limiters,
+		logger:    o.logger,
+		progress:  o.progress,
+
+		preservesTimes: o.preservesTimes(),
+		destFileInfo:   o.destFileInfo,
 	}
 
 	return s, s.readReply()
 }
 
 func (s *sourceProtocol) WriteFile(fileInfo *FileInfo, body io.ReadCloser) error {
-	if !fileInfo.modTime.IsZero() || !fileInfo.accessTime.IsZero() {
-		err := s.setTime(fileInfo.modTime, fileInfo.accessTime)
-		if err != nil {
-			return err
-		}
+	err := s.writeTime(fileInfo)
+	if err != nil {
+		body.Close()
+		return err
 	}
-	return s.writeFile(fileInfo.mode, fileInfo.size, fileInfo.name, body)
+	return s.writeFile(s.destFileInfo(fileInfo).mode, fileInfo.size, fileInfo.name, body)
 }
 
 func (s *sourceProtocol) StartDirectory(dirInfo *FileInfo) error {
-	if !dirInfo.modTime.IsZero() || !dirInfo.accessTime.IsZero() {
-		err := s.setTime(dirInfo.modTime, dirInfo.accessTime)
-		if err != nil {
-			return err
-		}
+	err := s.writeTime(dirInfo)
+	if err != nil {
+		return err
+	}
+	return s.startDirectory(s.destFileInfo(dirInfo).mode, dirInfo.name)
+}
+
+// writeTime sends the times of info if they are preserved and known.
+func (s *sourceProtocol) writeTime(info *FileInfo) error {
+	if !s.preservesTimes || (info.modTime.IsZero() && info.accessTime.IsZero()) {
+		return nil
 	}
-	return s.startDirectory(dirInfo.mode, dirInfo.name)
+	return s.setTime(info.modTime, info.accessTime)
 }
 
 func (s *sourceProtocol) EndDirectory() error {
@@ -66,20 +86,23 @@ func (s *sourceProtocol) EndDirectory() error {
 func (s *sourceProtocol) setTime(mtime, atime time.Time) error {
 	ms, mus := toSecondsAndMicroseconds(mtime)
 	as, aus := toSecondsAndMicroseconds(atime)
-	_, err := fmt.Fprintf(s.remIn, "%c%d %d %d %d\n", msgTime, ms, mus, as, aus)
+	err := s.writeHeader(fmt.Sprintf("%c%d %d %d %d", msgTime, ms, mus, as, aus))
 	if err != nil {
 		return fmt.Errorf("failed to write scp time header: %w", err)
 	}
 	return s.readReply()
 }
 
+// toSecondsAndMicroseconds converts t to the values of a time message.
+// Nanoseconds are truncated like the scp command of OpenSSH does, so the
+// time on the remote is never later than t.
 func toSecondsAndMicroseconds(t time.Time) (seconds int64, microseconds int) {
-	rounded := t.Round(time.Microsecond)
-	return rounded.Unix(), rounded.Nanosecond() / int(int64(time.Microsecond)/int64(time.Nanosecond))
+	truncated := t.Truncate(time.Microsecond)
+	return truncated.Unix(), truncated.Nanosecond() / int(int64(time.Microsecond)/int64(time.Nanosecond))
 }
 
 func (s *sourceProtocol) writeFileHeader(mode os.FileMode, length int64, filename string) error {
-	_, err := fmt.Fprintf(s.remIn, "%c%#4o %d %s\n", msgCopyFile, mode&os.ModePerm, length, filepath.Base(filename))
+	err := s.writeHeader(fmt.Sprintf("%c%#4o %d %s", msgCopyFile, mode&os.ModePerm, length, filepath.Base(filename)))
 	if err != nil {
 		return fmt.Errorf("failed to write scp file header: %w", err)
 	}
@@ -92,28 +115,85 @@ func (s *sourceProtocol) writeFile(mode os.FileMode, length int64, filename stri
 		return err
 	}
 
-	_, err = io.Copy(s.remIn, body)
+	changed, err := s.writeFileBody(filepath.Base(filename), length, body)
 	// NOTE: We close body whether or not copy fails and ignore an error from closing body.
 	body.Close()
 	if err != nil {
-		return fmt.Errorf("failed to write scp file body: %w", err)
+		return err
 	}
 	err = s.readReply()
 	if err != nil {
 		return err
 	}
 
-	_, err = s.remIn.Write([]byte{replyOK})
+	if changed {
+		// Tell the remote the file is broken like OpenSSH scp does.
+		// The remote still acknowledges the file and exits with an error later.
+		err = s.writeReply(replyError, fmt.Sprintf("%s: %s", filepath.Base(filename), ErrFileChanged))
+		if err != nil {
+			return fmt.Errorf("failed to write scp replyError reply: %w", err)
+		}
+		err = s.readReply()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%s: %w", filepath.Base(filename), ErrFileChanged)
+	}
+
+	err = s.writeReply(replyOK, "")
 	if err != nil {
 		return fmt.Errorf("failed to write scp replyOK reply: %w", err)
 	}
 	return s.readReply()
 }
 
+// writeFileBody writes exactly length bytes of body to the remote.
+// If body ends early, the rest is padded with zeros. changed is true
+// if body is shorter than length or body has a different size
+// after copying.
+func (s *sourceProtocol) writeFileBody(name string, length int64, body io.Reader) (changed bool, err error) {
+	w := newProgressWriter(s.limiters.writer(s.remIn), s.progress, name, length)
+	changed, err = copyFileBody(w, length, body)
+	if err != nil {
+		return changed, fmt.Errorf("failed to write scp file body: %w", err)
+	}
+	return changed, nil
+}
+
+// copyFileBody writes exactly length bytes of body to w in the same way
+// as writeFileBody.
+func copyFileBody(w io.Writer, length int64, body io.Reader) (changed bool, err error) {
+	n, err := io.CopyN(w, body, length)
+	if err == io.EOF {
+		changed = true
+		_, err = io.CopyN(w, zeroReader{}, length-n)
+	}
+	if err != nil {
+		return changed, err
+	}
+
+	if st, ok := body.(interface{ Stat() (os.FileInfo, error) }); ok {
+		fi, err := st.Stat()
+		if err == nil && fi.Mode().IsRegular() && fi.Size() != length {
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
 func (s *sourceProtocol) startDirectory(mode os.FileMode, dirname string) error {
 	// length is not used.
 	length := 0
-	_, err := fmt.Fprintf(s.remIn, "%c%#4o %d %s\n", msgStartDirectory, mode&os.ModePerm, length, filepath.Base(dirname))
+	err := s.writeHeader(fmt.Sprintf("%c%#4o %d %s", msgStartDirectory, mode&os.ModePerm, length, filepath.Base(dirname)))
 	if err != nil {
 		return fmt.Errorf("failed to write scp start directory header: %w", err)
 	}
@@ -121,28 +201,50 @@ func (s *sourceProtocol) startDirectory(mode os.FileMode, dirname string) error
 }
 
 func (s *sourceProtocol) endDirectory() error {
-	_, err := fmt.Fprintf(s.remIn, "%c\n", msgEndDirectory)
+	err := s.writeHeader(string(msgEndDirectory))
 	if err != nil {
 		return fmt.Errorf("failed to write scp end directory header: %w", err)
 	}
 	return s.readReply()
 }
 
+// writeHeader writes a header line without the trailing newline.
+func (s *sourceProtocol) writeHeader(header string) error {
+	logDebug(s.logger, "scp header sent", "header", header)
+	_, err := io.WriteString(s.remIn, header+"\n")
+	return err
+}
+
+// writeReply writes a reply. msg is used only for replyError and replyFatalError.
+func (s *sourceProtocol) writeReply(b byte, msg string) error {
+	if b == replyOK {
+		logDebug(s.logger, "scp reply sent", "type", b)
+		_, err := s.remIn.Write([]byte{b})
+		return err
+	}
+	logDebug(s.logger, "scp reply sent", "type", b, "message", msg)
+	_, err := fmt.Fprintf(s.remIn, "%c%s\n", b, msg)
+	return err
+}
+
 func (s *sourceProtocol) readReply() error {
 	b, err := s.remReader.ReadByte()
 	if err != nil {
 		return fmt.Errorf("failed to read scp reply type: %w", err)
 	}
 	if b == replyOK {
+		logDebug(s.logger, "scp reply received", "type", b)
 		return nil
 	}
 	if b != replyError && b != replyFatalError {
+		logDebug(s.logger, "scp unexpected reply received", "type", b, "following", bufferedBytes(s.remReader))
 		return fmt.Errorf("unexpected scp reply type: %v", b)
 	}
 	line, err := s.remReader.ReadString('\n')
 	if err != nil {
 		return fmt.Errorf("failed to read scp reply message: %w", err)
 	}
+	logDebug(s.logger, "scp reply received", "type", b, "message", strings.TrimSuffix(line, "\n"))
 	return &protocolError{
 		msg:   line,
 		fatal: b == replyFatalError,
@@ -153,13 +255,19 @@ type sinkProtocol struct {
 	remIn     io.WriteCloser
 	remOut    io.Reader
 	remReader *bufio.Reader
+	limiters  rateLimiters
+	logger    Logger
+	progress  ProgressFunc
 }
 
-func newSinkProtocol(remIn io.WriteCloser, remOut io.Reader) (*sinkProtocol, error) {
+func newSinkProtocol(remIn io.WriteCloser, remOut io.Reader, o *transferOptions) (*sinkProtocol, error) {
 	s := &sinkProtocol{
 		remIn:     remIn,
 		remOut:    remOut,
 		remReader: bufio.NewReader(remOut),
+		limiters:  o.limiters,
+		logger:    o.logger,
+		progress:  o.progress,
 	}
 
 	err := s.WriteReplyOK()
@@ -201,20 +309,17 @@ func (s *sinkProtocol) ReadHeaderOrReply() (interface{}, error) {
 		return nil, fmt.Errorf("failed to read scp message type: %w", err)
 	}
 	switch b {
-	case msgCopyFile:
-		var h fileMsgHeader
-		n, err := fmt.Fscanf(s.remReader, "%04o %d ", &h.Mode, &h.Size)
+	case msgCopyFile, msgStartDirectory, msgEndDirectory, msgTime:
+		line, err := readLine(s.remReader, maxHeaderLength-1)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read scp file message header: %w", err)
-		}
-		if n != 2 {
-			return nil, fmt.Errorf("unexpected count in reading file message header: n=%d", n)
+			return nil, fmt.Errorf("failed to read scp message header: %w", err)
 		}
-		name, err := s.remReader.ReadString('\n')
+		line = string(b) + line
+		h, err := parseHeader(line)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read scp file message header: %w", err)
+			return nil, err
 		}
-		h.Name = strings.TrimSuffix(name, "\n")
+		logDebug(s.logger, "scp header received", "header", line)
 
 		err = s.WriteReplyOK()
 		if err != nil {
@@ -222,91 +327,191 @@ func (s *sinkProtocol) ReadHeaderOrReply() (interface{}, error) {
 		}
 
 		return h, nil
-	case msgStartDirectory:
-		var h startDirectoryMsgHeader
-		var dummySize int64
-		n, err := fmt.Fscanf(s.remReader, "%04o %d ", &h.Mode, &dummySize)
+	case replyOK:
+		logDebug(s.logger, "scp reply received", "type", b)
+		return okMsg{}, nil
+	case replyError, replyFatalError:
+		line, err := readLine(s.remReader, maxHeaderLength-1)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read scp start directory message header: %w", err)
+			return nil, fmt.Errorf("failed to read scp reply error message: %w", err)
 		}
-		if n != 2 {
-			return nil, fmt.Errorf("unexpected count in reading start directory message header: n=%d", n)
+		logDebug(s.logger, "scp reply received", "type", b, "message", line)
+
+		if b == replyError {
+			err = s.WriteReplyOK()
+			if err != nil {
+				return nil, fmt.Errorf("failed to write scp replyOK reply: %w", err)
+			}
 		}
-		name, err := s.remReader.ReadString('\n')
-		if err != nil {
-			return nil, fmt.Errorf("failed to read scp directory message header: %w", err)
+
+		return nil, &protocolError{
+			msg:   line + "\n",
+			fatal: b == replyFatalError,
 		}
-		h.Name = strings.TrimSuffix(name, "\n")
+	default:
+		logDebug(s.logger, "scp invalid message received", "type", b, "following", bufferedBytes(s.remReader))
+		return nil, fmt.Errorf("invalid scp message type: %v", b)
+	}
+}
 
-		err = s.WriteReplyOK()
-		if err != nil {
-			return nil, fmt.Errorf("failed to write scp replyOK reply: %w", err)
+// maxHeaderLength is the maximum length of a header line or a reply message
+// including the type and the newline.
+const maxHeaderLength = 8192
+
+// readLine reads a line up to max bytes excluding the newline, and returns
+// it without the newline.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		line = append(line, frag...)
+		if err == nil {
+			line = line[:len(line)-1]
+		}
+		if len(line) > max {
+			return "", fmt.Errorf("line too long; max=%d", max)
+		}
+		if err == nil {
+			return string(line), nil
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
 		}
+	}
+}
 
-		return h, nil
-	case msgEndDirectory:
-		_, err := s.remReader.ReadString('\n')
+// parseHeader parses a C, D, E or T header line without the newline
+// strictly like OpenSSH scp.
+func parseHeader(line string) (interface{}, error) {
+	if line == "" {
+		return nil, errors.New("empty scp message header")
+	}
+	switch line[0] {
+	case msgCopyFile:
+		mode, size, name, err := parseFileHeader(line)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read scp end directory message: %w", err)
+			return nil, fmt.Errorf("invalid scp file message header %q: %w", line, err)
 		}
-
-		err = s.WriteReplyOK()
+		return fileMsgHeader{Mode: mode, Size: size, Name: name}, nil
+	case msgStartDirectory:
+		mode, _, name, err := parseFileHeader(line)
 		if err != nil {
-			return nil, fmt.Errorf("failed to write scp replyOK reply: %w", err)
+			return nil, fmt.Errorf("invalid scp start directory message header %q: %w", line, err)
+		}
+		return startDirectoryMsgHeader{Mode: mode, Name: name}, nil
+	case msgEndDirectory:
+		if line != string(msgEndDirectory) {
+			return nil, fmt.Errorf("invalid scp end directory message header %q", line)
 		}
-
 		return endDirectoryMsgHeader{}, nil
 	case msgTime:
-		var ms int64
-		var mus int
-		var as int64
-		var aus int
-		n, err := fmt.Fscanf(s.remReader, "%d %d %d %d\n", &ms, &mus, &as, &aus)
+		h, err := parseTimeHeader(line)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read scp time message header: %w", err)
-		}
-		if n != 4 {
-			return nil, fmt.Errorf("unexpected count in reading time message header: n=%d", 3)
+			return nil, fmt.Errorf("invalid scp time message header %q: %w", line, err)
 		}
+		return h, nil
+	default:
+		return nil, fmt.Errorf("invalid scp message type: %v", line[0])
+	}
+}
 
-		err = s.WriteReplyOK()
-		if err != nil {
-			return nil, fmt.Errorf("failed to write scp replyOK reply: %w", err)
+// parseFileHeader parses a C or D header which is the type, exactly four
+// octal digits of the mode, a space, the decimal size, a space and the name.
+func parseFileHeader(line string) (mode os.FileMode, size int64, name string, err error) {
+	rest := line[1:]
+	if len(rest) < 5 || rest[4] != ' ' {
+		return 0, 0, "", errors.New("mode not delimited")
+	}
+	for _, c := range []byte(rest[:4]) {
+		if c < '0' || c > '7' {
+			return 0, 0, "", errors.New("bad mode")
 		}
+		mode = mode<<3 | os.FileMode(c-'0')
+	}
+	rest = rest[5:]
 
-		h := timeMsgHeader{
-			Mtime: fromSecondsAndMicroseconds(ms, mus),
-			Atime: fromSecondsAndMicroseconds(as, aus),
-		}
+	i := strings.IndexByte(rest, ' ')
+	if i < 0 {
+		return 0, 0, "", errors.New("size not delimited")
+	}
+	size, err = parseDecimal(rest[:i], math.MaxInt64)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("bad size: %w", err)
+	}
 
-		return h, nil
-	case replyOK:
-		return okMsg{}, nil
-	case replyError, replyFatalError:
-		line, err := s.remReader.ReadString('\n')
+	name = rest[i+1:]
+	if !isValidFilename(name) {
+		return 0, 0, "", errors.New("unexpected filename")
+	}
+	return mode, size, name, nil
+}
+
+// isValidFilename reports whether name sent by the remote is a single path
+// element which stays in the destination directory. Backslashes are
+// rejected since they are separators on Windows clients.
+func isValidFilename(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\n\x00")
+}
+
+// parseTimeHeader parses a T header which is the type and the seconds and
+// microseconds of the modification and access times delimited by spaces.
+func parseTimeHeader(line string) (timeMsgHeader, error) {
+	fields := strings.Split(line[1:], " ")
+	if len(fields) != 4 {
+		return timeMsgHeader{}, errors.New("time not delimited")
+	}
+	var values [4]int64
+	for i, f := range fields {
+		var err error
+		if i%2 == 0 {
+			values[i], err = parseSeconds(f)
+		} else {
+			values[i], err = parseDecimal(f, 999999)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to read scp reply error message: %w", err)
+			return timeMsgHeader{}, err
 		}
+	}
+	return timeMsgHeader{
+		Mtime: fromSecondsAndMicroseconds(values[0], int(values[1])),
+		Atime: fromSecondsAndMicroseconds(values[2], int(values[3])),
+	}, nil
+}
 
-		if b == replyError {
-			err = s.WriteReplyOK()
-			if err != nil {
-				return nil, fmt.Errorf("failed to write scp replyOK reply: %w", err)
-			}
-		}
+// parseSeconds parses decimal seconds which may be negative.
+func parseSeconds(s string) (int64, error) {
+	if strings.HasPrefix(s, "-") {
+		v, err := parseDecimal(s[1:], math.MaxInt64)
+		return -v, err
+	}
+	return parseDecimal(s, math.MaxInt64)
+}
 
-		return nil, &protocolError{
-			msg:   line,
-			fatal: b == replyFatalError,
+// parseDecimal parses decimal digits without a sign up to max.
+func parseDecimal(s string, max int64) (int64, error) {
+	if s == "" {
+		return 0, errors.New("number not present")
+	}
+	var v int64
+	for _, c := range []byte(s) {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("bad number %q", s)
 		}
-	default:
-		return nil, fmt.Errorf("invalid scp message type: %v", b)
+		d := int64(c - '0')
+		if v > (max-d)/10 {
+			return 0, fmt.Errorf("number out of range %q", s)
+		}
+		v = v*10 + d
 	}
+	return v, nil
 }
 
 func (s *sinkProtocol) CopyFileBodyTo(h fileMsgHeader, w io.Writer) error {
-	lr := io.LimitReader(s.remReader, h.Size)
-	n, err := io.Copy(w, lr)
+	lr := io.LimitReader(s.limiters.reader(s.remReader), h.Size)
+	n, err := io.Copy(newProgressWriter(w, s.progress, h.Name, h.Size), lr)
 	if err == io.EOF {
 		if n != h.Size {
 			return fmt.Errorf("unexpected EOF in CopyFileBodyTo: %w", err)
@@ -324,6 +529,18 @@ func (s *sinkProtocol) CopyFileBodyTo(h fileMsgHeader, w io.Writer) error {
 }
 
 func (s *sinkProtocol) WriteReplyOK() error {
+	logDebug(s.logger, "scp reply sent", "type", byte(replyOK))
 	_, err := s.remIn.Write([]byte{replyOK})
 	return err
 }
+
+// bufferedBytes returns the bytes already buffered in r up to
+// maxLoggedUnexpectedBytes without reading more from the remote.
+func bufferedBytes(r *bufio.Reader) string {
+	n := r.Buffered()
+	if n > maxLoggedUnexpectedBytes {
+		n = maxLoggedUnexpectedBytes
+	}
+	b, _ := r.Peek(n)
+	return string(b)
+}
@@ -0,0 +1,104 @@
+//go:build go1.18
+// +build go1.18
+
+package scp
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var fuzzHeaderSeeds = []string{
+	"C0644 5 file1",
+	"C7777 0 a b",
+	"C0644 9223372036854775807 big",
+	"C0644 -5 file1",
+	"C644 5 file1",
+	"C0644 5 ../file1",
+	"D0755 0 dir1",
+	"D0755 0 ..",
+	"E",
+	"T1577934245 123456 1577934246 0",
+	"T-1 0 0 0",
+	"T1 1000000 3 4",
+}
+
+func FuzzParseHeader(f *testing.F) {
+	for _, seed := range fuzzHeaderSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		h, err := parseHeader(line)
+		if err != nil {
+			return
+		}
+		checkHeader(t, h)
+
+		// A parsed header must be parsed to the same value after formatting.
+		formatted := formatHeader(h)
+		h2, err := parseHeader(formatted)
+		if err != nil {
+			t.Fatalf("formatted header rejected; line=%q, formatted=%q, err=%s", line, formatted, err)
+		}
+		if formatHeader(h2) != formatted {
+			t.Errorf("header unmatch after formatting; line=%q, formatted=%q, got=%+v", line, formatted, h2)
+		}
+	})
+}
+
+func FuzzReadHeaderOrReply(f *testing.F) {
+	f.Add(strings.Join(fuzzHeaderSeeds, "\n") + "\n")
+	f.Add("T1 0 2 0\nC0644 5 file1\n\x00D0755 0 dir1\nE\n")
+	f.Add("\x01scp: file1: No such file or directory\n")
+	f.Add("\x02fatal\n")
+	f.Add("\x00\x00\x00")
+	f.Add("C0644 5 file1")
+	f.Fuzz(func(t *testing.T, input string) {
+		s := newTestSinkProtocol(input)
+		for {
+			h, err := s.ReadHeaderOrReply()
+			if err != nil {
+				return
+			}
+			checkHeader(t, h)
+		}
+	})
+}
+
+// checkHeader checks invariants of a parsed header.
+func checkHeader(t *testing.T, h interface{}) {
+	t.Helper()
+	switch h := h.(type) {
+	case fileMsgHeader:
+		if h.Mode > 07777 || h.Size < 0 || !validHeaderName(h.Name) {
+			t.Errorf("invalid file header accepted; %+v", h)
+		}
+	case startDirectoryMsgHeader:
+		if h.Mode > 07777 || !validHeaderName(h.Name) {
+			t.Errorf("invalid start directory header accepted; %+v", h)
+		}
+	case timeMsgHeader, endDirectoryMsgHeader, okMsg:
+	default:
+		t.Errorf("unexpected header type %T", h)
+	}
+}
+
+func validHeaderName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\n\x00")
+}
+
+// formatHeader formats a parsed header back to a line.
+func formatHeader(h interface{}) string {
+	switch h := h.(type) {
+	case fileMsgHeader:
+		return fmt.Sprintf("C%04o %d %s", h.Mode, h.Size, h.Name)
+	case startDirectoryMsgHeader:
+		return fmt.Sprintf("D%04o 0 %s", h.Mode, h.Name)
+	case endDirectoryMsgHeader:
+		return "E"
+	case timeMsgHeader:
+		return fmt.Sprintf("T%d %d %d %d", h.Mtime.Unix(), h.Mtime.Nanosecond()/1000, h.Atime.Unix(), h.Atime.Nanosecond()/1000)
+	}
+	return ""
+}
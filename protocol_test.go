@@ -0,0 +1,227 @@
+package scp
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func newTestSinkProtocol(input string) *sinkProtocol {
+	return &sinkProtocol{
+		remIn:     nopWriteCloser{ioutil.Discard},
+		remOut:    strings.NewReader(input),
+		remReader: bufio.NewReader(strings.NewReader(input)),
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	testCases := []struct {
+		line    string
+		want    interface{}
+		wantErr bool
+	}{
+		{line: "C0644 5 file1", want: fileMsgHeader{Mode: 0644, Size: 5, Name: "file1"}},
+		{line: "C7777 0 a b", want: fileMsgHeader{Mode: 07777, Size: 0, Name: "a b"}},
+		{line: "C0644 9223372036854775807 big", want: fileMsgHeader{Mode: 0644, Size: 1<<63 - 1, Name: "big"}},
+		{line: "D0755 0 dir1", want: startDirectoryMsgHeader{Mode: 0755, Name: "dir1"}},
+		{line: "E", want: endDirectoryMsgHeader{}},
+		{
+			line: "T1577934245 123456 1577934246 0",
+			want: timeMsgHeader{
+				Mtime: time.Unix(1577934245, 123456000),
+				Atime: time.Unix(1577934246, 0),
+			},
+		},
+		{line: "T-1 0 0 0", want: timeMsgHeader{Mtime: time.Unix(-1, 0), Atime: time.Unix(0, 0)}},
+		{line: "", wantErr: true},
+		{line: "X0644 5 file1", wantErr: true},
+		{line: "C644 5 file1", wantErr: true},
+		{line: "C00644 5 file1", wantErr: true},
+		{line: "C0844 5 file1", wantErr: true},
+		{line: "C0644 -5 file1", wantErr: true},
+		{line: "C0644 +5 file1", wantErr: true},
+		{line: "C0644 9223372036854775808 big", wantErr: true},
+		{line: "C0644 5file1", wantErr: true},
+		{line: "C0644  5 file1", wantErr: true},
+		{line: "C0644 5 ", wantErr: true},
+		{line: "C0644 5 .", wantErr: true},
+		{line: "C0644 5 ..", wantErr: true},
+		{line: "C0644 5 dir/file1", wantErr: true},
+		{line: "C0644 5 \n", wantErr: true},
+		{line: "C0644 5 ..\\x", wantErr: true},
+		{line: "C0644 5 a\x00b", wantErr: true},
+		{line: "D0755 0 ..", wantErr: true},
+		{line: "E ", wantErr: true},
+		{line: "T1 2 3", wantErr: true},
+		{line: "T1 2 3 4 5", wantErr: true},
+		{line: "T1 1000000 3 4", wantErr: true},
+		{line: "T1 -2 3 4", wantErr: true},
+		{line: "T1  3 4", wantErr: true},
+		{line: "T1 2 3 4 ", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := parseHeader(tc.line)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("unexpected success for %q; got=%+v", tc.line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q; %s", tc.line, err)
+			continue
+		}
+		if th, ok := tc.want.(timeMsgHeader); ok {
+			gh, ok := got.(timeMsgHeader)
+			if !ok || !gh.Mtime.Equal(th.Mtime) || !gh.Atime.Equal(th.Atime) {
+				t.Errorf("header unmatch for %q; got=%+v, want=%+v", tc.line, got, tc.want)
+			}
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("header unmatch for %q; got=%+v, want=%+v", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestReadHeaderOrReply(t *testing.T) {
+	t.Run("Messages", func(t *testing.T) {
+		s := newTestSinkProtocol("T1 0 2 0\nC0644 5 file1\n\x00D0755 0 dir1\nE\n")
+		want := []interface{}{
+			timeMsgHeader{Mtime: time.Unix(1, 0), Atime: time.Unix(2, 0)},
+			fileMsgHeader{Mode: 0644, Size: 5, Name: "file1"},
+			okMsg{},
+			startDirectoryMsgHeader{Mode: 0755, Name: "dir1"},
+			endDirectoryMsgHeader{},
+		}
+		for i, w := range want {
+			got, err := s.ReadHeaderOrReply()
+			if err != nil {
+				t.Fatalf("unexpected error for message %d; %s", i, err)
+			}
+			if th, ok := w.(timeMsgHeader); ok {
+				gh, ok := got.(timeMsgHeader)
+				if !ok || !gh.Mtime.Equal(th.Mtime) || !gh.Atime.Equal(th.Atime) {
+					t.Errorf("message %d unmatch; got=%+v, want=%+v", i, got, w)
+				}
+				continue
+			}
+			if got != w {
+				t.Errorf("message %d unmatch; got=%+v, want=%+v", i, got, w)
+			}
+		}
+		if _, err := s.ReadHeaderOrReply(); err != io.EOF {
+			t.Errorf("unexpected error at the end; got=%v, want=%v", err, io.EOF)
+		}
+	})
+
+	t.Run("Error reply", func(t *testing.T) {
+		s := newTestSinkProtocol("\x01scp: file1: No such file or directory\n")
+		_, err := s.ReadHeaderOrReply()
+		pe, ok := err.(*protocolError)
+		if !ok {
+			t.Fatalf("unexpected error type; %v", err)
+		}
+		if pe.Fatal() || pe.Error() != "scp: file1: No such file or directory\n" {
+			t.Errorf("unexpected protocol error; %q fatal=%v", pe.Error(), pe.Fatal())
+		}
+	})
+
+	t.Run("Too long line", func(t *testing.T) {
+		s := newTestSinkProtocol("C0644 5 " + strings.Repeat("a", maxHeaderLength) + "\n")
+		_, err := s.ReadHeaderOrReply()
+		if err == nil {
+			t.Error("unexpected success for too long line")
+		}
+	})
+
+	t.Run("Maximum length line", func(t *testing.T) {
+		name := strings.Repeat("a", maxHeaderLength-len("C0644 5 \n"))
+		s := newTestSinkProtocol("C0644 5 " + name + "\n")
+		got, err := s.ReadHeaderOrReply()
+		if err != nil {
+			t.Fatalf("unexpected error; %s", err)
+		}
+		if h, ok := got.(fileMsgHeader); !ok || h.Name != name {
+			t.Errorf("unexpected header; got=%+v", got)
+		}
+	})
+
+	t.Run("Truncated line", func(t *testing.T) {
+		s := newTestSinkProtocol("C0644 5 file1")
+		_, err := s.ReadHeaderOrReply()
+		if err == nil || err == io.EOF {
+			t.Errorf("unexpected error for truncated line; %v", err)
+		}
+	})
+}
+
+func TestSecondsAndMicroseconds(t *testing.T) {
+	testCases := []struct {
+		time         time.Time
+		seconds      int64
+		microseconds int
+		roundTrip    time.Time
+	}{
+		{
+			time:         time.Unix(1577934245, 123456789),
+			seconds:      1577934245,
+			microseconds: 123456,
+			roundTrip:    time.Unix(1577934245, 123456000),
+		},
+		{
+			// Truncated without carrying to the next second.
+			time:         time.Unix(1577934245, 999999999),
+			seconds:      1577934245,
+			microseconds: 999999,
+			roundTrip:    time.Unix(1577934245, 999999000),
+		},
+		{
+			time:         time.Unix(-2, 500000999),
+			seconds:      -2,
+			microseconds: 500000,
+			roundTrip:    time.Unix(-2, 500000000),
+		},
+	}
+	for _, tc := range testCases {
+		seconds, microseconds := toSecondsAndMicroseconds(tc.time)
+		if seconds != tc.seconds || microseconds != tc.microseconds {
+			t.Errorf("toSecondsAndMicroseconds(%s) = (%d, %d), want (%d, %d)", tc.time, seconds, microseconds, tc.seconds, tc.microseconds)
+		}
+		if got := fromSecondsAndMicroseconds(seconds, microseconds); !got.Equal(tc.roundTrip) {
+			t.Errorf("fromSecondsAndMicroseconds(%d, %d) = %s, want %s", seconds, microseconds, got, tc.roundTrip)
+		}
+	}
+}
+
+func TestCompareModTimes(t *testing.T) {
+	base := time.Unix(1577934245, 0)
+	testCases := []struct {
+		name string
+		opts []Option
+		src  time.Time
+		want int
+	}{
+		{name: "same second", src: base.Add(500 * time.Millisecond), want: 0},
+		{name: "next second", src: base.Add(time.Second), want: 1},
+		{name: "exact", opts: []Option{WithModTimeTolerance(0)}, src: base.Add(time.Microsecond), want: 1},
+		{name: "exact below precision", opts: []Option{WithModTimeTolerance(0)}, src: base.Add(999 * time.Nanosecond), want: 0},
+		{name: "within tolerance", opts: []Option{WithModTimeTolerance(2 * time.Second)}, src: base.Add(-2 * time.Second), want: 0},
+		{name: "older beyond tolerance", opts: []Option{WithModTimeTolerance(time.Second)}, src: base.Add(-1001 * time.Millisecond), want: -1},
+	}
+	for _, tc := range testCases {
+		o := (&SCP{}).newTransferOptions(tc.opts)
+		if got := o.compareModTimes(tc.src, base); got != tc.want {
+			t.Errorf("%s: compareModTimes = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
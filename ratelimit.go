@@ -0,0 +1,140 @@
+package scp
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the bandwidth of file bodies in bytes per second.
+// It is safe to be shared by concurrent transfers.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	// tokens is the number of bytes allowed to be transferred now.
+	// It becomes negative when transfers are ahead of the rate.
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{rate: bytesPerSecond}
+}
+
+func (l *rateLimiter) setRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = bytesPerSecond
+}
+
+// chunkSize returns the maximum number of bytes to be transferred at once.
+// It is about a tenth of a second of transfer to keep the rate smooth.
+func (l *rateLimiter) chunkSize() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size := l.rate / 10
+	if size < 1 {
+		size = 1
+	}
+	if size > maxRateLimitChunkSize {
+		size = maxRateLimitChunkSize
+	}
+	return int(size)
+}
+
+const maxRateLimitChunkSize = 32 * 1024
+
+// wait blocks until n bytes are allowed to be transferred.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	}
+	// Allow a burst of a tenth of a second at most.
+	if burst := float64(l.rate) / 10; l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(d)
+}
+
+// rateLimiters are the limiters applied to a single transfer.
+type rateLimiters []*rateLimiter
+
+func (ls rateLimiters) chunkSize(max int) int {
+	for _, l := range ls {
+		if size := l.chunkSize(); size < max {
+			max = size
+		}
+	}
+	return max
+}
+
+func (ls rateLimiters) wait(n int) {
+	for _, l := range ls {
+		l.wait(n)
+	}
+}
+
+// writer returns w limited with ls.
+func (ls rateLimiters) writer(w io.Writer) io.Writer {
+	if len(ls) == 0 {
+		return w
+	}
+	return &rateLimitedWriter{w: w, limiters: ls}
+}
+
+// reader returns r limited with ls.
+func (ls rateLimiters) reader(r io.Reader) io.Reader {
+	if len(ls) == 0 {
+		return r
+	}
+	return &rateLimitedReader{r: r, limiters: ls}
+}
+
+type rateLimitedWriter struct {
+	w        io.Writer
+	limiters rateLimiters
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := w.limiters.chunkSize(len(p))
+		w.limiters.wait(n)
+		m, err := w.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type rateLimitedReader struct {
+	r        io.Reader
+	limiters rateLimiters
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return r.r.Read(p)
+	}
+	p = p[:r.limiters.chunkSize(len(p))]
+	n, err := r.r.Read(p)
+	r.limiters.wait(n)
+	return n, err
+}
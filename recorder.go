@@ -0,0 +1,531 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directions of transcript entries.
+const (
+	// TranscriptOut is the direction from the local to the remote.
+	TranscriptOut = "out"
+	// TranscriptIn is the direction from the remote to the local.
+	TranscriptIn = "in"
+)
+
+// Kinds of transcript entries.
+const (
+	// TranscriptCommand is the remote command which starts a session.
+	TranscriptCommand = "command"
+	// TranscriptHeader is a C, D, E or T header.
+	TranscriptHeader = "header"
+	// TranscriptOK is a reply of success.
+	TranscriptOK = "ok"
+	// TranscriptError is a reply of a non-fatal error.
+	TranscriptError = "error"
+	// TranscriptFatal is a reply of a fatal error.
+	TranscriptFatal = "fatal"
+	// TranscriptBody is a file body.
+	TranscriptBody = "body"
+	// TranscriptRaw is a line which is not a valid message.
+	TranscriptRaw = "raw"
+	// TranscriptExit is the exit status of the remote command.
+	TranscriptExit = "exit"
+)
+
+// TranscriptEntry is a message of the scp protocol exchange in a transcript.
+type TranscriptEntry struct {
+	Time time.Time `json:"time"`
+	// Session is the sequence number of the session starting from 1.
+	Session int `json:"session"`
+	// Dir is TranscriptOut or TranscriptIn. It is empty for
+	// TranscriptCommand and TranscriptExit.
+	Dir  string `json:"dir,omitempty"`
+	Kind string `json:"kind"`
+	// Line is the command, the header line without the newline, or the
+	// message of an error reply.
+	Line string `json:"line,omitempty"`
+	// Size is the size of a file body.
+	Size int64 `json:"size,omitempty"`
+	// SHA256 is the hex encoded SHA-256 digest of a file body.
+	SHA256 string `json:"sha256,omitempty"`
+	// Data is the file body if bodies are recorded in full, or the bytes of a raw line.
+	Data []byte `json:"data,omitempty"`
+	// Status is the exit status of the remote command.
+	Status int `json:"status,omitempty"`
+}
+
+// Recorder records the scp protocol exchange of sessions to a transcript,
+// which consists of TranscriptEntry values in JSON lines.
+// A Recorder can be set to SCP.Recorder and shared by concurrent transfers.
+type Recorder struct {
+	recordsBodies bool
+
+	mu       sync.Mutex
+	enc      *json.Encoder
+	sessions int
+	err      error
+}
+
+// NewRecorder creates a recorder which writes a transcript to w.
+// If recordsBodies is true, file bodies are recorded in full. Otherwise
+// only their sizes and SHA-256 digests are recorded.
+func NewRecorder(w io.Writer, recordsBodies bool) *Recorder {
+	return &Recorder{
+		recordsBodies: recordsBodies,
+		enc:           json.NewEncoder(w),
+	}
+}
+
+// Err returns the first error in writing the transcript.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) write(e *TranscriptEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	e.Time = time.Now()
+	r.err = r.enc.Encode(e)
+}
+
+// startSession records the command and returns the recording of a new session.
+func (r *Recorder) startSession(cmd string) *sessionRecording {
+	r.mu.Lock()
+	r.sessions++
+	session := r.sessions
+	r.mu.Unlock()
+
+	r.write(&TranscriptEntry{Session: session, Kind: TranscriptCommand, Line: cmd})
+	return &sessionRecording{recorder: r, session: session}
+}
+
+type sessionRecording struct {
+	recorder *Recorder
+	session  int
+}
+
+// wrap returns the streams of the remote command which record the data
+// passing through them.
+func (s *sessionRecording) wrap(remIn io.WriteCloser, remOut io.Reader) (io.WriteCloser, io.Reader) {
+	in := &recordingWriter{WriteCloser: remIn, stream: s.newStream(TranscriptOut)}
+	out := &recordingReader{Reader: remOut, stream: s.newStream(TranscriptIn)}
+	return in, out
+}
+
+func (s *sessionRecording) newStream(dir string) *transcriptStream {
+	return &transcriptStream{recording: s, dir: dir}
+}
+
+// exit records the exit status from the error of Session.Wait.
+func (s *sessionRecording) exit(err error) {
+	if s == nil {
+		return
+	}
+	status, ok := exitStatus(err)
+	if err != nil && !ok {
+		return
+	}
+	s.recorder.write(&TranscriptEntry{Session: s.session, Kind: TranscriptExit, Status: status})
+}
+
+type recordingWriter struct {
+	io.WriteCloser
+	stream *transcriptStream
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.stream.feed(p[:n])
+	return n, err
+}
+
+type recordingReader struct {
+	io.Reader
+	stream *transcriptStream
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.stream.feed(p[:n])
+	return n, err
+}
+
+// transcriptStream splits the data in a direction into messages.
+type transcriptStream struct {
+	recording *sessionRecording
+	dir       string
+
+	mu sync.Mutex
+	// line is the incomplete line.
+	line []byte
+	// bodySize and bodyLeft are the size and the remaining bytes of the body in progress.
+	bodySize int64
+	bodyLeft int64
+	bodyHash hash.Hash
+	body     []byte
+}
+
+func (t *transcriptStream) feed(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(p) > 0 {
+		if t.bodyLeft > 0 {
+			n := int64(len(p))
+			if n > t.bodyLeft {
+				n = t.bodyLeft
+			}
+			t.bodyHash.Write(p[:n])
+			if t.recording.recorder.recordsBodies {
+				t.body = append(t.body, p[:n]...)
+			}
+			t.bodyLeft -= n
+			p = p[n:]
+			if t.bodyLeft == 0 {
+				t.write(&TranscriptEntry{
+					Kind:   TranscriptBody,
+					Size:   t.bodySize,
+					SHA256: hex.EncodeToString(t.bodyHash.Sum(nil)),
+					Data:   t.body,
+				})
+				t.body = nil
+			}
+			continue
+		}
+
+		if len(t.line) == 0 && p[0] == replyOK {
+			t.write(&TranscriptEntry{Kind: TranscriptOK})
+			p = p[1:]
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			t.line = append(t.line, p...)
+			return
+		}
+		t.line = append(t.line, p[:i]...)
+		p = p[i+1:]
+		t.writeLine(string(t.line))
+		t.line = t.line[:0]
+	}
+}
+
+func (t *transcriptStream) writeLine(line string) {
+	if line == "" {
+		t.write(&TranscriptEntry{Kind: TranscriptRaw, Data: []byte("\n")})
+		return
+	}
+	switch line[0] {
+	case msgCopyFile, msgStartDirectory, msgEndDirectory, msgTime:
+		t.write(&TranscriptEntry{Kind: TranscriptHeader, Line: line})
+		if line[0] != msgCopyFile {
+			return
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 3 {
+			return
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size <= 0 {
+			return
+		}
+		t.bodySize = size
+		t.bodyLeft = size
+		t.bodyHash = sha256.New()
+	case replyError:
+		t.write(&TranscriptEntry{Kind: TranscriptError, Line: line[1:]})
+	case replyFatalError:
+		t.write(&TranscriptEntry{Kind: TranscriptFatal, Line: line[1:]})
+	default:
+		t.write(&TranscriptEntry{Kind: TranscriptRaw, Data: []byte(line + "\n")})
+	}
+}
+
+func (t *transcriptStream) write(e *TranscriptEntry) {
+	e.Session = t.recording.session
+	e.Dir = t.dir
+	t.recording.recorder.write(e)
+}
+
+// Replayer acts as the remote scp command of the sessions in a transcript
+// written by Recorder. It can be used in tests to reproduce the behavior
+// of an scp implementation with NewSCPWithTransport(replayer.Transport()).
+//
+// File bodies sent from the remote are replayed only if they are recorded
+// in full. Otherwise zero bytes of the same size are sent.
+type Replayer struct {
+	mu       sync.Mutex
+	sessions [][]TranscriptEntry
+}
+
+// NewReplayer reads a transcript from r and creates a Replayer.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	var sessions [][]TranscriptEntry
+	index := make(map[int]int)
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var e TranscriptEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read transcript: %w", err)
+		}
+		i, ok := index[e.Session]
+		if !ok {
+			i = len(sessions)
+			index[e.Session] = i
+			sessions = append(sessions, nil)
+		}
+		sessions[i] = append(sessions[i], e)
+	}
+	return &Replayer{sessions: sessions}, nil
+}
+
+// Serve replays the next session in the transcript. It reads the data
+// sent by the local from stdin, checks it matches the transcript,
+// and writes the data sent by the remote to stdout.
+// cmd is the command requested by the local and it must match the recorded one.
+// It returns the recorded exit status of the remote command.
+func (p *Replayer) Serve(cmd string, stdin io.Reader, stdout io.Writer) (exitStatus int, err error) {
+	p.mu.Lock()
+	if len(p.sessions) == 0 {
+		p.mu.Unlock()
+		return 0, errors.New("no more sessions in transcript")
+	}
+	entries := p.sessions[0]
+	p.sessions = p.sessions[1:]
+	p.mu.Unlock()
+
+	for i, e := range entries {
+		switch {
+		case e.Kind == TranscriptCommand:
+			if cmd != e.Line {
+				return 0, fmt.Errorf("command unmatch in session %d: got=%q, want=%q", e.Session, cmd, e.Line)
+			}
+		case e.Kind == TranscriptExit:
+			exitStatus = e.Status
+		case e.Dir == TranscriptOut:
+			err = expectEntry(stdin, &e)
+			if err != nil {
+				return 0, fmt.Errorf("unexpected data for entry %d in session %d: %w", i, e.Session, err)
+			}
+		case e.Dir == TranscriptIn:
+			_, err = stdout.Write(entryBytes(&e))
+			if err != nil {
+				return 0, fmt.Errorf("failed to write entry %d in session %d: %w", i, e.Session, err)
+			}
+		}
+	}
+	return exitStatus, nil
+}
+
+// Transport returns a Transport whose sessions are served by Serve, so
+// that an SCP created with NewSCPWithTransport transfers files with the
+// replayed remote instead of an ssh server. An error of Serve is returned
+// from the reads of the standard output and from Wait.
+func (p *Replayer) Transport() Transport {
+	return replayTransport{replayer: p}
+}
+
+type replayTransport struct {
+	replayer *Replayer
+}
+
+func (t replayTransport) NewSession() (Session, error) {
+	stdinR, stdinW := io.Pipe()
+	return &replaySession{
+		replayer: t.replayer,
+		stdinR:   stdinR,
+		stdinW:   stdinW,
+		stdout:   newReplayPipe(),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+type replaySession struct {
+	replayer *Replayer
+	stdinR   *io.PipeReader
+	stdinW   *io.PipeWriter
+	// stdout is buffered since the transcript records the data from the
+	// remote when it is read ahead by the local, which may be before the
+	// local sends the preceding data.
+	stdout *replayPipe
+	done   chan struct{}
+	// status and err are the result of Serve which are set before done
+	// is closed.
+	status int
+	err    error
+}
+
+func (s *replaySession) StdinPipe() (io.WriteCloser, error) {
+	return s.stdinW, nil
+}
+
+func (s *replaySession) StdoutPipe() (io.Reader, error) {
+	return s.stdout, nil
+}
+
+func (s *replaySession) StderrPipe() (io.Reader, error) {
+	return bytes.NewReader(nil), nil
+}
+
+func (s *replaySession) Start(cmd string) error {
+	go func() {
+		s.status, s.err = s.replayer.Serve(cmd, s.stdinR, s.stdout)
+		if s.err != nil {
+			s.stdout.closeWithError(s.err)
+		} else {
+			s.stdout.closeWithError(io.EOF)
+		}
+		close(s.done)
+		// The data sent after the remote exits is discarded like an ssh
+		// channel does.
+		io.Copy(ioutil.Discard, s.stdinR)
+	}()
+	return nil
+}
+
+func (s *replaySession) Wait() error {
+	<-s.done
+	if s.err != nil {
+		return s.err
+	}
+	if s.status != 0 {
+		return &replayExitError{status: s.status}
+	}
+	return nil
+}
+
+func (s *replaySession) Close() error {
+	s.stdinR.CloseWithError(io.ErrClosedPipe)
+	s.stdout.closeWithError(io.ErrClosedPipe)
+	return nil
+}
+
+// replayPipe is a pipe whose writes do not wait for reads.
+type replayPipe struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// err is returned by Read after buf is drained. It is set when the
+	// pipe is closed.
+	err error
+}
+
+func newReplayPipe() *replayPipe {
+	p := &replayPipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *replayPipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.buf.Len() == 0 && p.err == nil {
+		p.cond.Wait()
+	}
+	if p.buf.Len() > 0 {
+		return p.buf.Read(b)
+	}
+	return 0, p.err
+}
+
+func (p *replayPipe) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return 0, io.ErrClosedPipe
+	}
+	p.cond.Broadcast()
+	return p.buf.Write(b)
+}
+
+func (p *replayPipe) closeWithError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+}
+
+// replayExitError is the error returned by Wait of a replayed session when
+// the recorded exit status is not zero.
+type replayExitError struct {
+	status int
+}
+
+func (e *replayExitError) Error() string {
+	return fmt.Sprintf("replayed command exited with status %d", e.status)
+}
+
+// ExitStatus returns the recorded exit status.
+func (e *replayExitError) ExitStatus() int {
+	return e.status
+}
+
+// entryBytes returns the bytes on the wire for e.
+func entryBytes(e *TranscriptEntry) []byte {
+	switch e.Kind {
+	case TranscriptHeader:
+		return []byte(e.Line + "\n")
+	case TranscriptOK:
+		return []byte{replyOK}
+	case TranscriptError:
+		return []byte(string(rune(replyError)) + e.Line + "\n")
+	case TranscriptFatal:
+		return []byte(string(rune(replyFatalError)) + e.Line + "\n")
+	case TranscriptBody:
+		if e.Data != nil {
+			return e.Data
+		}
+		return make([]byte, e.Size)
+	default:
+		return e.Data
+	}
+}
+
+// expectEntry reads the bytes for e from r and checks they match.
+func expectEntry(r io.Reader, e *TranscriptEntry) error {
+	var want []byte
+	if e.Kind == TranscriptBody {
+		want = make([]byte, e.Size)
+	} else {
+		want = entryBytes(e)
+	}
+	got := make([]byte, len(want))
+	_, err := io.ReadFull(r, got)
+	if err != nil {
+		return err
+	}
+	if e.Kind == TranscriptBody {
+		sum := sha256.Sum256(got)
+		if hex.EncodeToString(sum[:]) != e.SHA256 {
+			return fmt.Errorf("file body digest unmatch; size=%d", e.Size)
+		}
+		return nil
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("got=%q, want=%q", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestRecorderAndReplayer(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestRecorderAndReplayer-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestRecorderAndReplayer-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localPath := filepath.Join(localDir, "file1")
+	err = ioutil.WriteFile(localPath, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
+	remotePath := filepath.Join(remoteDir, "file1")
+	// The access time is set before each send since it is updated by reading the file.
+	fileTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	setFileTime := func(t *testing.T) {
+		err := os.Chtimes(localPath, fileTime, fileTime)
+		if err != nil {
+			t.Fatalf("fail to change file times; %s", err)
+		}
+	}
+
+	var transcript bytes.Buffer
+	recorder := scp.NewRecorder(&transcript, true)
+	sc := scp.NewSCP(c)
+	sc.Recorder = recorder
+	setFileTime(t)
+	err = sc.SendFile(localPath, remotePath)
+	if err != nil {
+		t.Fatalf("fail to send file; %s", err)
+	}
+	err = sc.ReceiveFile(remotePath, filepath.Join(localDir, "received"))
+	if err != nil {
+		t.Fatalf("fail to receive file; %s", err)
+	}
+	err = sc.ReceiveFile(filepath.Join(remoteDir, "no-such-file"), filepath.Join(localDir, "missing"))
+	if err == nil {
+		t.Fatal("unexpected success of receiving a nonexistent file")
+	}
+	if err := recorder.Err(); err != nil {
+		t.Fatalf("fail to record; %s", err)
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		replayer, err := scp.NewReplayer(bytes.NewReader(transcript.Bytes()))
+		if err != nil {
+			t.Fatalf("fail to create replayer; %s", err)
+		}
+		err = os.Remove(filepath.Join(localDir, "received"))
+		if err != nil {
+			t.Fatalf("fail to remove file; %s", err)
+		}
+
+		sc := scp.NewSCPWithTransport(replayer.Transport())
+		setFileTime(t)
+		err = sc.SendFile(localPath, remotePath)
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		err = sc.ReceiveFile(remotePath, filepath.Join(localDir, "received"))
+		if err != nil {
+			t.Fatalf("fail to receive file; %s", err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(localDir, "received"))
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		if string(got) != "hello" {
+			t.Errorf("content unmatch; got=%q, want=%q", got, "hello")
+		}
+		err = sc.ReceiveFile(filepath.Join(remoteDir, "no-such-file"), filepath.Join(localDir, "missing"))
+		if err == nil {
+			t.Error("unexpected success of receiving a nonexistent file")
+		}
+	})
+
+	t.Run("Replay mismatch", func(t *testing.T) {
+		replayer, err := scp.NewReplayer(bytes.NewReader(transcript.Bytes()))
+		if err != nil {
+			t.Fatalf("fail to create replayer; %s", err)
+		}
+
+		// The file has the same name, size and times but different content.
+		otherPath := filepath.Join(localDir, "other", "file1")
+		err = os.Mkdir(filepath.Dir(otherPath), 0755)
+		if err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		err = ioutil.WriteFile(otherPath, []byte("world"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		err = os.Chtimes(otherPath, fileTime, fileTime)
+		if err != nil {
+			t.Fatalf("fail to change file times; %s", err)
+		}
+
+		sc := scp.NewSCPWithTransport(replayer.Transport())
+		err = sc.SendFile(otherPath, remotePath)
+		if err == nil || !strings.Contains(err.Error(), "file body digest unmatch") {
+			t.Errorf("replay error is not reported; %v", err)
+		}
+	})
+}
@@ -0,0 +1,265 @@
+package scp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listFormat is the format for the find command on the remote.
+// Each entry is type, permission in octal, size, modification time,
+// access time and the path relative to the starting point, terminated with NUL.
+const listFormat = `%y %m %s %T@ %A@ %P\0`
+
+// maxArgsLength is the maximum length of arguments passed to a single
+// remote command. It is well below ARG_MAX of common systems.
+const maxArgsLength = 32 * 1024
+
+// commandPrefix returns the words before scp in the SCPCommand like "sudo ".
+// It is used to run other commands on the remote with the same privilege.
+func (s *SCP) commandPrefix() string {
+	words := strings.Fields(s.SCPCommand)
+	for i, word := range words {
+		if path.Base(word) == "scp" {
+			if i == 0 {
+				return ""
+			}
+			return strings.Join(words[:i], " ") + " "
+		}
+	}
+	return ""
+}
+
+// shellCommand returns a command to run script with the commandPrefix.
+func (s *SCP) shellCommand(script string) string {
+	prefix := s.commandPrefix()
+	if prefix == "" {
+		return script
+	}
+	return prefix + "sh -c " + escapeShellArg(script)
+}
+
+func runRemoteCommand(t Transport, cmd string) ([]byte, error) {
+	session, err := t.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	// NOTE: We keep stdin open until the command exits since some servers
+	// stop forwarding the output as soon as stdin is closed.
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stdin.Close()
+
+	stdoutPipe, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrPipe, err := session.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = session.Start(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run remote command: %w", err)
+	}
+
+	var stderr bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&stderr, stderrPipe)
+		close(done)
+	}()
+	stdout, readErr := ioutil.ReadAll(stdoutPipe)
+	<-done
+	err = session.Wait()
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return nil, fmt.Errorf("failed to run remote command: %w", err)
+		}
+		return nil, fmt.Errorf("failed to run remote command: %w: %s", err, msg)
+	}
+	return stdout, nil
+}
+
+// listRemote returns the information of the remote root and entries under it
+// keyed by slash separated relative paths. The root is keyed by "".
+// If recursive is false, only the root is listed.
+// The returned map is empty if the root does not exist.
+// The remote must have the find command with the -printf action like GNU findutils.
+func (s *SCP) listRemote(root string, recursive bool) (map[string]*FileInfo, error) {
+	maxDepth := -1
+	if !recursive {
+		maxDepth = 0
+	}
+	return s.findRemote(root, false, maxDepth)
+}
+
+// findRemote is like listRemote, but lists entries up to maxDepth levels
+// below the root. If maxDepth is negative, the depth is not limited.
+// If follow is true and the root is a symbolic link, the link is followed.
+func (s *SCP) findRemote(root string, follow bool, maxDepth int) (map[string]*FileInfo, error) {
+	find := "find "
+	if follow {
+		find += "-H "
+	}
+	find += escapeShellArg(root)
+	if maxDepth >= 0 {
+		find += " -maxdepth " + strconv.Itoa(maxDepth)
+	}
+	find += " -printf " + escapeShellArg(listFormat)
+	script := "if [ -e " + escapeShellArg(root) + " ] || [ -L " + escapeShellArg(root) + " ]; then " + find + "; fi"
+
+	out, err := runRemoteCommand(s.commandTransport(), s.shellCommand(script))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote %s: %w", root, err)
+	}
+	return parseRemoteList(root, out)
+}
+
+// statRemote returns the information of the remote file or nil if it does not exist.
+func (s *SCP) statRemote(name string) (*FileInfo, error) {
+	infos, err := s.listRemote(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return infos[""], nil
+}
+
+// removeRemote removes the remote files and directories recursively.
+func (s *SCP) removeRemote(paths []string) error {
+	for _, args := range quotedArgBatches(paths) {
+		_, err := runRemoteCommand(s.commandTransport(), s.commandPrefix()+"rm -rf -- "+args)
+		if err != nil {
+			return fmt.Errorf("failed to remove remote files: %w", err)
+		}
+	}
+	return nil
+}
+
+// quotedArgBatches escapes args and joins them into batches
+// which are not longer than maxArgsLength if possible.
+func quotedArgBatches(args []string) []string {
+	return quotedArgGroupBatches(args, 1)
+}
+
+// quotedArgGroupBatches is like quotedArgBatches, but each group of size
+// args is kept in the same batch.
+func quotedArgGroupBatches(args []string, size int) []string {
+	var batches []string
+	var b strings.Builder
+	for i := 0; i < len(args); i += size {
+		var group strings.Builder
+		for j := i; j < i+size && j < len(args); j++ {
+			if group.Len() > 0 {
+				group.WriteByte(' ')
+			}
+			group.WriteString(escapeShellArg(args[j]))
+		}
+		if b.Len() > 0 && b.Len()+1+group.Len() > maxArgsLength {
+			batches = append(batches, b.String())
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(group.String())
+	}
+	if b.Len() > 0 {
+		batches = append(batches, b.String())
+	}
+	return batches
+}
+
+func parseRemoteList(root string, out []byte) (map[string]*FileInfo, error) {
+	infos := make(map[string]*FileInfo)
+	for _, rec := range strings.Split(string(out), "\x00") {
+		if rec == "" {
+			continue
+		}
+		fields := strings.SplitN(rec, " ", 6)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("unexpected remote list entry: %q", rec)
+		}
+		perm, err := strconv.ParseUint(fields[1], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode in remote list entry: %q", rec)
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in remote list entry: %q", rec)
+		}
+		mtime, err := parseFindTime(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid modification time in remote list entry: %q", rec)
+		}
+		atime, err := parseFindTime(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid access time in remote list entry: %q", rec)
+		}
+
+		mode := os.FileMode(perm) & os.ModePerm
+		switch fields[0] {
+		case "d":
+			mode |= os.ModeDir
+		case "l":
+			mode |= os.ModeSymlink
+		case "f":
+		default:
+			mode |= os.ModeIrregular
+		}
+
+		rel := fields[5]
+		name := path.Base(rel)
+		if rel == "" {
+			name = path.Base(root)
+		}
+		infos[rel] = &FileInfo{
+			name:       name,
+			size:       size,
+			mode:       mode,
+			modTime:    mtime,
+			accessTime: atime,
+		}
+	}
+	return infos, nil
+}
+
+// parseFindTime parses a time printed with %T@ or %A@ of find like
+// "1600000000.1234567890".
+func parseFindTime(s string) (time.Time, error) {
+	secStr, fracStr := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		secStr, fracStr = s[:i], s[i+1:]
+	}
+	sec, err := strconv.ParseInt(secStr, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec int64
+	if fracStr != "" {
+		if len(fracStr) > 9 {
+			fracStr = fracStr[:9]
+		} else {
+			fracStr += strings.Repeat("0", 9-len(fracStr))
+		}
+		nsec, err = strconv.ParseInt(fracStr, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(sec, nsec), nil
+}
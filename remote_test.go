@@ -0,0 +1,25 @@
+package scp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQuotedArgGroupBatches(t *testing.T) {
+	long := strings.Repeat("a", maxArgsLength-20)
+	args := []string{"target1", "link1", long, "link2", "target3", "link3"}
+	batches := quotedArgGroupBatches(args, 2)
+	want := []string{
+		"'target1' 'link1'",
+		"'" + long + "' 'link2'",
+		"'target3' 'link3'",
+	}
+	if len(batches) != len(want) {
+		t.Fatalf("batch count unmatch; got=%d, want=%d", len(batches), len(want))
+	}
+	for i := range want {
+		if batches[i] != want[i] {
+			t.Errorf("batch %d unmatch; got=%.40q, want=%.40q", i, batches[i], want[i])
+		}
+	}
+}
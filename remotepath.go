@@ -0,0 +1,47 @@
+package scp
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// isWindowsShell returns whether the remote is a Windows OpenSSH server.
+func isWindowsShell(shell ShellType) bool {
+	return shell == ShellCmd || shell == ShellPowerShell
+}
+
+// cleanRemotePath cleans the remote path p and converts it to a slash
+// separated path. For Windows shells, backslashes are converted to slashes
+// too, and a path with a drive letter like C:\data is converted to /C:/data,
+// which Windows OpenSSH accepts.
+func cleanRemotePath(shell ShellType, p string) string {
+	if !isWindowsShell(shell) {
+		return realPath(filepath.Clean(p))
+	}
+	p = strings.Replace(p, `\`, "/", -1)
+	if hasDriveLetter(p) {
+		p = "/" + p
+	}
+	p = path.Clean(p)
+	if len(p) == len("/C:") && hasDriveLetter(p[1:]) {
+		// The root directory of the drive.
+		p += "/"
+	}
+	return p
+}
+
+// hasDriveLetter returns whether p starts with a drive letter like C:.
+func hasDriveLetter(p string) bool {
+	if len(p) < 2 || p[1] != ':' {
+		return false
+	}
+	c := p[0]
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// remoteDir returns the directory of the remote path p cleaned with
+// cleanRemotePath.
+func remoteDir(shell ShellType, p string) string {
+	return cleanRemotePath(shell, path.Dir(cleanRemotePath(shell, p)))
+}
@@ -0,0 +1,43 @@
+package scp
+
+import "testing"
+
+func TestCleanRemotePath(t *testing.T) {
+	testCases := []struct {
+		shell ShellType
+		path  string
+		want  string
+	}{
+		{ShellPOSIX, "/home/user1/../user2/file1", "/home/user2/file1"},
+		{ShellUnknown, "dir1/./file1", "dir1/file1"},
+		{ShellCmd, `C:\data\file1`, "/C:/data/file1"},
+		{ShellCmd, `C:\data\..\file1`, "/C:/file1"},
+		{ShellCmd, `C:\`, "/C:/"},
+		{ShellCmd, "C:", "/C:/"},
+		{ShellPowerShell, "/C:/data/", "/C:/data"},
+		{ShellPowerShell, `data\file1`, "data/file1"},
+	}
+	for _, tc := range testCases {
+		if got := cleanRemotePath(tc.shell, tc.path); got != tc.want {
+			t.Errorf("cleanRemotePath(%s, %q) = %q, want %q", tc.shell, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestQuoteRemoteArg(t *testing.T) {
+	testCases := []struct {
+		shell ShellType
+		arg   string
+		want  string
+	}{
+		{ShellPOSIX, "/data dir/it's", `'/data dir/it'\''s'`},
+		{ShellCmd, "/C:/a&b ^c", `"/C:/a&b ^c"`},
+		{ShellPowerShell, "/C:/it's $HOME", `'/C:/it''s $HOME'`},
+		{ShellPowerShell, "/C:/it\u2019s", "'/C:/it\u2019\u2019s'"},
+	}
+	for _, tc := range testCases {
+		if got := quoteRemoteArg(tc.shell, tc.arg); got != tc.want {
+			t.Errorf("quoteRemoteArg(%s, %q) = %q, want %q", tc.shell, tc.arg, got, tc.want)
+		}
+	}
+}
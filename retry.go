@@ -0,0 +1,144 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RetryPolicy is the policy to retry transfers which fail with transient errors.
+//
+// SendFile, ReceiveFile, SendDir, ReceiveDir and SyncDir are retried.
+// Send is retried only if the reader implements io.Seeker, and it is
+// rewound before each attempt. Receive, SendOpen and ReceiveOpen are not
+// retried since the data cannot be transferred again.
+// Only the scp session is retried. Commands run before it, like listing
+// remote files for an overwrite policy, are not.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts including the first one.
+	// If it is one or less, transfers are not retried.
+	MaxAttempts int
+	// Backoff returns the delay before the retry-th retry, where retry
+	// starts from 1. If it is nil, ExponentialBackoff(100*time.Millisecond, 10*time.Second)
+	// is used.
+	Backoff func(retry int) time.Duration
+	// Retryable reports whether err is retryable. If it is nil, IsRetryable is used.
+	Retryable func(err error) bool
+}
+
+// WithRetry sets the retry policy of a single transfer.
+func WithRetry(policy RetryPolicy) Option {
+	return func(o *transferOptions) {
+		o.retryPolicy = policy
+	}
+}
+
+// ExponentialBackoff returns a backoff function which returns initial for
+// the first retry and doubles it for each retry up to max.
+func ExponentialBackoff(initial, max time.Duration) func(retry int) time.Duration {
+	return func(retry int) time.Duration {
+		d := initial
+		for i := 1; i < retry && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+var defaultBackoff = ExponentialBackoff(100*time.Millisecond, 10*time.Second)
+
+// IsRetryable reports whether err is a transient error which is worth retrying.
+// Failures to open a session, connection resets and lost connections are
+// retryable. Errors reported by the remote scp, like permission errors,
+// and other protocol errors are not.
+func IsRetryable(err error) bool {
+	var protoErr *protocolError
+	if errors.As(err, &protoErr) {
+		return false
+	}
+	var openErr *ssh.OpenChannelError
+	var exitMissingErr *ssh.ExitMissingError
+	if errors.As(err, &openErr) || errors.As(err, &exitMissingErr) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retry calls fn until it succeeds or the retry policy gives up.
+// Entries added to the plan of a dry run by a failed attempt are discarded.
+func (o *transferOptions) retry(fn func() error) error {
+	p := o.retryPolicy
+	backoff := p.Backoff
+	if backoff == nil {
+		backoff = defaultBackoff
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	var planLen int
+	if o.plan != nil {
+		planLen = len(*o.plan)
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+		if o.plan != nil {
+			*o.plan = (*o.plan)[:planLen]
+		}
+		time.Sleep(backoff(attempt))
+	}
+}
+
+// rewindBody is the body of a retried Send. It is rewound to the offset
+// where it started before each attempt and closed by Send instead of
+// WriteFile.
+type rewindBody struct {
+	r     io.ReadSeeker
+	start int64
+}
+
+// newRewindBody returns the body which is rewound to the current offset
+// of r.
+func newRewindBody(r io.ReadSeeker) (rewindBody, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return rewindBody{}, fmt.Errorf("failed to get offset of source: %w", err)
+	}
+	return rewindBody{r: r, start: start}, nil
+}
+
+func (b rewindBody) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+func (b rewindBody) Close() error { return nil }
+
+func (b rewindBody) rewind() error {
+	_, err := b.r.Seek(b.start, io.SeekStart)
+	return err
+}
+
+// Stat lets WriteFile check whether the file changed size. It is not
+// supported if the body does not start at the beginning of the file.
+func (b rewindBody) Stat() (os.FileInfo, error) {
+	if st, ok := b.r.(interface{ Stat() (os.FileInfo, error) }); ok && b.start == 0 {
+		return st.Stat()
+	}
+	return nil, errors.New("stat is not supported")
+}
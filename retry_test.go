@@ -0,0 +1,228 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestRetry(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	setup := func(t *testing.T) (localDir, remoteDir string, sc *scp.SCP) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestRetry-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		remoteDir, err = ioutil.TempDir("", "go-scp-TestRetry-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		// The scp command fails at the first run.
+		marker := filepath.Join(localDir, "marker")
+		sc = scp.NewSCP(c)
+		sc.SCPCommand = "sh -c 'if [ -e " + marker + " ]; then exec scp \"$@\"; fi; touch " + marker + "; exit 1' scp"
+		return localDir, remoteDir, sc
+	}
+
+	noBackoff := func(int) time.Duration { return 0 }
+
+	t.Run("SendFile retried", func(t *testing.T) {
+		localDir, remoteDir, sc := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		localPath := filepath.Join(localDir, "file1")
+		err := ioutil.WriteFile(localPath, []byte("hello"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		remotePath := filepath.Join(remoteDir, "file1")
+		err = sc.SendFile(localPath, remotePath, scp.WithRetry(scp.RetryPolicy{MaxAttempts: 2, Backoff: noBackoff}))
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		got, err := ioutil.ReadFile(remotePath)
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		if string(got) != "hello" {
+			t.Errorf("content unmatch; got=%q, want=%q", got, "hello")
+		}
+	})
+
+	t.Run("Send with seeker retried", func(t *testing.T) {
+		localDir, remoteDir, sc := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		sc.Retry = scp.RetryPolicy{MaxAttempts: 2, Backoff: noBackoff}
+		info := scp.NewFileInfo("file1", 5, 0644, time.Now(), time.Now())
+		remotePath := filepath.Join(remoteDir, "file1")
+		err := sc.Send(info, ioutil.NopCloser(bytes.NewReader([]byte("hello"))), remotePath)
+		if err == nil {
+			t.Fatal("unexpected success of Send with a reader which is not seekable")
+		}
+
+		r := &seekReadCloser{Reader: bytes.NewReader([]byte("hello"))}
+		err = sc.Send(info, r, remotePath)
+		if err != nil {
+			t.Fatalf("fail to send; %s", err)
+		}
+		if !r.closed {
+			t.Error("reader is not closed")
+		}
+		got, err := ioutil.ReadFile(remotePath)
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		if string(got) != "hello" {
+			t.Errorf("content unmatch; got=%q, want=%q", got, "hello")
+		}
+	})
+
+	t.Run("Send with advanced reader retried", func(t *testing.T) {
+		localDir, remoteDir, sc := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		// The body starts after the header of the local file.
+		localPath := filepath.Join(localDir, "file1")
+		err := ioutil.WriteFile(localPath, []byte("HEADERhello"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		file, err := os.Open(localPath)
+		if err != nil {
+			t.Fatalf("fail to open file; %s", err)
+		}
+		_, err = file.Seek(int64(len("HEADER")), io.SeekStart)
+		if err != nil {
+			t.Fatalf("fail to seek file; %s", err)
+		}
+
+		sc.Retry = scp.RetryPolicy{MaxAttempts: 2, Backoff: noBackoff}
+		info := scp.NewFileInfo("file1", 5, 0644, time.Now(), time.Now())
+		remotePath := filepath.Join(remoteDir, "file1")
+		err = sc.Send(info, file, remotePath)
+		if err != nil {
+			t.Fatalf("fail to send; %s", err)
+		}
+		got, err := ioutil.ReadFile(remotePath)
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		if string(got) != "hello" {
+			t.Errorf("content unmatch; got=%q, want=%q", got, "hello")
+		}
+	})
+
+	t.Run("ReceiveFile retried", func(t *testing.T) {
+		localDir, remoteDir, sc := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		remotePath := filepath.Join(remoteDir, "file1")
+		err := ioutil.WriteFile(remotePath, []byte("hello"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		// The remote scp exits with an error without reporting it, which is
+		// not retryable by default.
+		policy := scp.RetryPolicy{
+			MaxAttempts: 2,
+			Backoff:     noBackoff,
+			Retryable:   func(error) bool { return true },
+		}
+		localPath := filepath.Join(localDir, "file1")
+		err = sc.ReceiveFile(remotePath, localPath, scp.WithRetry(policy))
+		if err != nil {
+			t.Fatalf("fail to receive file; %s", err)
+		}
+		got, err := ioutil.ReadFile(localPath)
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		if string(got) != "hello" {
+			t.Errorf("content unmatch; got=%q, want=%q", got, "hello")
+		}
+	})
+
+	t.Run("Remote error not retried", func(t *testing.T) {
+		localDir, remoteDir, _ := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		localPath := filepath.Join(localDir, "file1")
+		err := ioutil.WriteFile(localPath, []byte("hello"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		attempts := 0
+		policy := scp.RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     noBackoff,
+			Retryable: func(err error) bool {
+				attempts++
+				return scp.IsRetryable(err)
+			},
+		}
+		sc := scp.NewSCP(c)
+		err = sc.SendFile(localPath, filepath.Join(remoteDir, "no-such-dir", "file1"), scp.WithRetry(policy))
+		if err == nil {
+			t.Fatal("unexpected success of sending to a nonexistent directory")
+		}
+		if attempts != 1 {
+			t.Errorf("unexpected retry; attempts=%d, want=1", attempts)
+		}
+	})
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := scp.ExponentialBackoff(100*time.Millisecond, time.Second)
+	testCases := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{retry: 1, want: 100 * time.Millisecond},
+		{retry: 2, want: 200 * time.Millisecond},
+		{retry: 4, want: 800 * time.Millisecond},
+		{retry: 5, want: time.Second},
+		{retry: 100, want: time.Second},
+	}
+	for _, tc := range testCases {
+		if got := backoff(tc.retry); got != tc.want {
+			t.Errorf("backoff unmatch for retry=%d; got=%s, want=%s", tc.retry, got, tc.want)
+		}
+	}
+}
+
+type seekReadCloser struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (r *seekReadCloser) Close() error {
+	r.closed = true
+	return nil
+}
@@ -1,13 +1,65 @@
 package scp
 
-import "golang.org/x/crypto/ssh"
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
 
 // SCP is the type for the SCP client.
 type SCP struct {
-	client *ssh.Client
+	transport Transport
 	// Alternate scp command. If not set, scp is used. This can be used
-	// to call scp via sudo by setting it to "sudo scp"
+	// to call scp via sudo by setting it to "sudo scp" if sudo does not ask
+	// for a password. Use Privilege instead for sudo with a password.
 	SCPCommand string
+	// Privilege runs the scp command and the other remote commands as
+	// another user with sudo, doas or su. SCPCommand should not have
+	// a command prefix like sudo when it is set. Transfers do not fall back
+	// to SFTP, which runs as the login user, when it is set.
+	Privilege *Privilege
+	// Overwrite is the default policy for existing destination files.
+	// It can be overridden per call with WithOverwrite.
+	Overwrite OverwritePolicy
+	// RateLimit limits the bandwidth of file bodies in bytes per second.
+	// The limit is shared by all transfers of this SCP including concurrent ones.
+	// If it is zero or negative, the bandwidth is not limited.
+	RateLimit int64
+	// Retry is the default policy to retry transfers which fail with
+	// transient errors. It can be overridden per call with WithRetry.
+	// By default, transfers are not retried.
+	Retry RetryPolicy
+	// Logger logs the scp protocol traffic if it is not nil.
+	Logger Logger
+	// Recorder records the scp protocol exchange if it is not nil.
+	Recorder *Recorder
+	// Protocol is the file transfer protocol. By default, the scp protocol
+	// is used and SFTP is used instead if the remote has no scp command.
+	Protocol Protocol
+	// Shell is the shell which runs commands on the remote. The arguments
+	// of scp are quoted for it, and remote paths like C:\data are converted
+	// to /C:/data for ShellCmd and ShellPowerShell, which mean a Windows
+	// OpenSSH server. If it is ShellUnknown, the shell detected with
+	// AutoDetect is used, or commands are built for a POSIX shell.
+	// Methods other than transfers like Stat and SyncDir, and overwrite
+	// policies other than OverwriteAlways need a POSIX shell.
+	Shell ShellType
+	// AutoDetect makes SCP probe the remote with Capabilities before the
+	// first transfer. The result is used to choose the protocol and to quote
+	// the arguments of scp for the remote shell, and a missing scp command
+	// or sudo asking for a password is reported before starting the transfer.
+	AutoDetect bool
+
+	mu      sync.Mutex
+	limiter *rateLimiter
+	// sftpFallback is true after scp is found missing with ProtocolAuto.
+	sftpFallback bool
+
+	probeMu sync.Mutex
+	caps    *Capabilities
+	// closers are the connections owned by this SCP.
+	closers []io.Closer
 }
 
 // NewSCP creates the SCP client.
@@ -15,6 +67,40 @@ type SCP struct {
 // calling NewSCP and call Close for ssh.Client after using SCP.
 func NewSCP(client *ssh.Client) *SCP {
 	return &SCP{
-		client: client,
+		transport: sshTransport{client: client},
+	}
+}
+
+// sharedRateLimiter returns the limiter for RateLimit or nil if it is not set.
+func (s *SCP) sharedRateLimiter() *rateLimiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.RateLimit <= 0 {
+		return nil
+	}
+	if s.limiter == nil {
+		s.limiter = newRateLimiter(s.RateLimit)
+	} else {
+		s.limiter.setRate(s.RateLimit)
+	}
+	return s.limiter
+}
+
+// Close closes the connections owned by the SCP, which are opened by
+// DialConfig or SSHConfig.Dial. It does nothing for an SCP created by
+// NewSCP or NewSCPWithTransport, whose connections are closed by the caller.
+func (s *SCP) Close() error {
+	s.mu.Lock()
+	closers := s.closers
+	s.closers = nil
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, c := range closers {
+		err := c.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
+	return firstErr
 }
@@ -0,0 +1,730 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Protocol is the type for the file transfer protocol used by SCP.
+type Protocol int
+
+const (
+	// ProtocolAuto uses the scp protocol, and falls back to SFTP for this and
+	// later transfers if the scp command is not found on the remote.
+	// This is the default.
+	ProtocolAuto Protocol = iota
+	// ProtocolSCP always uses the scp protocol.
+	ProtocolSCP
+	// ProtocolSFTP always uses the sftp subsystem. The transport must
+	// support subsystems like the default one for ssh.Client.
+	//
+	// Send, SendFile, SendDir, SendOpen, Receive, ReceiveFile, ReceiveDir and
+	// ReceiveOpen work in the same way as with the scp protocol, but the
+	// scp transcript is not recorded by Recorder. Other methods like SyncDir
+	// and Stat still run commands on the remote.
+	ProtocolSFTP
+)
+
+// usesSFTP returns whether transfers use SFTP.
+func (s *SCP) usesSFTP() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Protocol == ProtocolSFTP || (s.Protocol == ProtocolAuto && s.sftpFallback)
+}
+
+// fallsBackToSFTP returns whether the transfer which failed with err is
+// done again with SFTP. It is true if scp is not found with ProtocolAuto
+// and without Privilege.
+func (s *SCP) fallsBackToSFTP(o *transferOptions, err error) bool {
+	if s.Protocol != ProtocolAuto || s.Privilege != nil || !errors.Is(err, ErrSCPNotFound) {
+		return false
+	}
+	s.mu.Lock()
+	s.sftpFallback = true
+	s.mu.Unlock()
+	logDebug(o.logger, "scp not found, falling back to sftp")
+	return true
+}
+
+// sftpSession is a client of the sftp subsystem started on a session of
+// the transport.
+type sftpSession struct {
+	*sftp.Client
+	session Session
+	logger  Logger
+}
+
+func newSFTPSession(t Transport, o *transferOptions) (*sftpSession, error) {
+	session, err := t.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	ss, ok := session.(subsystemSession)
+	if !ok {
+		session.Close()
+		return nil, errors.New("sftp subsystem is not supported by the transport")
+	}
+	stdin, err := ss.StdinPipe()
+	if err != nil {
+		ss.Close()
+		return nil, err
+	}
+	stdout, err := ss.StdoutPipe()
+	if err != nil {
+		ss.Close()
+		return nil, err
+	}
+
+	logDebug(o.logger, "sftp session start")
+	err = ss.RequestSubsystem("sftp")
+	if err != nil {
+		ss.Close()
+		return nil, fmt.Errorf("failed to start sftp subsystem: %w", err)
+	}
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		ss.Close()
+		return nil, fmt.Errorf("failed to start sftp client: %w", err)
+	}
+	return &sftpSession{Client: client, session: ss, logger: o.logger}, nil
+}
+
+func (c *sftpSession) Close() error {
+	err := c.Client.Close()
+	c.session.Close()
+	logSessionEnd(c.logger, err)
+	return err
+}
+
+func runSFTPSession(t Transport, o *transferOptions, handler func(c *sftpSession) error) error {
+	return o.retry(func() error {
+		c, err := newSFTPSession(t, o)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return handler(c)
+	})
+}
+
+// newFileInfoFromSFTP creates a file information from the one returned by
+// the sftp client.
+func newFileInfoFromSFTP(fi os.FileInfo, name string) *FileInfo {
+	if name == "" {
+		name = fi.Name()
+	}
+	atime := fi.ModTime()
+	if st, ok := fi.Sys().(*sftp.FileStat); ok {
+		atime = time.Unix(int64(st.Atime), 0)
+	}
+	return NewFileInfo(name, fi.Size(), fi.Mode(), fi.ModTime(), atime)
+}
+
+// stat returns the information of the remote file or nil if it does not exist.
+func (c *sftpSession) stat(name string) (*FileInfo, error) {
+	fi, err := c.Stat(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to stat remote %s: %w", name, err)
+	}
+	return newFileInfoFromSFTP(fi, ""), nil
+}
+
+// shouldSend is SCP.shouldSend with SFTP.
+func (c *sftpSession) shouldSend(o *transferOptions, src *FileInfo, dest string) (bool, error) {
+	if o.overwrite == OverwriteAlways {
+		return true, nil
+	}
+	info, err := c.stat(dest)
+	if err != nil {
+		return false, err
+	}
+	return o.overwrite.shouldWrite(src, info, o.compareModTimes), nil
+}
+
+// exists returns whether the remote file name exists. It is needed only if
+// the permission of existing files is not set by o.
+func (c *sftpSession) exists(o *transferOptions, name string, isDir bool) (bool, error) {
+	if o.setsMode(isDir) {
+		return true, nil
+	}
+	info, err := c.stat(name)
+	return info != nil, err
+}
+
+// setMode sets the permission of the remote file or directory name for
+// the source info. created is true if name is created by the transfer.
+// Unlike the scp command, the remote umask is not applied to new files.
+func (c *sftpSession) setMode(o *transferOptions, name string, info *FileInfo, created bool) error {
+	if !o.setsMode(info.IsDir()) && !created {
+		return nil
+	}
+	err := c.Chmod(name, o.destMode(info.mode, info.IsDir())&os.ModePerm)
+	if err != nil {
+		if info.IsDir() {
+			return fmt.Errorf("failed to change remote directory mode: %w", err)
+		}
+		return fmt.Errorf("failed to change remote file mode: %w", err)
+	}
+	return nil
+}
+
+// setTimes sets the times of the remote file name if they are preserved
+// and known.
+func (c *sftpSession) setTimes(o *transferOptions, name string, info *FileInfo) error {
+	if !o.preservesTimes() || (info.modTime.IsZero() && info.accessTime.IsZero()) {
+		return nil
+	}
+	mtime, atime := info.modTime, info.accessTime
+	if mtime.IsZero() {
+		mtime = atime
+	} else if atime.IsZero() {
+		atime = mtime
+	}
+	err := c.Chtimes(name, atime, mtime)
+	if err != nil {
+		return fmt.Errorf("failed to change remote file time: %w", err)
+	}
+	return nil
+}
+
+// writeFile writes exactly info.Size() bytes of body to the remote file
+// dest like sourceProtocol.WriteFile. body is closed after copying.
+func (c *sftpSession) writeFile(o *transferOptions, info *FileInfo, body io.ReadCloser, dest string) error {
+	defer body.Close()
+	exists, err := c.exists(o, dest, false)
+	if err != nil {
+		return err
+	}
+	f, err := c.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("failed to open remote file: %w", err)
+	}
+	w := newProgressWriter(o.limiters.writer(f), o.progress, info.name, info.size)
+	changed, err := copyFileBody(w, info.size, body)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write sftp file body: %w", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close remote file: %w", err)
+	}
+	err = c.setMode(o, dest, info, !exists)
+	if err != nil {
+		return err
+	}
+	err = c.setTimes(o, dest, info)
+	if err != nil {
+		return err
+	}
+	if changed {
+		return fmt.Errorf("%s: %w", info.name, ErrFileChanged)
+	}
+	return nil
+}
+
+// readFile copies the remote file src to the local file dest and sets the
+// permission and the times of info to dest.
+func (c *sftpSession) readFile(o *transferOptions, src string, info *FileInfo, dest string) error {
+	r, err := c.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open remote file: %w", err)
+	}
+	defer r.Close()
+
+	exists, err := localExists(dest)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, o.destMode(info.mode, false))
+	if err != nil {
+		return fmt.Errorf("failed to open destination file: %w", err)
+	}
+	bw, finish := o.localBodyWriter(file)
+	w := newProgressWriter(bw, o.progress, info.name, info.size)
+	_, err = io.Copy(w, o.limiters.reader(r))
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	err = finish()
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = o.setLocalMode(dest, info.mode, false, !exists)
+	if err != nil {
+		return err
+	}
+	return o.setLocalTimes(dest, info.accessTime, info.modTime, false)
+}
+
+// listDestDir is SCP.listRemoteDestDir with SFTP.
+func (c *sftpSession) listDestDir(srcDir, destDir string) (root string, infos map[string]*FileInfo, err error) {
+	root = destDir
+	info, err := c.stat(destDir)
+	if err != nil {
+		return "", nil, err
+	}
+	if info != nil && info.IsDir() {
+		root = path.Join(destDir, filepath.Base(srcDir))
+	}
+
+	infos = make(map[string]*FileInfo)
+	walker := c.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if walker.Path() == root && os.IsNotExist(err) {
+				break
+			}
+			return "", nil, fmt.Errorf("failed to list remote %s: %w", root, err)
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), root), "/")
+		fi := walker.Stat()
+		infos[rel] = newFileInfoFromSFTP(fi, "")
+		if fi.Mode()&os.ModeSymlink != 0 {
+			infos[rel].mode |= os.ModeSymlink
+		}
+	}
+	return root, infos, nil
+}
+
+func (s *SCP) sftpSend(o *transferOptions, info *FileInfo, r io.ReadCloser, destDir string) error {
+	dest := path.Join(destDir, info.name)
+	body := io.ReadCloser(r)
+	seeker, ok := r.(io.ReadSeeker)
+	if ok && o.retryPolicy.MaxAttempts > 1 {
+		defer r.Close()
+		rb, err := newRewindBody(seeker)
+		if err != nil {
+			return err
+		}
+		body = rb
+	} else {
+		o.retryPolicy.MaxAttempts = 0
+	}
+
+	return runSFTPSession(s.transport, o, func(c *sftpSession) error {
+		write, err := c.shouldSend(o, info, dest)
+		if err != nil || !write {
+			body.Close()
+			return err
+		}
+		if b, ok := body.(rewindBody); ok {
+			if err := b.rewind(); err != nil {
+				return fmt.Errorf("failed to rewind source: %w", err)
+			}
+		}
+		err = c.writeFile(o, info, body, dest)
+		if err != nil {
+			return fmt.Errorf("failed to copy file: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *SCP) sftpSendFile(o *transferOptions, srcFile, destFile string) error {
+	osFileInfo, err := os.Stat(srcFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat source file: %w", err)
+	}
+	fi := newFileInfoFromOS(osFileInfo, "")
+
+	var dest string
+	err = runSFTPSession(s.transport, o, func(c *sftpSession) error {
+		dest = destFile
+		info, err := c.stat(dest)
+		if err != nil {
+			return err
+		}
+		if info != nil && info.IsDir() {
+			dest = path.Join(destFile, fi.name)
+		}
+		write, err := c.shouldSend(o, fi, dest)
+		if err != nil || !write {
+			return err
+		}
+
+		file, err := os.Open(srcFile)
+		if err != nil {
+			return fmt.Errorf("failed to open source file: %w", err)
+		}
+		// NOTE: file will be closed by writeFile.
+		err = c.writeFile(o, fi, file, dest)
+		if err != nil {
+			return fmt.Errorf("failed to copy file: %w", err)
+		}
+		return nil
+	})
+	return s.changeOwners(o, []sentFile{{remote: dest, local: srcFile}}, err)
+}
+
+type sftpSendWriter struct {
+	c        *sftpSession
+	o        *transferOptions
+	file     *sftp.File
+	w        io.Writer
+	fileInfo *FileInfo
+	dest     string
+	created  bool
+}
+
+func (s *sftpSendWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("failed to write sftp file body: %w", err)
+	}
+	return n, nil
+}
+
+func (s *sftpSendWriter) Close() error {
+	defer s.c.Close()
+	err := s.file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close remote file: %w", err)
+	}
+	err = s.c.setMode(s.o, s.dest, s.fileInfo, s.created)
+	if err != nil {
+		return err
+	}
+	return s.c.setTimes(s.o, s.dest, s.fileInfo)
+}
+
+func (s *SCP) sftpSendOpen(o *transferOptions, fileInfo *FileInfo, destDir string) (io.WriteCloser, error) {
+	c, err := newSFTPSession(s.transport, o)
+	if err != nil {
+		return nil, err
+	}
+	dest := path.Join(destDir, fileInfo.name)
+	exists, err := c.exists(o, dest, false)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	f, err := c.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to open remote file: %w", err)
+	}
+	return &sftpSendWriter{
+		c:        c,
+		o:        o,
+		file:     f,
+		w:        o.limiters.writer(f),
+		fileInfo: fileInfo,
+		dest:     dest,
+		created:  !exists,
+	}, nil
+}
+
+// sftpDirSender is a dirSender which creates the directory tree with SFTP.
+type sftpDirSender struct {
+	c    *sftpSession
+	o    *transferOptions
+	root string
+	dirs []string
+	// infos are the information of the directories in dirs.
+	infos []*FileInfo
+}
+
+func (d *sftpDirSender) StartDirectory(dirInfo *FileInfo) error {
+	dir := d.root
+	if len(d.dirs) > 0 {
+		dir = path.Join(d.dirs[len(d.dirs)-1], dirInfo.name)
+	}
+	err := d.c.Mkdir(dir)
+	created := err == nil
+	if err != nil {
+		if fi, statErr := d.c.Stat(dir); statErr != nil || !fi.IsDir() {
+			return fmt.Errorf("failed to create remote directory: %w", err)
+		}
+	}
+	err = d.c.setMode(d.o, dir, dirInfo, created)
+	if err != nil {
+		return err
+	}
+	d.dirs = append(d.dirs, dir)
+	d.infos = append(d.infos, dirInfo)
+	return nil
+}
+
+func (d *sftpDirSender) WriteFile(fileInfo *FileInfo, body io.ReadCloser) error {
+	return d.c.writeFile(d.o, fileInfo, body, path.Join(d.dirs[len(d.dirs)-1], fileInfo.name))
+}
+
+func (d *sftpDirSender) EndDirectory() error {
+	dir, info := d.dirs[len(d.dirs)-1], d.infos[len(d.infos)-1]
+	d.dirs, d.infos = d.dirs[:len(d.dirs)-1], d.infos[:len(d.infos)-1]
+	return d.c.setTimes(d.o, dir, info)
+}
+
+func (s *SCP) sftpSendDir(o *transferOptions, srcDir, destDir string, acceptFn AcceptFunc) error {
+	recorder := &sentRecorder{srcDir: srcDir}
+	err := runSFTPSession(s.transport, o, func(c *sftpSession) error {
+		root, destInfos, err := c.listDestDir(srcDir, destDir)
+		if err != nil {
+			return err
+		}
+		if o.plan != nil {
+			return o.planSendDir(srcDir, root, destInfos, acceptFn, o.overwrite)
+		}
+
+		recorder.dirSender = &sftpDirSender{c: c, o: o, root: root}
+		recorder.destRoot = root
+		recorder.dirs = nil
+		recorder.sent = nil
+		var ds dirSender = recorder
+		if o.hardLinks {
+			ds = newHardLinkSender(recorder, o, c.link, srcDir, root)
+		}
+		return sendDir(ds, srcDir, "", acceptFn, func(relPath string, info *FileInfo) bool {
+			return o.overwrite.shouldWrite(info, destInfos[relPath], o.compareModTimes)
+		})
+	})
+	return s.changeOwners(o, recorder.sent, err)
+}
+
+func (s *SCP) sftpReceive(o *transferOptions, srcFile string, dest io.Writer) (*FileInfo, error) {
+	var info *FileInfo
+	err := runSFTPSession(s.transport, o, func(c *sftpSession) error {
+		r, err := c.Open(srcFile)
+		if err != nil {
+			return fmt.Errorf("failed to open remote file: %w", err)
+		}
+		defer r.Close()
+		fi, err := r.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat remote file: %w", err)
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("remote %s is not a regular file", srcFile)
+		}
+		info = newFileInfoFromSFTP(fi, path.Base(srcFile))
+
+		w := newProgressWriter(dest, o.progress, info.name, info.size)
+		_, err = io.Copy(w, o.limiters.reader(r))
+		if err != nil {
+			return fmt.Errorf("failed to copy file: %w", err)
+		}
+		return nil
+	})
+	return info, err
+}
+
+func (s *SCP) sftpReceiveFile(o *transferOptions, srcFile, destFile string) error {
+	return runSFTPSession(s.transport, o, func(c *sftpSession) error {
+		info, err := c.stat(srcFile)
+		if err != nil {
+			return err
+		}
+		if info == nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("remote %s is not a regular file", srcFile)
+		}
+		info.name = path.Base(srcFile)
+		write, err := shouldReceive(o, info, destFile)
+		if err != nil || !write {
+			return err
+		}
+		return c.readFile(o, srcFile, info, destFile)
+	})
+}
+
+type sftpReceiveReader struct {
+	c    *sftpSession
+	file *sftp.File
+	r    io.Reader
+}
+
+func (r *sftpReceiveReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		return n, fmt.Errorf("failed to read from sftp remote file: %w", err)
+	}
+	return n, err
+}
+
+func (r *sftpReceiveReader) Close() error {
+	r.file.Close()
+	return r.c.Close()
+}
+
+func (s *SCP) sftpReceiveOpen(o *transferOptions, srcFile string) (io.ReadCloser, *FileInfo, error) {
+	c, err := newSFTPSession(s.transport, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := c.Open(srcFile)
+	if err != nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("failed to open remote file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		c.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to stat remote file: %w", err)
+		}
+		return nil, nil, fmt.Errorf("remote %s is not a regular file", srcFile)
+	}
+	reader := &sftpReceiveReader{
+		c:    c,
+		file: f,
+		r:    o.limiters.reader(f),
+	}
+	return reader, newFileInfoFromSFTP(fi, path.Base(srcFile)), nil
+}
+
+// sftpDirReceiver receives a remote directory tree with SFTP
+// in the same way as ReceiveDir with the scp protocol.
+type sftpDirReceiver struct {
+	c        *sftpSession
+	o        *transferOptions
+	acceptFn AcceptFunc
+}
+
+func (s *SCP) sftpReceiveDir(o *transferOptions, srcDir, destDir string, skipsFirstDirectory bool, acceptFn AcceptFunc) error {
+	return runSFTPSession(s.transport, o, func(c *sftpSession) error {
+		info, err := c.stat(srcDir)
+		if err != nil {
+			return err
+		}
+		if info == nil || !info.IsDir() {
+			return fmt.Errorf("remote %s is not a directory", srcDir)
+		}
+		r := &sftpDirReceiver{c: c, o: o, acceptFn: acceptFn}
+		if skipsFirstDirectory {
+			if o.plan != nil {
+				o.addPlan(destDir, PlanCreate, info)
+				return r.receiveEntries(srcDir, destDir)
+			}
+			err = o.setLocalMode(destDir, info.mode, true, true)
+			if err != nil {
+				return err
+			}
+			err = r.receiveEntries(srcDir, destDir)
+			if err != nil {
+				return err
+			}
+			return o.setLocalTimes(destDir, info.accessTime, info.modTime, true)
+		}
+		return r.receiveDir(srcDir, filepath.Join(destDir, info.name), info)
+	})
+}
+
+// receiveDir receives the remote directory src with the information info
+// to the local directory dest.
+func (r *sftpDirReceiver) receiveDir(src, dest string, info *FileInfo) error {
+	accepted, err := r.acceptFn(filepath.Dir(dest), info)
+	if err != nil {
+		return fmt.Errorf("error from accessFn: %w", err)
+	}
+	if !accepted {
+		if r.o.plan != nil {
+			r.o.addPlan(dest, PlanSkip, info)
+		}
+		return nil
+	}
+
+	if r.o.plan != nil {
+		action, err := localPlanAction(dest)
+		if err != nil {
+			return err
+		}
+		r.o.addPlan(dest, action, info)
+		return r.receiveEntries(src, dest)
+	}
+
+	exists, err := localExists(dest)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dest, r.o.destMode(info.mode, true))
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = r.o.setLocalMode(dest, info.mode, true, !exists)
+	if err != nil {
+		return err
+	}
+	err = r.receiveEntries(src, dest)
+	if err != nil {
+		return err
+	}
+	return r.o.setLocalTimes(dest, info.accessTime, info.modTime, true)
+}
+
+// receiveEntries receives the entries in the remote directory src
+// to the local directory dest. Symbolic links are followed like scp -r.
+func (r *sftpDirReceiver) receiveEntries(src, dest string) error {
+	fis, err := r.c.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("failed to read remote directory %s: %w", src, err)
+	}
+	for _, fi := range fis {
+		if !isValidFilename(fi.Name()) {
+			return fmt.Errorf("unexpected filename in remote directory %s: %q", src, fi.Name())
+		}
+		name := path.Join(src, fi.Name())
+		if fi.Mode()&os.ModeSymlink != 0 {
+			fi, err = r.c.Stat(name)
+			if err != nil {
+				return fmt.Errorf("failed to stat remote %s: %w", name, err)
+			}
+		}
+		info := newFileInfoFromSFTP(fi, path.Base(name))
+		localFilename := filepath.Join(dest, info.name)
+		switch {
+		case fi.IsDir():
+			err = r.receiveDir(name, localFilename, info)
+			if err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			err = r.receiveFile(name, localFilename, dest, info)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *sftpDirReceiver) receiveFile(src, dest, destDir string, info *FileInfo) error {
+	accepted, err := r.acceptFn(destDir, info)
+	if err != nil {
+		return fmt.Errorf("error from accessFn: %w", err)
+	}
+	if accepted {
+		accepted, err = shouldReceive(r.o, info, dest)
+		if err != nil {
+			return err
+		}
+	}
+	if r.o.plan != nil {
+		action := PlanSkip
+		if accepted {
+			action, err = localPlanAction(dest)
+			if err != nil {
+				return err
+			}
+		}
+		r.o.addPlan(dest, action, info)
+		return nil
+	}
+	if !accepted {
+		return nil
+	}
+	return r.c.readFile(r.o, src, info, dest)
+}
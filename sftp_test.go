@@ -0,0 +1,479 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSFTP(t *testing.T) {
+	l, err := newTestSFTPServer()
+	if err != nil {
+		t.Fatalf("fail to create test sftp server; %s", err)
+	}
+	defer l.Close()
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sftp server; %s", err)
+	}
+	defer c.Close()
+
+	setup := func(t *testing.T) (localDir, remoteDir string) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSFTP-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		remoteDir, err = ioutil.TempDir("", "go-scp-TestSFTP-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		return localDir, remoteDir
+	}
+	newSFTP := func() *scp.SCP {
+		s := scp.NewSCP(c)
+		s.Protocol = scp.ProtocolSFTP
+		return s
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("Send and Receive", func(t *testing.T) {
+		localDir, remoteDir := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		s := newSFTP()
+		info := scp.NewFileInfo("file1", 5, 0640, modTime, modTime)
+		err := s.Send(info, ioutil.NopCloser(strings.NewReader("hello")), filepath.Join(remoteDir, "file1"))
+		if err != nil {
+			t.Fatalf("fail to send; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{"file1": "hello"})
+		fi, err := os.Stat(filepath.Join(remoteDir, "file1"))
+		if err != nil {
+			t.Fatalf("fail to stat; %s", err)
+		}
+		if fi.Mode() != 0640 || !fi.ModTime().Equal(modTime) {
+			t.Errorf("file info unmatch; mode=%s, modTime=%s", fi.Mode(), fi.ModTime())
+		}
+
+		var buf bytes.Buffer
+		got, err := s.Receive(filepath.Join(remoteDir, "file1"), &buf)
+		if err != nil {
+			t.Fatalf("fail to receive; %s", err)
+		}
+		if buf.String() != "hello" {
+			t.Errorf("content unmatch; got=%q, want=%q", buf.String(), "hello")
+		}
+		if got.Name() != "file1" || got.Size() != 5 || got.Mode() != 0640 || !got.ModTime().Equal(modTime) {
+			t.Errorf("file info unmatch; name=%s, size=%d, mode=%s, modTime=%s",
+				got.Name(), got.Size(), got.Mode(), got.ModTime())
+		}
+
+		err = s.Send(info, ioutil.NopCloser(strings.NewReader("hi")), filepath.Join(remoteDir, "file1"))
+		if !errors.Is(err, scp.ErrFileChanged) {
+			t.Errorf("unexpected error; got=%v, want=%v", err, scp.ErrFileChanged)
+		}
+	})
+
+	t.Run("SendFile and ReceiveFile", func(t *testing.T) {
+		localDir, remoteDir := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		localFile := filepath.Join(localDir, "file1")
+		err := writeFileWithModTime(localFile, []byte("hello"), modTime)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+
+		s := newSFTP()
+		// The destination is a directory.
+		err = s.SendFile(localFile, remoteDir)
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{"file1": "hello"})
+
+		err = s.ReceiveFile(filepath.Join(remoteDir, "file1"), filepath.Join(localDir, "file2"))
+		if err != nil {
+			t.Fatalf("fail to receive file; %s", err)
+		}
+		if !sameFileInfoAndContent(t, localDir, localDir, "file2", "file1") {
+			t.Errorf("received file unmatch")
+		}
+
+		// The newer destination is kept with OverwriteIfNewer.
+		err = writeFileWithModTime(localFile, []byte("newer"), modTime.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		err = s.ReceiveFile(filepath.Join(remoteDir, "file1"), localFile, scp.WithOverwrite(scp.OverwriteIfNewer))
+		if err != nil {
+			t.Fatalf("fail to receive file; %s", err)
+		}
+		checkFileContents(t, localDir, map[string]string{"file1": "newer"})
+	})
+
+	t.Run("SendOpen and ReceiveOpen", func(t *testing.T) {
+		localDir, remoteDir := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		s := newSFTP()
+		info := scp.NewFileInfo("file1", 5, 0644, modTime, modTime)
+		w, err := s.SendOpen(info, filepath.Join(remoteDir, "file1"))
+		if err != nil {
+			t.Fatalf("fail to open; %s", err)
+		}
+		_, err = io.WriteString(w, "hello")
+		if err != nil {
+			t.Fatalf("fail to write; %s", err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatalf("fail to close; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{"file1": "hello"})
+
+		r, got, err := s.ReceiveOpen(filepath.Join(remoteDir, "file1"))
+		if err != nil {
+			t.Fatalf("fail to open; %s", err)
+		}
+		defer r.Close()
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("fail to read; %s", err)
+		}
+		if string(content) != "hello" || got.Size() != 5 || !got.ModTime().Equal(modTime) {
+			t.Errorf("unmatch; content=%q, size=%d, modTime=%s", content, got.Size(), got.ModTime())
+		}
+	})
+
+	t.Run("SendDir and ReceiveDir", func(t *testing.T) {
+		localDir, remoteDir := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		srcDir := filepath.Join(localDir, "src")
+		entries := []fileInfo{
+			{name: "file1", maxSize: testMaxFileSize, mode: 0644},
+			{
+				name: "dir1", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "file2", maxSize: testMaxFileSize, mode: 0600},
+					{name: "dir2", isDir: true, mode: 0750},
+				},
+			},
+		}
+		err := os.Mkdir(srcDir, 0755)
+		if err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		err = generateRandomFiles(srcDir, entries)
+		if err != nil {
+			t.Fatalf("fail to generate files; %s", err)
+		}
+
+		s := newSFTP()
+		// The destination does not exist.
+		err = s.SendDir(srcDir, filepath.Join(remoteDir, "dest"), nil)
+		if err != nil {
+			t.Fatalf("fail to send directory; %s", err)
+		}
+		sameDirTreeContent(t, srcDir, filepath.Join(remoteDir, "dest"))
+
+		// The destination exists.
+		err = s.SendDir(srcDir, remoteDir, nil)
+		if err != nil {
+			t.Fatalf("fail to send directory; %s", err)
+		}
+		sameDirTreeContent(t, srcDir, filepath.Join(remoteDir, "src"))
+
+		err = s.ReceiveDir(filepath.Join(remoteDir, "src"), filepath.Join(localDir, "received"), nil)
+		if err != nil {
+			t.Fatalf("fail to receive directory; %s", err)
+		}
+		sameDirTreeContent(t, filepath.Join(remoteDir, "src"), filepath.Join(localDir, "received"))
+
+		err = s.ReceiveDir(filepath.Join(remoteDir, "src"), filepath.Join(localDir, "received"), func(parentDir string, info os.FileInfo) (bool, error) {
+			return info.IsDir(), nil
+		})
+		if err != nil {
+			t.Fatalf("fail to receive directory; %s", err)
+		}
+		sameDirTreeContent(t, filepath.Join(remoteDir, "src", "dir1", "dir2"), filepath.Join(localDir, "received", "src", "dir1", "dir2"))
+		if _, err := os.Stat(filepath.Join(localDir, "received", "src", "file1")); !os.IsNotExist(err) {
+			t.Errorf("rejected file must not be received; %v", err)
+		}
+	})
+
+	t.Run("SendDir dry run", func(t *testing.T) {
+		localDir, remoteDir := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		err := writeFileWithModTime(filepath.Join(localDir, "file1"), []byte("hello"), modTime)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		err = writeFileWithModTime(filepath.Join(remoteDir, "file1"), []byte("hello"), modTime)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+
+		var plan []scp.PlanEntry
+		err = newSFTP().SendDir(localDir, remoteDir, nil, scp.WithDryRun(&plan), scp.WithOverwrite(scp.OverwriteIfDifferent))
+		if err != nil {
+			t.Fatalf("fail to plan; %s", err)
+		}
+		var got []string
+		for _, e := range plan {
+			got = append(got, e.Action.String()+" "+filepath.Base(e.Path))
+		}
+		want := []string{"create " + filepath.Base(localDir), "create file1"}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("plan unmatch; got=%v, want=%v", got, want)
+		}
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		localDir, remoteDir := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		localFile := filepath.Join(localDir, "file1")
+		err := writeFileWithModTime(localFile, []byte("hello"), modTime)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+
+		s := scp.NewSCP(c)
+		s.SCPCommand = "/nonexistent/scp"
+		s.Protocol = scp.ProtocolSCP
+		err = s.SendFile(localFile, remoteDir)
+		if !errors.Is(err, scp.ErrSCPNotFound) {
+			t.Errorf("unexpected error; got=%v, want=%v", err, scp.ErrSCPNotFound)
+		}
+		_, err = s.Receive(filepath.Join(remoteDir, "file1"), ioutil.Discard)
+		if !errors.Is(err, scp.ErrSCPNotFound) {
+			t.Errorf("unexpected error; got=%v, want=%v", err, scp.ErrSCPNotFound)
+		}
+
+		s.Protocol = scp.ProtocolAuto
+		err = s.SendFile(localFile, remoteDir)
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{"file1": "hello"})
+		var buf bytes.Buffer
+		_, err = s.Receive(filepath.Join(remoteDir, "file1"), &buf)
+		if err != nil {
+			t.Fatalf("fail to receive; %s", err)
+		}
+		if buf.String() != "hello" {
+			t.Errorf("content unmatch; got=%q, want=%q", buf.String(), "hello")
+		}
+
+		r, _, err := scp.NewSCP(c).ReceiveOpen(filepath.Join(remoteDir, "file1"))
+		if err != nil {
+			t.Fatalf("fail to open; %s", err)
+		}
+		r.Close()
+	})
+
+	t.Run("Transport without subsystems", func(t *testing.T) {
+		s := scp.NewSCPWithTransport(&scp.ExecTransport{})
+		s.Protocol = scp.ProtocolSFTP
+		_, err := s.Receive("/etc/hostname", ioutil.Discard)
+		if err == nil {
+			t.Errorf("receive must fail without sftp support")
+		}
+	})
+}
+
+// newTestSFTPServer starts an ssh server which runs commands with sh and
+// serves the sftp subsystem.
+func newTestSFTPServer() (net.Listener, error) {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == testSshdUser && string(pass) == testSshdPassword {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		},
+	}
+	key, err := generateTestSshdKey()
+	if err != nil {
+		return nil, err
+	}
+	private, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	config.AddHostKey(private)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newCh := range chans {
+					if newCh.ChannelType() != "session" {
+						newCh.Reject(ssh.UnknownChannelType, "unknown channel type")
+						continue
+					}
+					ch, chReqs, err := newCh.Accept()
+					if err != nil {
+						continue
+					}
+					go serveTestSFTPSession(ch, chReqs)
+				}
+			}()
+		}
+	}()
+	return l, nil
+}
+
+// forEachTestBackend runs fn as a subtest for the scp protocol run with
+// ExecTransport and for SFTP served by a test ssh server. Each subtest gets
+// a new SCP and new local and remote temporary directories.
+func forEachTestBackend(t *testing.T, fn func(t *testing.T, s *scp.SCP, localDir, remoteDir string)) {
+	t.Helper()
+	l, err := newTestSFTPServer()
+	if err != nil {
+		t.Fatalf("fail to create test sftp server; %s", err)
+	}
+	defer l.Close()
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sftp server; %s", err)
+	}
+	defer c.Close()
+
+	backends := []struct {
+		name   string
+		newSCP func() *scp.SCP
+	}{
+		{
+			name: "scp",
+			newSCP: func() *scp.SCP {
+				return scp.NewSCPWithTransport(&scp.ExecTransport{})
+			},
+		},
+		{
+			name: "sftp",
+			newSCP: func() *scp.SCP {
+				s := scp.NewSCP(c)
+				s.Protocol = scp.ProtocolSFTP
+				return s
+			},
+		},
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			prefix := "go-scp-" + strings.ReplaceAll(t.Name(), "/", "-")
+			localDir, err := ioutil.TempDir("", prefix+"-local")
+			if err != nil {
+				t.Fatalf("fail to get tempdir; %s", err)
+			}
+			defer os.RemoveAll(localDir)
+			remoteDir, err := ioutil.TempDir("", prefix+"-remote")
+			if err != nil {
+				t.Fatalf("fail to get tempdir; %s", err)
+			}
+			defer os.RemoveAll(remoteDir)
+			fn(t, b.newSCP(), localDir, remoteDir)
+		})
+	}
+}
+
+func serveTestSFTPSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		var payload struct{ Value string }
+		switch req.Type {
+		case "subsystem":
+			if ssh.Unmarshal(req.Payload, &payload) != nil || payload.Value != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			server.Close()
+			return
+		case "exec":
+			if ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+			status := runTestSFTPCommand(ch, payload.Value)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func runTestSFTPCommand(ch ssh.Channel, command string) uint32 {
+	cmd := exec.Command(testSshdShell, "-c", command)
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+	// NOTE: Use a pipe so that Wait does not wait for the client to close stdin.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 1
+	}
+	err = cmd.Start()
+	if err != nil {
+		return 1
+	}
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return uint32(exitErr.ExitCode())
+	} else if err != nil {
+		return 1
+	}
+	return 0
+}
@@ -1,23 +1,37 @@
 package scp
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
-
-	"golang.org/x/crypto/ssh"
 )
 
 // Receive copies a single remote file to the specified writer
 // and returns the file information. The actual type of the file information is
 // scp.FileInfo, and you can get the access time with fileInfo.(*scp.FileInfo).AccessTime().
-func (s *SCP) Receive(srcFile string, dest io.Writer) (*FileInfo, error) {
+func (s *SCP) Receive(srcFile string, dest io.Writer, opts ...Option) (*FileInfo, error) {
 	var info *FileInfo
-	srcFile = realPath(filepath.Clean(srcFile))
-	err := runSinkSession(s.client, srcFile, false, s.SCPCommand, false, true, func(s *sinkSession) error {
+	o := s.newTransferOptions(opts)
+	err := o.checkNoDryRun("Receive")
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: Receive is not retried since dest may be partially written.
+	o.retryPolicy.MaxAttempts = 0
+	useSFTP, err := s.prepareTransfer(o)
+	if err != nil {
+		return nil, err
+	}
+	srcFile = cleanRemotePath(o.shell, srcFile)
+	if useSFTP {
+		return s.sftpReceive(o, srcFile, dest)
+	}
+	err = runSinkSession(s.commandTransport(), srcFile, false, s.SCPCommand, false, true, o, func(s *sinkSession) error {
 		var timeHeader timeMsgHeader
 		// loop over headers until we get the file content
 		for {
@@ -47,73 +61,111 @@ func (s *SCP) Receive(srcFile string, dest io.Writer) (*FileInfo, error) {
 		}
 		return nil
 	})
+	if s.fallsBackToSFTP(o, err) {
+		return s.sftpReceive(o, srcFile, dest)
+	}
 	return info, err
 }
 
 // ReceiveFile copies a single remote file to the local machine with
 // the specified name. The time and permission will be set to the same value
-// of the source file.
-func (s *SCP) ReceiveFile(srcFile, destFile string) error {
-	srcFile = realPath(filepath.Clean(srcFile))
+// of the source file unless they are changed with WithPreserve or WithFileMode.
+// The local file is kept sparse with WithSparse.
+func (s *SCP) ReceiveFile(srcFile, destFile string, opts ...Option) error {
+	o := s.newTransferOptions(opts)
+	if err := o.checkNoDryRun("ReceiveFile"); err != nil {
+		return err
+	}
+	useSFTP, err := s.prepareTransfer(o)
+	if err != nil {
+		return err
+	}
+	srcFile = cleanRemotePath(o.shell, srcFile)
 	destFile = filepath.Clean(destFile)
 	fiDest, err := os.Stat(destFile)
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to get information of destnation file: %w", err)
 	}
 	if err == nil && fiDest.IsDir() {
-		destFile = filepath.Join(destFile, filepath.Base(srcFile))
+		destFile = filepath.Join(destFile, path.Base(srcFile))
 	}
-
-	file, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		return fmt.Errorf("failed to open destination file: %w", err)
+	if useSFTP {
+		return s.sftpReceiveFile(o, srcFile, destFile)
 	}
-	defer file.Close()
 
-	fi, err := s.Receive(srcFile, file)
-	if err != nil {
-		file.Close()
-		return err
-	}
+	err = runSinkSession(s.commandTransport(), srcFile, false, s.SCPCommand, false, true, o, func(s *sinkSession) error {
+		var timeHeader timeMsgHeader
+		// loop over headers until we get the file content
+		for {
+			h, err := s.ReadHeaderOrReply()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed to read scp message header: %w", err)
+			}
 
-	// adapt permissions and header based on the information from fi
-	err = os.Chmod(destFile, fi.Mode())
-	if err != nil {
-		return fmt.Errorf("failed to change file mode: %w", err)
+			switch h.(type) {
+			case timeMsgHeader:
+				timeHeader = h.(timeMsgHeader)
+			case fileMsgHeader:
+				fileHeader := h.(fileMsgHeader)
+				info := NewFileInfo(srcFile, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+				write, err := shouldReceive(o, info, destFile)
+				if err != nil {
+					return err
+				}
+				if !write {
+					err = s.CopyFileBodyTo(fileHeader, ioutil.Discard)
+					if err != nil {
+						return fmt.Errorf("failed to copy file: %w", err)
+					}
+					continue
+				}
+				err = copyFileBodyFromRemote(s, o, destFile, timeHeader, fileHeader)
+				if err != nil {
+					return err
+				}
+			case okMsg:
+				// do nothing
+			default:
+				return fmt.Errorf("unexpected file message header, got %+v", h)
+			}
+		}
+		return nil
+	})
+	if s.fallsBackToSFTP(o, err) {
+		return s.sftpReceiveFile(o, srcFile, destFile)
 	}
+	return err
+}
 
-	err = os.Chtimes(destFile, fi.AccessTime(), fi.ModTime())
+func copyFileBodyFromRemote(s *sinkSession, o *transferOptions, localFilename string, timeHeader timeMsgHeader, fileHeader fileMsgHeader) error {
+	exists, err := localExists(localFilename)
 	if err != nil {
-		return fmt.Errorf("failed to change file time: %w", err)
+		return err
 	}
-
-	return nil
-}
-
-func copyFileBodyFromRemote(s *sinkSession, localFilename string, timeHeader timeMsgHeader, fileHeader fileMsgHeader) error {
-	file, err := os.OpenFile(localFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileHeader.Mode)
+	file, err := os.OpenFile(localFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, o.destMode(fileHeader.Mode, false))
 	if err != nil {
 		return fmt.Errorf("failed to open destination file: %w", err)
 	}
 
-	err = s.CopyFileBodyTo(fileHeader, file)
+	w, finish := o.localBodyWriter(file)
+	err = s.CopyFileBodyTo(fileHeader, w)
 	if err != nil {
 		file.Close()
 		return fmt.Errorf("failed to copy file: %w", err)
 	}
+	err = finish()
 	file.Close()
-
-	err = os.Chmod(localFilename, fileHeader.Mode)
 	if err != nil {
-		return fmt.Errorf("failed to change file mode: %w", err)
+		return err
 	}
 
-	err = os.Chtimes(localFilename, timeHeader.Atime, timeHeader.Mtime)
+	err = o.setLocalMode(localFilename, fileHeader.Mode, false, !exists)
 	if err != nil {
-		return fmt.Errorf("failed to change file time: %w", err)
+		return err
 	}
-
-	return nil
+	return o.setLocalTimes(localFilename, timeHeader.Atime, timeHeader.Mtime, false)
 }
 
 type receiveReader struct {
@@ -167,11 +219,23 @@ func (r *receiveReader) Close() error {
 // when the remote file is ready to be read.
 // The caller of ReceiveOpen is responsible to invoke Close in the
 // returned io.ReadCloser.
-func (s *SCP) ReceiveOpen(srcFile string) (io.ReadCloser, *FileInfo, error) {
+func (s *SCP) ReceiveOpen(srcFile string, opts ...Option) (io.ReadCloser, *FileInfo, error) {
 	var info *FileInfo
-	srcFile = realPath(filepath.Clean(srcFile))
+	o := s.newTransferOptions(opts)
+	err := o.checkNoDryRun("ReceiveOpen")
+	if err != nil {
+		return nil, nil, err
+	}
+	useSFTP, err := s.prepareTransfer(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	srcFile = cleanRemotePath(o.shell, srcFile)
+	if useSFTP {
+		return s.sftpReceiveOpen(o, srcFile)
+	}
 
-	sink, err := newSinkSession(s.client, srcFile, false, s.SCPCommand, false, true)
+	sink, err := newSinkSession(s.commandTransport(), srcFile, false, s.SCPCommand, false, true, o)
 	// Caller is responsible to close sinkSession via closing the returned io.ReadCloser
 	if err != nil {
 		return nil, nil, err
@@ -193,7 +257,7 @@ func (s *SCP) ReceiveOpen(srcFile string) (io.ReadCloser, *FileInfo, error) {
 		case fileMsgHeader:
 			fileHeader := h.(fileMsgHeader)
 			info = NewFileInfo(srcFile, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
-			lr := io.LimitReader(sink.remReader, fileHeader.Size)
+			lr := io.LimitReader(sink.limiters.reader(sink.remReader), fileHeader.Size)
 
 			reader := &receiveReader{
 				sink:   sink,
@@ -209,6 +273,13 @@ func (s *SCP) ReceiveOpen(srcFile string) (io.ReadCloser, *FileInfo, error) {
 		}
 	}
 
+	if err := sink.Wait(); errors.Is(err, ErrSCPNotFound) {
+		sink.Close()
+		if s.fallsBackToSFTP(o, err) {
+			return s.sftpReceiveOpen(o, srcFile)
+		}
+		return nil, nil, err
+	}
 	return nil, nil, fmt.Errorf("unexpected initialization to read scp file %s", srcFile)
 }
 
@@ -216,28 +287,42 @@ func (s *SCP) ReceiveOpen(srcFile string) (io.ReadCloser, *FileInfo, error) {
 // to the destDir on the local machine. You can filter the files and directories
 // to be copied with acceptFn. If acceptFn is nil, all files and directories will
 // be copied. The time and permission will be set to the same value of the source
-// file or directory.
-func (s *SCP) ReceiveDir(srcDir, destDir string, acceptFn AcceptFunc) error {
-	srcDir = realPath(filepath.Clean(srcDir))
+// file or directory unless they are changed with WithPreserve, WithFileMode or
+// WithDirMode.
+// Files rejected by acceptFn or skipped by the overwrite policy are still
+// transferred over the network and discarded.
+// The local files are kept sparse with WithSparse.
+func (s *SCP) ReceiveDir(srcDir, destDir string, acceptFn AcceptFunc, opts ...Option) error {
+	o := s.newTransferOptions(opts)
+	useSFTP, err := s.prepareTransfer(o)
+	if err != nil {
+		return err
+	}
+	srcDir = cleanRemotePath(o.shell, srcDir)
 	destDir = filepath.Clean(destDir)
-	_, err := os.Stat(destDir)
+	_, err = os.Stat(destDir)
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to get information of destination directory: %w", err)
 	}
 	var skipsFirstDirectory bool
 	if os.IsNotExist(err) {
 		skipsFirstDirectory = true
-		err = os.MkdirAll(destDir, 0777)
-		if err != nil {
-			return fmt.Errorf("failed to create destination directory: %w", err)
+		if o.plan == nil {
+			err = os.MkdirAll(destDir, 0777)
+			if err != nil {
+				return fmt.Errorf("failed to create destination directory: %w", err)
+			}
 		}
 	}
 
 	if acceptFn == nil {
 		acceptFn = acceptAny
 	}
+	if useSFTP {
+		return s.sftpReceiveDir(o, srcDir, destDir, skipsFirstDirectory, acceptFn)
+	}
 
-	return runSinkSession(s.client, srcDir, false, s.SCPCommand, true, true, func(s *sinkSession) error {
+	err = runSinkSession(s.commandTransport(), srcDir, false, s.SCPCommand, true, true, o, func(s *sinkSession) error {
 		curDir := destDir
 		var timeHeader timeMsgHeader
 		var timeHeaders []timeMsgHeader
@@ -259,6 +344,19 @@ func (s *SCP) ReceiveDir(srcDir, destDir string, acceptFn AcceptFunc) error {
 				if isFirstStartDirectory {
 					isFirstStartDirectory = false
 					if skipsFirstDirectory {
+						// The source directory is received as destDir, so
+						// its times are pushed to set them to destDir at
+						// the last E message.
+						timeHeaders = append(timeHeaders, timeHeader)
+						if o.plan != nil {
+							info := NewFileInfo(destDir, 0, dirHeader.Mode|os.ModeDir, timeHeader.Mtime, timeHeader.Atime)
+							o.addPlan(destDir, PlanCreate, info)
+							continue
+						}
+						err = o.setLocalMode(destDir, dirHeader.Mode, true, true)
+						if err != nil {
+							return err
+						}
 						continue
 					}
 				}
@@ -276,30 +374,49 @@ func (s *SCP) ReceiveDir(srcDir, destDir string, acceptFn AcceptFunc) error {
 					return fmt.Errorf("error from accessFn: %w", err)
 				}
 				if !accepted {
+					if o.plan != nil {
+						o.addPlan(curDir, PlanSkip, info)
+					}
 					skipBaseDir = curDir
 					continue
 				}
 
-				err = os.MkdirAll(curDir, dirHeader.Mode)
+				if o.plan != nil {
+					action, err := localPlanAction(curDir)
+					if err != nil {
+						return err
+					}
+					o.addPlan(curDir, action, info)
+					continue
+				}
+
+				exists, err := localExists(curDir)
+				if err != nil {
+					return err
+				}
+				err = os.MkdirAll(curDir, o.destMode(dirHeader.Mode, true))
 				if err != nil {
 					return fmt.Errorf("failed to create directory: %w", err)
 				}
 
-				err = os.Chmod(curDir, dirHeader.Mode)
+				err = o.setLocalMode(curDir, dirHeader.Mode, true, !exists)
 				if err != nil {
-					return fmt.Errorf("failed to change directory mode: %w", err)
+					return err
 				}
 			case endDirectoryMsgHeader:
 				if len(timeHeaders) > 0 {
 					timeHeader = timeHeaders[len(timeHeaders)-1]
 					timeHeaders = timeHeaders[:len(timeHeaders)-1]
-					if skipBaseDir == "" {
-						err := os.Chtimes(curDir, timeHeader.Atime, timeHeader.Mtime)
+					if skipBaseDir == "" && o.plan == nil {
+						err := o.setLocalTimes(curDir, timeHeader.Atime, timeHeader.Mtime, true)
 						if err != nil {
-							return fmt.Errorf("failed to change directory time: %w", err)
+							return err
 						}
 					}
 				}
+				if skipsFirstDirectory && curDir == destDir {
+					continue
+				}
 				curDir = filepath.Dir(curDir)
 				if skipBaseDir != "" {
 					var sub bool
@@ -324,11 +441,32 @@ func (s *SCP) ReceiveDir(srcDir, destDir string, acceptFn AcceptFunc) error {
 					if err != nil {
 						return fmt.Errorf("error from accessFn: %w", err)
 					}
+					localFilename := filepath.Join(curDir, fileHeader.Name)
+					if accepted {
+						accepted, err = shouldReceive(o, info, localFilename)
+						if err != nil {
+							return err
+						}
+					}
+					if o.plan != nil {
+						action := PlanSkip
+						if accepted {
+							action, err = localPlanAction(localFilename)
+							if err != nil {
+								return err
+							}
+						}
+						o.addPlan(localFilename, action, info)
+						accepted = false
+					}
 					if !accepted {
+						err = s.CopyFileBodyTo(fileHeader, ioutil.Discard)
+						if err != nil {
+							return err
+						}
 						continue
 					}
-					localFilename := filepath.Join(curDir, fileHeader.Name)
-					err = copyFileBodyFromRemote(s, localFilename, timeHeader, fileHeader)
+					err = copyFileBodyFromRemote(s, o, localFilename, timeHeader, fileHeader)
 					if err != nil {
 						return err
 					}
@@ -344,6 +482,10 @@ func (s *SCP) ReceiveDir(srcDir, destDir string, acceptFn AcceptFunc) error {
 		}
 		return nil
 	})
+	if s.fallsBackToSFTP(o, err) {
+		return s.sftpReceiveDir(o, srcDir, destDir, skipsFirstDirectory, acceptFn)
+	}
+	return err
 }
 
 func isSubdirectory(basepath, targetpath string) (bool, error) {
@@ -355,8 +497,8 @@ func isSubdirectory(basepath, targetpath string) (bool, error) {
 }
 
 type sinkSession struct {
-	client            *ssh.Client
-	session           *ssh.Session
+	transport         Transport
+	session           Session
 	remoteSrcPath     string
 	remoteSrcIsDir    bool
 	scpPath           string
@@ -364,21 +506,24 @@ type sinkSession struct {
 	updatesPermission bool
 	stdin             io.WriteCloser
 	stdout            io.Reader
+	logger            Logger
+	recording         *sessionRecording
 	*sinkProtocol
 }
 
-func newSinkSession(client *ssh.Client, remoteSrcPath string, remoteSrcIsDir bool, scpPath string, recursive, updatesPermission bool) (*sinkSession, error) {
+func newSinkSession(t Transport, remoteSrcPath string, remoteSrcIsDir bool, scpPath string, recursive, updatesPermission bool, o *transferOptions) (*sinkSession, error) {
 	s := &sinkSession{
-		client:            client,
+		transport:         t,
 		remoteSrcPath:     remoteSrcPath,
 		remoteSrcIsDir:    remoteSrcIsDir,
 		scpPath:           scpPath,
 		recursive:         recursive,
 		updatesPermission: updatesPermission,
+		logger:            o.logger,
 	}
 
 	var err error
-	s.session, err = s.client.NewSession()
+	s.session, err = s.transport.NewSession()
 	if err != nil {
 		return s, err
 	}
@@ -408,13 +553,27 @@ func newSinkSession(client *ssh.Client, remoteSrcPath string, remoteSrcIsDir boo
 		opt = append(opt, 'd')
 	}
 
-	cmd := s.scpPath + " " + string(opt) + " " + escapeShellArg(s.remoteSrcPath)
+	cmd := s.scpPath + " " + string(opt) + " " + quoteRemoteArg(o.shell, s.remoteSrcPath)
+	logDebug(o.logger, "scp session start", "command", cmd)
 	err = s.session.Start(cmd)
 	if err != nil {
 		return s, err
 	}
 
-	s.sinkProtocol, err = newSinkProtocol(s.stdin, s.stdout)
+	remIn, remOut := s.stdin, s.stdout
+	if o.recorder != nil {
+		s.recording = o.recorder.startSession(cmd)
+		remIn, remOut = s.recording.wrap(remIn, remOut)
+	}
+
+	s.sinkProtocol, err = newSinkProtocol(remIn, remOut, o)
+	if errors.Is(err, io.EOF) {
+		// The remote exited before the first reply, which happens
+		// when scp is not found.
+		if waitErr := s.Wait(); errors.Is(waitErr, ErrSCPNotFound) {
+			return s, waitErr
+		}
+	}
 	return s, err
 }
 
@@ -429,20 +588,25 @@ func (s *sinkSession) Wait() error {
 	if s == nil || s.session == nil {
 		return nil
 	}
-	return s.session.Wait()
+	err := s.session.Wait()
+	logSessionEnd(s.logger, err)
+	s.recording.exit(err)
+	return scpNotFoundError(err, s.scpPath)
 }
 
-func runSinkSession(client *ssh.Client, remoteSrcPath string, remoteSrcIsDir bool, scpPath string, recursive, updatesPermission bool, handler func(s *sinkSession) error) error {
-	s, err := newSinkSession(client, remoteSrcPath, remoteSrcIsDir, scpPath, recursive, updatesPermission)
-	defer s.Close()
-	if err != nil {
-		return err
-	}
+func runSinkSession(t Transport, remoteSrcPath string, remoteSrcIsDir bool, scpPath string, recursive, updatesPermission bool, o *transferOptions, handler func(s *sinkSession) error) error {
+	return o.retry(func() error {
+		s, err := newSinkSession(t, remoteSrcPath, remoteSrcIsDir, scpPath, recursive, updatesPermission, o)
+		defer s.Close()
+		if err != nil {
+			return err
+		}
 
-	err = handler(s)
-	if err != nil {
-		return err
-	}
+		err = handler(s)
+		if err != nil {
+			return err
+		}
 
-	return s.Wait()
+		return s.Wait()
+	})
 }
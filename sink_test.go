@@ -8,7 +8,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	scp "github.com/hnakamur/go-scp"
 )
@@ -178,6 +180,89 @@ func TestReceiveFile(t *testing.T) {
 		}
 		sameDirTreeContent(t, remoteDir, localDir)
 	})
+
+	t.Run("Rate limited", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		remoteName := "src.dat"
+		localName := "dest.dat"
+		remotePath := filepath.Join(remoteDir, remoteName)
+		localPath := filepath.Join(localDir, localName)
+		err = generateRandomFileWithSize(remotePath, 50*1024)
+		if err != nil {
+			t.Fatalf("fail to generate remote file; %s", err)
+		}
+
+		sc := scp.NewSCP(c)
+		sc.RateLimit = 100 * 1024
+		start := time.Now()
+		err = sc.ReceiveFile(remotePath, localPath)
+		if err != nil {
+			t.Errorf("fail to ReceiveFile; %s", err)
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+			t.Errorf("transfer is too fast for rate limit; %s", elapsed)
+		}
+		sameFileInfoAndContent(t, localDir, remoteDir, localName, remoteName)
+	})
+}
+
+func TestReceiveFileOverwrite(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	for _, tc := range overwriteTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFileOverwrite-local")
+			if err != nil {
+				t.Fatalf("fail to get tempdir; %s", err)
+			}
+			defer os.RemoveAll(localDir)
+
+			remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFileOverwrite-remote")
+			if err != nil {
+				t.Fatalf("fail to get tempdir; %s", err)
+			}
+			defer os.RemoveAll(remoteDir)
+
+			remotePath := filepath.Join(remoteDir, "test.dat")
+			localPath := filepath.Join(localDir, "test.dat")
+			err = writeFileWithModTime(remotePath, tc.srcContent, tc.srcModTime)
+			if err != nil {
+				t.Fatalf("fail to write remote file; %s", err)
+			}
+			err = writeFileWithModTime(localPath, tc.destContent, tc.destModTime)
+			if err != nil {
+				t.Fatalf("fail to write local file; %s", err)
+			}
+
+			err = scp.NewSCP(c).ReceiveFile(remotePath, localPath, scp.WithOverwrite(tc.policy))
+			if err != nil {
+				t.Errorf("fail to ReceiveFile; %s", err)
+			}
+			checkOverwritten(t, localPath, tc)
+		})
+	}
 }
 
 func TestReceiveDir(t *testing.T) {
@@ -305,4 +390,131 @@ func TestReceiveDir(t *testing.T) {
 		}
 		sameDirTreeContent(t, remoteDir, localDestDir)
 	})
+
+	t.Run("overwrite never", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		for _, name := range []string{"existing", "new"} {
+			err = ioutil.WriteFile(filepath.Join(remoteDir, name), []byte("remote"), 0644)
+			if err != nil {
+				t.Fatalf("fail to write remote file; %s", err)
+			}
+		}
+		localDestDir := filepath.Join(localDir, filepath.Base(remoteDir))
+		err = os.Mkdir(localDestDir, 0755)
+		if err != nil {
+			t.Fatalf("fail to create local directory; %s", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(localDestDir, "existing"), []byte("local"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write local file; %s", err)
+		}
+
+		err = scp.NewSCP(c).ReceiveDir(remoteDir, localDir, nil, scp.WithOverwrite(scp.OverwriteNever))
+		if err != nil {
+			t.Errorf("fail to ReceiveDir; %s", err)
+		}
+		for name, want := range map[string]string{"existing": "local", "new": "remote"} {
+			got, err := ioutil.ReadFile(filepath.Join(localDestDir, name))
+			if err != nil {
+				t.Fatalf("fail to read file; %s", err)
+			}
+			if string(got) != want {
+				t.Errorf("unmatch content of %s, got:%q, want:%q", name, got, want)
+			}
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
+				},
+			},
+		}
+		err = generateRandomFiles(remoteDir, entries)
+		if err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+
+		var plan []scp.PlanEntry
+		localDestDir := filepath.Join(localDir, "dest")
+		err = scp.NewSCP(c).ReceiveDir(remoteDir, localDestDir, nil, scp.WithDryRun(&plan))
+		if err != nil {
+			t.Errorf("fail to ReceiveDir; %s", err)
+		}
+		if _, err := os.Stat(localDestDir); !os.IsNotExist(err) {
+			t.Errorf("destination directory is created in dry run; %v", err)
+		}
+
+		got := make(map[string]scp.PlanEntry)
+		for _, e := range plan {
+			got[e.Path] = e
+		}
+		for _, name := range []string{"", "foo", "baz", "baz/hoge"} {
+			p := filepath.Join(localDestDir, filepath.FromSlash(name))
+			e, ok := got[p]
+			if !ok {
+				t.Errorf("plan entry for %s is missing", p)
+				continue
+			}
+			if e.Action != scp.PlanCreate {
+				t.Errorf("unmatch action for %s, got:%s", p, e.Action)
+			}
+			fi, err := os.Stat(filepath.Join(remoteDir, filepath.FromSlash(name)))
+			if err != nil {
+				t.Fatalf("fail to stat; %s", err)
+			}
+			if !fi.IsDir() && e.Size != fi.Size() {
+				t.Errorf("unmatch size for %s, got:%d, want:%d", p, e.Size, fi.Size())
+			}
+		}
+	})
+}
+
+func TestReceiveDirUnexpectedFilename(t *testing.T) {
+	forEachTestBackend(t, func(t *testing.T, s *scp.SCP, localDir, remoteDir string) {
+		// The name is a path outside the destination on Windows clients.
+		srcDir := filepath.Join(remoteDir, "src")
+		err := os.Mkdir(srcDir, 0755)
+		if err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(srcDir, `..\x`), []byte("hello"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+
+		err = s.ReceiveDir(srcDir, filepath.Join(localDir, "dest"), nil)
+		if err == nil || !strings.Contains(err.Error(), "unexpected filename") {
+			t.Errorf("unexpected error; %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(localDir, "dest", `..\x`)); !os.IsNotExist(err) {
+			t.Errorf("file must not be received; %v", err)
+		}
+	})
 }
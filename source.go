@@ -1,47 +1,123 @@
 package scp
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
-
-	"golang.org/x/crypto/ssh"
 )
 
 // Send reads a single local file content from the r,
 // and copies it to the remote file with the name info.Name()
 // under the directory filepath.Dir(destFile).
-// The time and permission will be set with the value of info.
+// The time and permission will be set with the value of info unless
+// they are changed with WithPreserve or WithFileMode.
 // The r will be closed after copying. If you don't want for r to be
 // closed, you can pass the result of ioutil.NopCloser(r).
-func (s *SCP) Send(info *FileInfo, r io.ReadCloser, destFile string) error {
-	destFile = filepath.Clean(destFile)
-	destFile = realPath(filepath.Dir(destFile))
+// Exactly info.Size() bytes are sent. If r has fewer bytes, the remote
+// file is padded with zeros and an error wrapping ErrFileChanged is returned.
+// The transfer is retried with the retry policy only if r implements io.Seeker.
+func (s *SCP) Send(info *FileInfo, r io.ReadCloser, destFile string, opts ...Option) error {
+	o := s.newTransferOptions(opts)
+	if err := o.checkNoDryRun("Send"); err != nil {
+		r.Close()
+		return err
+	}
+	useSFTP, err := s.prepareTransfer(o)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	destFile = remoteDir(o.shell, destFile)
+	if useSFTP {
+		return s.sftpSend(o, info, r, destFile)
+	}
+
+	write, err := s.shouldSend(o, info, path.Join(destFile, info.name))
+	if err != nil || !write {
+		r.Close()
+		return err
+	}
 
-	return runSourceSession(s.client, destFile, false, s.SCPCommand, false, true, func(s *sourceSession) error {
-		err := s.WriteFile(info, r)
+	body := io.ReadCloser(r)
+	seeker, ok := r.(io.ReadSeeker)
+	if ok && o.retryPolicy.MaxAttempts > 1 {
+		defer r.Close()
+		rb, err := newRewindBody(seeker)
+		if err != nil {
+			return err
+		}
+		body = rb
+	} else {
+		o.retryPolicy.MaxAttempts = 0
+	}
+
+	err = runSourceSession(s.commandTransport(), destFile, false, s.SCPCommand, false, o.setsRemoteMode(), o, func(s *sourceSession) error {
+		if b, ok := body.(rewindBody); ok {
+			if err := b.rewind(); err != nil {
+				return fmt.Errorf("failed to rewind source: %w", err)
+			}
+		}
+		err := s.WriteFile(info, body)
 		if err != nil {
 			return fmt.Errorf("failed to copy file: %w", err)
 		}
 		return nil
 	})
+	if s.fallsBackToSFTP(o, err) {
+		// NOTE: r is not read since scp exits before the first reply.
+		return s.sftpSend(o, info, r, destFile)
+	}
+	return err
 }
 
 // SendFile copies a single local file to the remote server.
-// The time and permission will be set with the value of the source file.
-func (s *SCP) SendFile(srcFile, destFile string) error {
+// The time and permission will be set with the value of the source file
+// unless they are changed with WithPreserve or WithFileMode.
+// If the file changes size while it is sent, an error wrapping
+// ErrFileChanged is returned.
+func (s *SCP) SendFile(srcFile, destFile string, opts ...Option) error {
+	o := s.newTransferOptions(opts)
+	if err := o.checkNoDryRun("SendFile"); err != nil {
+		return err
+	}
+	useSFTP, err := s.prepareTransfer(o)
+	if err != nil {
+		return err
+	}
 	srcFile = filepath.Clean(srcFile)
-	destFile = realPath(filepath.Clean(destFile))
+	destFile = cleanRemotePath(o.shell, destFile)
+	if useSFTP {
+		return s.sftpSendFile(o, srcFile, destFile)
+	}
 
-	return runSourceSession(s.client, destFile, false, s.SCPCommand, false, true, func(s *sourceSession) error {
-		osFileInfo, err := os.Stat(srcFile)
+	osFileInfo, err := os.Stat(srcFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat source file: %w", err)
+	}
+	fi := newFileInfoFromOS(osFileInfo, "")
+
+	dest := destFile
+	if o.overwrite != OverwriteAlways || o.changesOwner() {
+		info, err := s.statRemote(destFile)
 		if err != nil {
-			return fmt.Errorf("failed to stat source file: %w", err)
+			return err
+		}
+		if info != nil && info.IsDir() {
+			dest = path.Join(destFile, fi.name)
 		}
-		fi := newFileInfoFromOS(osFileInfo, "")
+	}
+	if o.overwrite != OverwriteAlways {
+		write, err := s.shouldSend(o, fi, dest)
+		if err != nil || !write {
+			return err
+		}
+	}
 
+	err = runSourceSession(s.commandTransport(), destFile, false, s.SCPCommand, false, o.setsRemoteMode(), o, func(s *sourceSession) error {
 		file, err := os.Open(srcFile)
 		if err != nil {
 			return fmt.Errorf("failed to open source file: %w", err)
@@ -53,6 +129,10 @@ func (s *SCP) SendFile(srcFile, destFile string) error {
 		}
 		return nil
 	})
+	if s.fallsBackToSFTP(o, err) {
+		return s.sftpSendFile(o, srcFile, destFile)
+	}
+	return s.changeOwners(o, []sentFile{{remote: dest, local: srcFile}}, err)
 }
 
 type sendWriter struct {
@@ -64,7 +144,7 @@ type sendWriter struct {
 var _ io.WriteCloser = &sendWriter{}
 
 func (s *sendWriter) Write(p []byte) (int, error) {
-	n, err := s.source.remIn.Write(p)
+	n, err := s.source.limiters.writer(s.source.remIn).Write(p)
 	s.written += int64(n)
 	if err != nil {
 		return n, fmt.Errorf("failed to write scp file body: %w", err)
@@ -76,7 +156,7 @@ func (s *sendWriter) Write(p []byte) (int, error) {
 			return n, err
 		}
 
-		_, err = s.source.remIn.Write([]byte{replyOK})
+		err = s.source.writeReply(replyOK, "")
 		if err != nil {
 			return n, fmt.Errorf("failed to write scp replyOK reply: %w", err)
 		}
@@ -108,26 +188,39 @@ func (s *sendWriter) Close() error {
 // SendOpen will write a known number of bytes according to fileInfo to the remote file.
 // The caller of SendOpen is responsible to close the returned io.WriteCloser.
 // Metadata such as modified time and mode/permission of the remote will is applied from fileInfo.
-func (s *SCP) SendOpen(fileInfo *FileInfo, destFile string) (io.WriteCloser, error) {
+func (s *SCP) SendOpen(fileInfo *FileInfo, destFile string, opts ...Option) (io.WriteCloser, error) {
 	var err error
+	o := s.newTransferOptions(opts)
+	err = o.checkNoDryRun("SendOpen")
+	if err != nil {
+		return nil, err
+	}
 
-	destFile = filepath.Clean(destFile)
-	destFile = realPath(filepath.Dir(destFile))
+	useSFTP, err := s.prepareTransfer(o)
+	if err != nil {
+		return nil, err
+	}
+	destFile = remoteDir(o.shell, destFile)
+	if useSFTP {
+		return s.sftpSendOpen(o, fileInfo, destFile)
+	}
 
-	source, err := newSourceSession(s.client, destFile, false, s.SCPCommand, false, true)
+	source, err := newSourceSession(s.commandTransport(), destFile, false, s.SCPCommand, false, o.setsRemoteMode(), o)
 	// Caller is responsible to close sourceSession via closing the returned io.WriteCloser
 	if err != nil {
+		if s.fallsBackToSFTP(o, err) {
+			source.Close()
+			return s.sftpSendOpen(o, fileInfo, destFile)
+		}
 		return nil, err
 	}
 
-	if !fileInfo.modTime.IsZero() || !fileInfo.accessTime.IsZero() {
-		err = source.setTime(fileInfo.modTime, fileInfo.accessTime)
-		if err != nil {
-			return nil, err
-		}
+	err = source.writeTime(fileInfo)
+	if err != nil {
+		return nil, err
 	}
 
-	err = source.writeFileHeader(fileInfo.mode, fileInfo.size, fileInfo.name)
+	err = source.writeFileHeader(o.destMode(fileInfo.mode, false), fileInfo.size, fileInfo.name)
 	if err != nil {
 		return nil, err
 	}
@@ -156,104 +249,230 @@ func acceptAny(string, os.FileInfo) (bool, error) {
 // over the network even if some files are filtered out. If you need more efficiency,
 // it is better to use another method like the tar command.
 // If acceptFn is nil, all files and directories will be copied.
-// The time and permission will be set to the same value of the source file or directory.
-func (s *SCP) SendDir(srcDir, destDir string, acceptFn AcceptFunc) error {
+// The time and permission will be set to the same value of the source file or directory
+// unless they are changed with WithPreserve, WithFileMode or WithDirMode.
+// Unlike acceptFn, files skipped by the overwrite policy are not transferred.
+// Hard linked files are sent once with WithHardLinks.
+func (s *SCP) SendDir(srcDir, destDir string, acceptFn AcceptFunc, opts ...Option) error {
+	o := s.newTransferOptions(opts)
+	useSFTP, err := s.prepareTransfer(o)
+	if err != nil {
+		return err
+	}
 	srcDir = filepath.Clean(srcDir)
-	destDir = realPath(filepath.Clean(destDir))
+	destDir = cleanRemotePath(o.shell, destDir)
 	if acceptFn == nil {
 		acceptFn = acceptAny
 	}
+	// Every entry is written with OverwriteAlways, so a dry run does not
+	// need to know which remote entries exist.
+	if o.plan != nil && o.overwrite == OverwriteAlways {
+		return o.planSendDir(srcDir, destDir, nil, acceptFn, o.overwrite)
+	}
+	if useSFTP {
+		return s.sftpSendDir(o, srcDir, destDir, acceptFn)
+	}
 
-	return runSourceSession(s.client, destDir, false, s.SCPCommand, true, true, func(s *sourceSession) error {
-		prevDirSkipped := false
+	if o.plan != nil {
+		destRoot, destInfos, err := s.listRemoteDestDir(srcDir, destDir)
+		if err != nil {
+			return err
+		}
+		return o.planSendDir(srcDir, destRoot, destInfos, acceptFn, o.overwrite)
+	}
 
-		endDirectories := func(prevDir, dir string) error {
-			rel, err := filepath.Rel(prevDir, dir)
-			if err != nil {
-				return err
-			}
-			for _, comp := range strings.Split(rel, string([]rune{filepath.Separator})) {
-				if comp == ".." {
-					if prevDirSkipped {
-						prevDirSkipped = false
-					} else {
-						err := s.EndDirectory()
-						if err != nil {
-							return err
-						}
+	// destInfos is nil if the overwrite policy does not need the remote files.
+	var destRoot string
+	var destInfos map[string]*FileInfo
+	if o.overwrite != OverwriteAlways {
+		destRoot, destInfos, err = s.listRemoteDestDir(srcDir, destDir)
+		if err != nil {
+			return err
+		}
+	} else if o.changesOwner() || o.hardLinks {
+		destRoot, err = s.remoteDestRoot(srcDir, destDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	recorder := &sentRecorder{srcDir: srcDir, destRoot: destRoot}
+	link := func(links []hardLink) (map[string]error, error) {
+		return s.linkRemote(o, links)
+	}
+	err = runSourceSession(s.commandTransport(), destDir, false, s.SCPCommand, true, o.setsRemoteMode(), o, func(s *sourceSession) error {
+		recorder.dirSender = s
+		recorder.dirs = nil
+		recorder.sent = nil
+		var ds dirSender = recorder
+		if o.hardLinks {
+			ds = newHardLinkSender(recorder, o, link, srcDir, destRoot)
+		}
+		return sendDir(ds, srcDir, "", acceptFn, func(relPath string, info *FileInfo) bool {
+			return destInfos == nil || o.overwrite.shouldWrite(info, destInfos[relPath], o.compareModTimes)
+		})
+	})
+	if s.fallsBackToSFTP(o, err) {
+		return s.sftpSendDir(o, srcDir, destDir, acceptFn)
+	}
+	return s.changeOwners(o, recorder.sent, err)
+}
+
+// listRemoteDestDir lists the remote directory root to which files under srcDir
+// are copied by SendDir.
+func (s *SCP) listRemoteDestDir(srcDir, destDir string) (root string, infos map[string]*FileInfo, err error) {
+	root, err = s.remoteDestRoot(srcDir, destDir)
+	if err != nil {
+		return "", nil, err
+	}
+	infos, err = s.listRemote(root, true)
+	return root, infos, err
+}
+
+// remoteDestRoot returns the remote directory to which files under srcDir
+// are copied by SendDir. Like the scp command, it is
+// destDir/filepath.Base(srcDir) if destDir exists, and destDir otherwise.
+func (s *SCP) remoteDestRoot(srcDir, destDir string) (string, error) {
+	info, err := s.statRemote(destDir)
+	if err != nil {
+		return "", err
+	}
+	if info != nil && info.IsDir() {
+		return path.Join(destDir, filepath.Base(srcDir)), nil
+	}
+	return destDir, nil
+}
+
+// dirSender is the interface to send a directory tree.
+// It is implemented by sourceSession and planSender.
+type dirSender interface {
+	StartDirectory(dirInfo *FileInfo) error
+	WriteFile(fileInfo *FileInfo, body io.ReadCloser) error
+	EndDirectory() error
+}
+
+// sendDir sends files and directories under the local srcDir to s.
+// If rootName is not empty, it is used as the name of srcDir on the remote.
+// Files rejected by acceptFn or shouldSend are not sent. shouldSend is called
+// with the slash separated path relative to srcDir.
+func sendDir(s dirSender, srcDir, rootName string, acceptFn AcceptFunc, shouldSend func(relPath string, info *FileInfo) bool) error {
+	prevDirSkipped := false
+	// changedErr is the first ErrFileChanged error. We keep sending
+	// other files and return it at the end like OpenSSH scp does.
+	var changedErr error
+
+	endDirectories := func(prevDir, dir string) error {
+		rel, err := filepath.Rel(prevDir, dir)
+		if err != nil {
+			return err
+		}
+		for _, comp := range strings.Split(rel, string([]rune{filepath.Separator})) {
+			if comp == ".." {
+				if prevDirSkipped {
+					prevDirSkipped = false
+				} else {
+					err := s.EndDirectory()
+					if err != nil {
+						return err
 					}
 				}
 			}
-			return nil
 		}
+		return nil
+	}
 
-		prevDir := srcDir
-		myWalkFn := func(path string, info os.FileInfo, err error) error {
-			// We must check err is not nil first.
-			// See https://golang.org/pkg/path/filepath/#WalkFunc
-			if err != nil {
-				return err
-			}
+	prevDir := srcDir
+	myWalkFn := func(path string, info os.FileInfo, err error) error {
+		// We must check err is not nil first.
+		// See https://golang.org/pkg/path/filepath/#WalkFunc
+		if err != nil {
+			return err
+		}
 
-			isDir := info.IsDir()
-			var dir string
-			if isDir {
-				dir = path
-			} else {
-				dir = filepath.Dir(path)
-			}
-			defer func() {
-				prevDir = dir
-			}()
+		isDir := info.IsDir()
+		var dir string
+		if isDir {
+			dir = path
+		} else {
+			dir = filepath.Dir(path)
+		}
+		defer func() {
+			prevDir = dir
+		}()
 
-			err = endDirectories(prevDir, dir)
-			if err != nil {
-				return err
+		err = endDirectories(prevDir, dir)
+		if err != nil {
+			return err
+		}
+
+		scpFileInfo := newFileInfoFromOS(info, "")
+		accepted, err := acceptFn(filepath.Dir(path), scpFileInfo)
+		if err != nil {
+			return err
+		}
+
+		if isDir {
+			if !accepted {
+				prevDirSkipped = true
+				return filepath.SkipDir
 			}
 
-			scpFileInfo := newFileInfoFromOS(info, "")
-			accepted, err := acceptFn(filepath.Dir(path), scpFileInfo)
+			if path == srcDir && rootName != "" {
+				scpFileInfo = newFileInfoFromOS(info, rootName)
+			}
+			err := s.StartDirectory(scpFileInfo)
 			if err != nil {
 				return err
 			}
-
-			if isDir {
-				if !accepted {
-					prevDirSkipped = true
-					return filepath.SkipDir
+		} else {
+			if accepted {
+				rel, err := filepath.Rel(srcDir, path)
+				if err != nil {
+					return err
 				}
-
-				err := s.StartDirectory(scpFileInfo)
+				accepted = shouldSend(filepath.ToSlash(rel), scpFileInfo)
+			}
+			if accepted {
+				fi := newFileInfoFromOS(info, "")
+				file, err := os.Open(path)
 				if err != nil {
 					return err
 				}
-			} else {
-				if accepted {
-					fi := newFileInfoFromOS(info, "")
-					file, err := os.Open(path)
-					if err != nil {
-						return err
-					}
-					err = s.WriteFile(fi, file)
-					if err != nil {
-						return err
+				err = s.WriteFile(fi, file)
+				if errors.Is(err, ErrFileChanged) {
+					if changedErr == nil {
+						changedErr = err
 					}
+				} else if err != nil {
+					return err
 				}
 			}
-			return nil
 		}
-		err := filepath.Walk(srcDir, myWalkFn)
+		return nil
+	}
+	err := filepath.Walk(srcDir, myWalkFn)
+	if err != nil {
+		return err
+	}
+
+	err = endDirectories(prevDir, srcDir)
+	if err != nil {
+		return err
+	}
+	// The source directory is ended too unless it is skipped, so that its
+	// times are set after its entries are written like OpenSSH scp does.
+	if !prevDirSkipped {
+		err = s.EndDirectory()
 		if err != nil {
 			return err
 		}
-
-		return endDirectories(prevDir, srcDir)
-	})
+	}
+	return changedErr
 }
 
 type sourceSession struct {
-	client            *ssh.Client
-	session           *ssh.Session
+	transport         Transport
+	session           Session
 	remoteDestPath    string
 	remoteDestIsDir   bool
 	scpPath           string
@@ -261,21 +480,24 @@ type sourceSession struct {
 	updatesPermission bool
 	stdin             io.WriteCloser
 	stdout            io.Reader
+	logger            Logger
+	recording         *sessionRecording
 	*sourceProtocol
 }
 
-func newSourceSession(client *ssh.Client, remoteDestPath string, remoteDestIsDir bool, scpPath string, recursive, updatesPermission bool) (*sourceSession, error) {
+func newSourceSession(t Transport, remoteDestPath string, remoteDestIsDir bool, scpPath string, recursive, updatesPermission bool, o *transferOptions) (*sourceSession, error) {
 	s := &sourceSession{
-		client:            client,
+		transport:         t,
 		remoteDestPath:    remoteDestPath,
 		remoteDestIsDir:   remoteDestIsDir,
 		scpPath:           scpPath,
 		recursive:         recursive,
 		updatesPermission: updatesPermission,
+		logger:            o.logger,
 	}
 
 	var err error
-	s.session, err = s.client.NewSession()
+	s.session, err = s.transport.NewSession()
 	if err != nil {
 		return s, err
 	}
@@ -305,13 +527,27 @@ func newSourceSession(client *ssh.Client, remoteDestPath string, remoteDestIsDir
 		opt = append(opt, 'd')
 	}
 
-	cmd := s.scpPath + " " + string(opt) + " " + escapeShellArg(s.remoteDestPath)
+	cmd := s.scpPath + " " + string(opt) + " " + quoteRemoteArg(o.shell, s.remoteDestPath)
+	logDebug(o.logger, "scp session start", "command", cmd)
 	err = s.session.Start(cmd)
 	if err != nil {
 		return s, err
 	}
 
-	s.sourceProtocol, err = newSourceProtocol(s.stdin, s.stdout)
+	remIn, remOut := s.stdin, s.stdout
+	if o.recorder != nil {
+		s.recording = o.recorder.startSession(cmd)
+		remIn, remOut = s.recording.wrap(remIn, remOut)
+	}
+
+	s.sourceProtocol, err = newSourceProtocol(remIn, remOut, o)
+	if errors.Is(err, io.EOF) {
+		// The remote exited without the first reply, which happens
+		// when scp is not found.
+		if waitErr := s.Wait(); errors.Is(waitErr, ErrSCPNotFound) {
+			return s, waitErr
+		}
+	}
 	return s, err
 }
 
@@ -326,7 +562,10 @@ func (s *sourceSession) Wait() error {
 	if s == nil || s.session == nil {
 		return nil
 	}
-	return s.session.Wait()
+	err := s.session.Wait()
+	logSessionEnd(s.logger, err)
+	s.recording.exit(err)
+	return scpNotFoundError(err, s.scpPath)
 }
 
 func (s *sourceSession) CloseStdin() error {
@@ -336,19 +575,21 @@ func (s *sourceSession) CloseStdin() error {
 	return s.stdin.Close()
 }
 
-func runSourceSession(client *ssh.Client, remoteDestPath string, remoteDestIsDir bool, scpPath string, recursive, updatesPermission bool, handler func(s *sourceSession) error) error {
-	s, err := newSourceSession(client, remoteDestPath, remoteDestIsDir, scpPath, recursive, updatesPermission)
-	defer s.Close()
-	if err != nil {
-		return err
-	}
-	err = func() error {
-		defer s.CloseStdin()
+func runSourceSession(t Transport, remoteDestPath string, remoteDestIsDir bool, scpPath string, recursive, updatesPermission bool, o *transferOptions, handler func(s *sourceSession) error) error {
+	return o.retry(func() error {
+		s, err := newSourceSession(t, remoteDestPath, remoteDestIsDir, scpPath, recursive, updatesPermission, o)
+		defer s.Close()
+		if err != nil {
+			return err
+		}
+		err = func() error {
+			defer s.CloseStdin()
 
-		return handler(s)
-	}()
-	if err != nil {
-		return err
-	}
-	return s.Wait()
+			return handler(s)
+		}()
+		if err != nil {
+			return err
+		}
+		return s.Wait()
+	})
 }
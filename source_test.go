@@ -9,6 +9,7 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -79,6 +80,57 @@ func TestSend(t *testing.T) {
 		}
 		sameFileInfoAndContent(t, remoteDir, localDir, remoteName2, localName)
 	})
+
+	t.Run("Body shorter than size", func(t *testing.T) {
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSend-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		remoteName := "dest.dat"
+		remotePath := filepath.Join(remoteDir, remoteName)
+		content := []byte("short")
+		fi := scp.NewFileInfo(remoteName, 10, 0644, time.Now(), time.Now())
+		err = scp.NewSCP(c).Send(fi, ioutil.NopCloser(bytes.NewReader(content)), remotePath)
+		if !errors.Is(err, scp.ErrFileChanged) {
+			t.Errorf("unexpected error from Send, got:%v, want:%v", err, scp.ErrFileChanged)
+		}
+
+		got, err := ioutil.ReadFile(remotePath)
+		if err != nil {
+			t.Fatalf("fail to read file %s; %s", remotePath, err)
+		}
+		want := append(content, make([]byte, 5)...)
+		if !bytes.Equal(got, want) {
+			t.Errorf("unmatch file content, got:%q, want:%q", got, want)
+		}
+	})
+
+	t.Run("Body longer than size", func(t *testing.T) {
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSend-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		remoteName := "dest.dat"
+		remotePath := filepath.Join(remoteDir, remoteName)
+		content := []byte("longer than size")
+		fi := scp.NewFileInfo(remoteName, 6, 0644, time.Now(), time.Now())
+		err = scp.NewSCP(c).Send(fi, ioutil.NopCloser(bytes.NewReader(content)), remotePath)
+		if err != nil {
+			t.Errorf("fail to Send; %s", err)
+		}
+
+		got, err := ioutil.ReadFile(remotePath)
+		if err != nil {
+			t.Fatalf("fail to read file %s; %s", remotePath, err)
+		}
+		if want := content[:6]; !bytes.Equal(got, want) {
+			t.Errorf("unmatch file content, got:%q, want:%q", got, want)
+		}
+	})
 }
 
 func TestSendOpen(t *testing.T) {
@@ -242,6 +294,87 @@ func TestSendFile(t *testing.T) {
 		}
 		sameDirTreeContent(t, localDir, remoteDir)
 	})
+
+	t.Run("Rate limited", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		localName := "test1.dat"
+		remoteName := "dest.dat"
+		localPath := filepath.Join(localDir, localName)
+		remotePath := filepath.Join(remoteDir, remoteName)
+		err = generateRandomFileWithSize(localPath, 50*1024)
+		if err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+
+		start := time.Now()
+		err = scp.NewSCP(c).SendFile(localPath, remotePath, scp.WithRateLimit(100*1024))
+		if err != nil {
+			t.Errorf("fail to SendFile; %s", err)
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+			t.Errorf("transfer is too fast for rate limit; %s", elapsed)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, remoteName, localName)
+	})
+}
+
+func TestSendFileOverwrite(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	for _, tc := range overwriteTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			localDir, err := ioutil.TempDir("", "go-scp-TestSendFileOverwrite-local")
+			if err != nil {
+				t.Fatalf("fail to get tempdir; %s", err)
+			}
+			defer os.RemoveAll(localDir)
+
+			remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFileOverwrite-remote")
+			if err != nil {
+				t.Fatalf("fail to get tempdir; %s", err)
+			}
+			defer os.RemoveAll(remoteDir)
+
+			localPath := filepath.Join(localDir, "test.dat")
+			remotePath := filepath.Join(remoteDir, "test.dat")
+			err = writeFileWithModTime(localPath, tc.srcContent, tc.srcModTime)
+			if err != nil {
+				t.Fatalf("fail to write local file; %s", err)
+			}
+			err = writeFileWithModTime(remotePath, tc.destContent, tc.destModTime)
+			if err != nil {
+				t.Fatalf("fail to write remote file; %s", err)
+			}
+
+			err = scp.NewSCP(c).SendFile(localPath, remoteDir, scp.WithOverwrite(tc.policy))
+			if err != nil {
+				t.Errorf("fail to SendFile; %s", err)
+			}
+			checkOverwritten(t, remotePath, tc)
+		})
+	}
 }
 
 func TestSendDir(t *testing.T) {
@@ -507,6 +640,287 @@ func TestSendDir(t *testing.T) {
 		}
 		sameDirTreeContent(t, localDir, remoteDir)
 	})
+	t.Run("overwrite if different", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		err = writeFileWithModTime(filepath.Join(localDir, "same"), []byte("local"), modTime)
+		if err != nil {
+			t.Fatalf("fail to write local file; %s", err)
+		}
+		err = writeFileWithModTime(filepath.Join(localDir, "changed"), []byte("local"), modTime)
+		if err != nil {
+			t.Fatalf("fail to write local file; %s", err)
+		}
+		remoteDestDir := filepath.Join(remoteDir, filepath.Base(localDir))
+		err = os.Mkdir(remoteDestDir, 0755)
+		if err != nil {
+			t.Fatalf("fail to create remote directory; %s", err)
+		}
+		err = writeFileWithModTime(filepath.Join(remoteDestDir, "same"), []byte("other"), modTime)
+		if err != nil {
+			t.Fatalf("fail to write remote file; %s", err)
+		}
+		err = writeFileWithModTime(filepath.Join(remoteDestDir, "changed"), []byte("other"), modTime.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("fail to write remote file; %s", err)
+		}
+
+		err = scp.NewSCP(c).SendDir(localDir, remoteDir, nil, scp.WithOverwrite(scp.OverwriteIfDifferent))
+		if err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+		for name, want := range map[string]string{"same": "other", "changed": "local"} {
+			got, err := ioutil.ReadFile(filepath.Join(remoteDestDir, name))
+			if err != nil {
+				t.Fatalf("fail to read file; %s", err)
+			}
+			if string(got) != want {
+				t.Errorf("unmatch content of %s, got:%q, want:%q", name, got, want)
+			}
+		}
+	})
+}
+
+func TestSendDirDryRun(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestSendDirDryRun-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDirDryRun-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	entries := []fileInfo{
+		{name: "a", maxSize: testMaxFileSize, mode: 0644},
+		{name: "b", maxSize: testMaxFileSize, mode: 0600},
+		{name: "c", maxSize: testMaxFileSize, mode: 0600},
+		{name: "sub", isDir: true, mode: 0755,
+			entries: []fileInfo{
+				{name: "d", maxSize: testMaxFileSize, mode: 0400},
+			},
+		},
+	}
+	err = generateRandomFiles(localDir, entries)
+	if err != nil {
+		t.Fatalf("fail to generate local files; %s", err)
+	}
+	remoteDestDir := filepath.Join(remoteDir, filepath.Base(localDir))
+	err = os.Mkdir(remoteDestDir, 0755)
+	if err != nil {
+		t.Fatalf("fail to create remote directory; %s", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(remoteDestDir, "a"), []byte("remote"), 0644)
+	if err != nil {
+		t.Fatalf("fail to write remote file; %s", err)
+	}
+
+	var plan []scp.PlanEntry
+	acceptFn := func(parentDir string, info os.FileInfo) (bool, error) {
+		return info.Name() != "c", nil
+	}
+	err = scp.NewSCP(c).SendDir(localDir, remoteDir, acceptFn, scp.WithDryRun(&plan), scp.WithOverwrite(scp.OverwriteNever))
+	if err != nil {
+		t.Fatalf("fail to SendDir; %s", err)
+	}
+
+	want := []struct {
+		path   string
+		action scp.PlanAction
+	}{
+		{path: remoteDestDir, action: scp.PlanOverwrite},
+		{path: filepath.Join(remoteDestDir, "a"), action: scp.PlanSkip},
+		{path: filepath.Join(remoteDestDir, "b"), action: scp.PlanCreate},
+		{path: filepath.Join(remoteDestDir, "c"), action: scp.PlanSkip},
+		{path: filepath.Join(remoteDestDir, "sub"), action: scp.PlanCreate},
+		{path: filepath.Join(remoteDestDir, "sub", "d"), action: scp.PlanCreate},
+	}
+	if len(plan) != len(want) {
+		t.Fatalf("unmatch plan entry count, got:%+v", plan)
+	}
+	for i, w := range want {
+		if plan[i].Path != w.path || plan[i].Action != w.action {
+			t.Errorf("unmatch plan entry #%d, got:%s %s, want:%s %s", i, plan[i].Action, plan[i].Path, w.action, w.path)
+		}
+	}
+	if plan[4].Mode != os.ModeDir|0755 {
+		t.Errorf("unmatch mode of directory, got:%s", plan[4].Mode)
+	}
+
+	names, err := filepath.Glob(filepath.Join(remoteDestDir, "*"))
+	if err != nil {
+		t.Fatalf("fail to glob; %s", err)
+	}
+	if len(names) != 1 {
+		t.Errorf("remote files are created in dry run; %v", names)
+	}
+}
+
+func TestSendDirDryRunOverwriteAlways(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "go-scp-TestSendDirDryRunOverwriteAlways-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+	err = os.Mkdir(filepath.Join(localDir, "sub"), 0755)
+	if err != nil {
+		t.Fatalf("fail to create directory; %s", err)
+	}
+	for _, name := range []string{"a", "sub/b"} {
+		err = ioutil.WriteFile(filepath.Join(localDir, filepath.FromSlash(name)), []byte("hello"), 0644)
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+	}
+
+	// The remote is not accessed since every entry is written.
+	var plan []scp.PlanEntry
+	s := scp.NewSCPWithTransport(noSessionTransport{})
+	err = s.SendDir(localDir, "/dest", nil, scp.WithDryRun(&plan))
+	if err != nil {
+		t.Fatalf("fail to SendDir; %s", err)
+	}
+
+	want := []string{"write /dest", "write /dest/a", "write /dest/sub", "write /dest/sub/b"}
+	var got []string
+	for _, e := range plan {
+		got = append(got, e.Action.String()+" "+e.Path)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unmatch plan, got:%v, want:%v", got, want)
+	}
+}
+
+// noSessionTransport is a Transport which fails to open sessions.
+type noSessionTransport struct{}
+
+func (noSessionTransport) NewSession() (scp.Session, error) {
+	return nil, errors.New("session must not be opened")
+}
+
+type overwriteTestCase struct {
+	name        string
+	policy      scp.OverwritePolicy
+	srcContent  []byte
+	srcModTime  time.Time
+	destContent []byte
+	destModTime time.Time
+	overwritten bool
+}
+
+var overwriteTestCases = []overwriteTestCase{
+	{
+		name:        "always",
+		policy:      scp.OverwriteAlways,
+		srcContent:  []byte("new"),
+		srcModTime:  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		destContent: []byte("old"),
+		destModTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		overwritten: true,
+	},
+	{
+		name:        "never",
+		policy:      scp.OverwriteNever,
+		srcContent:  []byte("new content"),
+		srcModTime:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		destContent: []byte("old"),
+		destModTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		overwritten: false,
+	},
+	{
+		name:        "if newer with newer source",
+		policy:      scp.OverwriteIfNewer,
+		srcContent:  []byte("new"),
+		srcModTime:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		destContent: []byte("old"),
+		destModTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		overwritten: true,
+	},
+	{
+		name:        "if newer with older source",
+		policy:      scp.OverwriteIfNewer,
+		srcContent:  []byte("new"),
+		srcModTime:  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		destContent: []byte("old"),
+		destModTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		overwritten: false,
+	},
+	{
+		name:        "if different with same size and time",
+		policy:      scp.OverwriteIfDifferent,
+		srcContent:  []byte("new"),
+		srcModTime:  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		destContent: []byte("old"),
+		destModTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		overwritten: false,
+	},
+	{
+		name:        "if different with different size",
+		policy:      scp.OverwriteIfDifferent,
+		srcContent:  []byte("new content"),
+		srcModTime:  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		destContent: []byte("old"),
+		destModTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		overwritten: true,
+	},
+	{
+		name:        "if different with older source",
+		policy:      scp.OverwriteIfDifferent,
+		srcContent:  []byte("new"),
+		srcModTime:  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		destContent: []byte("old"),
+		destModTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		overwritten: true,
+	},
+}
+
+func checkOverwritten(t *testing.T, destPath string, tc overwriteTestCase) {
+	got, err := ioutil.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("fail to read file %s; %s", destPath, err)
+	}
+	want := tc.destContent
+	if tc.overwritten {
+		want = tc.srcContent
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("unmatch file content, got:%q, want:%q", got, want)
+	}
+}
+
+func writeFileWithModTime(filename string, content []byte, modTime time.Time) error {
+	err := ioutil.WriteFile(filename, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(filename, modTime, modTime)
 }
 
 var (
@@ -0,0 +1,73 @@
+package scp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// WithSparse makes ReceiveFile and ReceiveDir skip the blocks of zeros in
+// the received file bodies instead of writing them, so the local files
+// are sparse on file systems which support holes. It is not used by
+// Receive and ReceiveOpen since their callers write the bodies.
+func WithSparse() Option {
+	return func(o *transferOptions) {
+		o.sparse = true
+	}
+}
+
+// sparseBlockSize is the size of the blocks which are checked for zeros.
+// It is the block size of most file systems.
+const sparseBlockSize = 4096
+
+var zeroBlock [sparseBlockSize]byte
+
+// localBodyWriter returns the writer of a received file body to file, and
+// the function to call after the body is written.
+func (o *transferOptions) localBodyWriter(file *os.File) (io.Writer, func() error) {
+	if !o.sparse {
+		return file, func() error { return nil }
+	}
+	w := &sparseWriter{file: file}
+	return w, w.finish
+}
+
+// sparseWriter writes to a new or truncated file, skipping the blocks of
+// zeros aligned to sparseBlockSize.
+type sparseWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := sparseBlockSize - int(w.offset%sparseBlockSize)
+		if n > len(p) {
+			n = len(p)
+		}
+		// The skipped bytes are read as zeros since the file is empty
+		// beyond the offset.
+		if !bytes.Equal(p[:n], zeroBlock[:n]) {
+			_, err := w.file.WriteAt(p[:n], w.offset)
+			if err != nil {
+				return written, err
+			}
+		}
+		w.offset += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// finish sets the size of the file, which is not extended by trailing
+// zeros.
+func (w *sparseWriter) finish() error {
+	err := w.file.Truncate(w.offset)
+	if err != nil {
+		return fmt.Errorf("failed to truncate destination file: %w", err)
+	}
+	return nil
+}
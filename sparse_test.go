@@ -0,0 +1,124 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestSparse(t *testing.T) {
+	// The body is mostly zeros with data which is not aligned to blocks,
+	// and ends with zeros.
+	const size = 16 << 20
+	body := make([]byte, size)
+	copy(body[1<<20+100:], bytes.Repeat([]byte("data"), 2000))
+	copy(body[8<<20:], "middle")
+
+	allocated := func(t *testing.T, name string) int64 {
+		t.Helper()
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		return fi.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+	checkFile := func(t *testing.T, name string, sparse bool) {
+		t.Helper()
+		got, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("contents of %s unmatch; size=%d", filepath.Base(name), len(got))
+		}
+		// Only a few blocks are allocated for the data.
+		if n := allocated(t, name); sparse && n > 1<<20 {
+			t.Errorf("%s is not sparse; allocated=%d", filepath.Base(name), n)
+		}
+	}
+
+	// Check the local file system supports holes.
+	probeDir, err := ioutil.TempDir("", "go-scp-TestSparse-probe")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(probeDir)
+	probe := filepath.Join(probeDir, "probe")
+	err = ioutil.WriteFile(probe, nil, 0644)
+	if err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
+	err = os.Truncate(probe, size)
+	if err != nil {
+		t.Fatalf("fail to truncate file; %s", err)
+	}
+	if allocated(t, probe) >= size {
+		t.Skip("file system does not support holes")
+	}
+
+	forEachTestBackend(t, func(t *testing.T, s *scp.SCP, localDir, remoteDir string) {
+		srcDir := filepath.Join(remoteDir, "src")
+		for _, name := range []string{"file1", "sub/file2"} {
+			remoteFile := filepath.Join(srcDir, filepath.FromSlash(name))
+			err := os.MkdirAll(filepath.Dir(remoteFile), 0755)
+			if err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+			err = ioutil.WriteFile(remoteFile, body, 0644)
+			if err != nil {
+				t.Fatalf("fail to write file; %s", err)
+			}
+		}
+
+		t.Run("ReceiveFile", func(t *testing.T) {
+			localFile := filepath.Join(localDir, "sparse")
+			err := s.ReceiveFile(filepath.Join(srcDir, "file1"), localFile, scp.WithSparse())
+			if err != nil {
+				t.Fatalf("fail to receive file; %s", err)
+			}
+			checkFile(t, localFile, true)
+		})
+
+		t.Run("ReceiveFile without option", func(t *testing.T) {
+			localFile := filepath.Join(localDir, "full")
+			err := s.ReceiveFile(filepath.Join(srcDir, "file1"), localFile)
+			if err != nil {
+				t.Fatalf("fail to receive file; %s", err)
+			}
+			checkFile(t, localFile, false)
+		})
+
+		t.Run("ReceiveDir", func(t *testing.T) {
+			localDestDir := filepath.Join(localDir, "dir")
+			err := s.ReceiveDir(srcDir, localDestDir, nil, scp.WithSparse())
+			if err != nil {
+				t.Fatalf("fail to receive directory; %s", err)
+			}
+			checkFile(t, filepath.Join(localDestDir, "file1"), true)
+			checkFile(t, filepath.Join(localDestDir, "sub", "file2"), true)
+		})
+
+		t.Run("Overwrite existing file", func(t *testing.T) {
+			// The zeros of the body are not written, so the contents of
+			// the existing file must be removed.
+			localFile := filepath.Join(localDir, "existing")
+			err := ioutil.WriteFile(localFile, bytes.Repeat([]byte{1}, size+100), 0644)
+			if err != nil {
+				t.Fatalf("fail to write file; %s", err)
+			}
+			err = s.ReceiveFile(filepath.Join(srcDir, "file1"), localFile, scp.WithSparse())
+			if err != nil {
+				t.Fatalf("fail to receive file; %s", err)
+			}
+			checkFile(t, localFile, true)
+		})
+	})
+}
@@ -0,0 +1,385 @@
+package scp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SSHConfig is the settings read from OpenSSH client config files like
+// ~/.ssh/config. Only the keywords Host, Match all, Include, HostName, Port,
+// User, IdentityFile, ProxyJump, UserKnownHostsFile and StrictHostKeyChecking
+// are used. Other keywords are ignored, and Match blocks other than
+// Match all never match.
+type SSHConfig struct {
+	blocks []sshConfigBlock
+}
+
+type sshConfigBlock struct {
+	// patterns are the patterns of the Host line. It is nil for a block
+	// which never matches.
+	patterns []string
+	params   []sshConfigParam
+}
+
+type sshConfigParam struct {
+	keyword string
+	args    []string
+}
+
+// HostConfig is the resolved settings for a host.
+type HostConfig struct {
+	// Alias is the host name passed to Resolve.
+	Alias    string
+	HostName string
+	Port     int
+	User     string
+	// IdentityFiles are the identity files in the order of preference.
+	IdentityFiles []string
+	// ProxyJump is the jump hosts in the form of [user@]host[:port].
+	ProxyJump []string
+	// UserKnownHostsFiles are the known_hosts files.
+	UserKnownHostsFiles []string
+	// StrictHostKeyChecking is one of "yes", "accept-new" and "no".
+	// "ask" is resolved to "yes" since there is no way to ask.
+	StrictHostKeyChecking string
+}
+
+// DefaultSSHConfigFiles returns ~/.ssh/config and /etc/ssh/ssh_config.
+func DefaultSSHConfigFiles() []string {
+	files := []string{}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".ssh", "config"))
+	}
+	return append(files, "/etc/ssh/ssh_config")
+}
+
+// LoadSSHConfig reads the config files in the order of precedence.
+// Files which do not exist are ignored.
+func LoadSSHConfig(files ...string) (*SSHConfig, error) {
+	c := &SSHConfig{}
+	for _, file := range files {
+		err := c.load(file, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// maxSSHConfigIncludeDepth is the maximum depth of Include like OpenSSH.
+const maxSSHConfigIncludeDepth = 16
+
+func (c *SSHConfig) load(file string, depth int) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open ssh config: %w", err)
+	}
+	defer f.Close()
+	err = c.parse(f, file, depth)
+	if err != nil {
+		return fmt.Errorf("failed to parse ssh config %s: %w", file, err)
+	}
+	return nil
+}
+
+func (c *SSHConfig) parse(r io.Reader, file string, depth int) error {
+	if depth == 0 {
+		// The lines before the first Host line apply to all hosts.
+		// Those in an included file continue the current block.
+		c.blocks = append(c.blocks, sshConfigBlock{patterns: []string{"*"}})
+	}
+	sc := bufio.NewScanner(r)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		keyword, args, err := splitSSHConfigLine(sc.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		switch keyword {
+		case "":
+		case "host":
+			c.blocks = append(c.blocks, sshConfigBlock{patterns: args})
+		case "match":
+			block := sshConfigBlock{}
+			if len(args) == 1 && strings.EqualFold(args[0], "all") {
+				block.patterns = []string{"*"}
+			}
+			c.blocks = append(c.blocks, block)
+		case "include":
+			if depth >= maxSSHConfigIncludeDepth {
+				return fmt.Errorf("line %d: too deeply nested Include", lineNo)
+			}
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(file), pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("line %d: %w", lineNo, err)
+				}
+				for _, m := range matches {
+					patterns := c.blocks[len(c.blocks)-1].patterns
+					err = c.load(m, depth+1)
+					if err != nil {
+						return err
+					}
+					// The lines after Include continue the block of the Include line.
+					c.blocks = append(c.blocks, sshConfigBlock{patterns: patterns})
+				}
+			}
+		default:
+			last := &c.blocks[len(c.blocks)-1]
+			last.params = append(last.params, sshConfigParam{keyword: keyword, args: args})
+		}
+	}
+	return sc.Err()
+}
+
+// splitSSHConfigLine splits a line into the lower-cased keyword and the
+// arguments. The keyword may be followed by "=". Arguments may be quoted
+// with double quotes.
+func splitSSHConfigLine(line string) (keyword string, args []string, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return "", nil, fmt.Errorf("missing argument for %s", line)
+	}
+	keyword = strings.ToLower(line[:i])
+	rest := strings.TrimLeft(line[i:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			j := strings.IndexByte(rest[1:], '"')
+			if j < 0 {
+				return "", nil, fmt.Errorf("unterminated quote for %s", keyword)
+			}
+			arg, rest = rest[1:j+1], rest[j+2:]
+		} else {
+			j := strings.IndexAny(rest, " \t")
+			if j < 0 {
+				j = len(rest)
+			}
+			arg, rest = rest[:j], rest[j:]
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("missing argument for %s", keyword)
+	}
+	return keyword, args, nil
+}
+
+// Resolve returns the settings for hostAlias. The first obtained value
+// of each keyword is used except IdentityFile, whose values are accumulated.
+// Unset values are filled with the defaults of OpenSSH.
+func (c *SSHConfig) Resolve(hostAlias string) (*HostConfig, error) {
+	h := &HostConfig{Alias: hostAlias}
+	var identityFiles []string
+	for _, block := range c.blocks {
+		if !matchSSHConfigHost(block.patterns, hostAlias) {
+			continue
+		}
+		for _, p := range block.params {
+			switch p.keyword {
+			case "hostname":
+				if h.HostName == "" {
+					h.HostName = p.args[0]
+				}
+			case "port":
+				if h.Port == 0 {
+					port, err := strconv.Atoi(p.args[0])
+					if err != nil || port <= 0 || port > 65535 {
+						return nil, fmt.Errorf("invalid port %q for %s", p.args[0], hostAlias)
+					}
+					h.Port = port
+				}
+			case "user":
+				if h.User == "" {
+					h.User = p.args[0]
+				}
+			case "identityfile":
+				identityFiles = append(identityFiles, p.args[0])
+			case "proxyjump":
+				if h.ProxyJump == nil {
+					h.ProxyJump = strings.Split(p.args[0], ",")
+				}
+			case "userknownhostsfile":
+				if h.UserKnownHostsFiles == nil {
+					h.UserKnownHostsFiles = p.args
+				}
+			case "stricthostkeychecking":
+				if h.StrictHostKeyChecking == "" {
+					h.StrictHostKeyChecking = strings.ToLower(p.args[0])
+				}
+			}
+		}
+	}
+
+	if h.Port == 0 {
+		h.Port = 22
+	}
+	if h.User == "" {
+		u, err := localUserName()
+		if err != nil {
+			return nil, err
+		}
+		h.User = u
+	}
+	hostName := h.HostName
+	// %h in HostName is the alias.
+	h.HostName = hostAlias
+	if hostName != "" {
+		h.HostName = expandSSHConfigTokens(hostName, h)
+	}
+	if len(h.ProxyJump) == 1 && strings.EqualFold(h.ProxyJump[0], "none") {
+		h.ProxyJump = nil
+	}
+	if identityFiles == nil {
+		identityFiles = []string{"~/.ssh/id_rsa", "~/.ssh/id_ecdsa", "~/.ssh/id_ed25519"}
+	}
+	for _, f := range identityFiles {
+		h.IdentityFiles = append(h.IdentityFiles, expandHome(expandSSHConfigTokens(f, h)))
+	}
+	if h.UserKnownHostsFiles == nil {
+		h.UserKnownHostsFiles = []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts2"}
+	}
+	var knownHostsFiles []string
+	for _, f := range h.UserKnownHostsFiles {
+		if strings.EqualFold(f, "none") {
+			continue
+		}
+		knownHostsFiles = append(knownHostsFiles, expandHome(expandSSHConfigTokens(f, h)))
+	}
+	h.UserKnownHostsFiles = knownHostsFiles
+	switch h.StrictHostKeyChecking {
+	case "", "ask", "yes", "true":
+		h.StrictHostKeyChecking = "yes"
+	case "no", "off", "false":
+		h.StrictHostKeyChecking = "no"
+	case "accept-new":
+	default:
+		return nil, fmt.Errorf("invalid StrictHostKeyChecking %q for %s", h.StrictHostKeyChecking, hostAlias)
+	}
+	return h, nil
+}
+
+// matchSSHConfigHost reports whether host matches the patterns of a Host line.
+// A pattern prefixed with "!" negates the match.
+func matchSSHConfigHost(patterns []string, host string) bool {
+	matched := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if matchWildcard(p[1:], host) {
+				return false
+			}
+		} else if matchWildcard(p, host) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchWildcard matches s with pattern where "*" matches zero or more
+// characters and "?" matches exactly one character, case-insensitively.
+func matchWildcard(pattern, s string) bool {
+	pattern = strings.ToLower(pattern)
+	s = strings.ToLower(s)
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+// expandSSHConfigTokens expands %%, %h, %n, %p, %r, %u and %d.
+func expandSSHConfigTokens(s string, h *HostConfig) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'h':
+			b.WriteString(h.HostName)
+		case 'n':
+			b.WriteString(h.Alias)
+		case 'p':
+			b.WriteString(strconv.Itoa(h.Port))
+		case 'r':
+			b.WriteString(h.User)
+		case 'u':
+			u, _ := localUserName()
+			b.WriteString(u)
+		case 'd':
+			home, _ := os.UserHomeDir()
+			b.WriteString(home)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// expandHome expands "~" at the start of path to the home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+func localUserName() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to get current user: %w", err)
+	}
+	name := u.Username
+	if i := strings.LastIndexByte(name, '\\'); i >= 0 {
+		// Strip the domain on Windows.
+		name = name[i+1:]
+	}
+	return name, nil
+}
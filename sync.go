@@ -0,0 +1,134 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// SyncDir copies files and directories under the local srcDir to the remote
+// destDir like rsync. Unlike SendDir, the entries under srcDir are always
+// copied directly under destDir. destDir is created if it does not exist,
+// but its parent directory must exist.
+//
+// The remote tree is listed first and only new files and files with
+// a different size or modification time are sent in a single scp session.
+// The comparison can be changed with an overwrite policy other than
+// OverwriteAlways. Directories are always sent to update their time and permission.
+//
+// If WithDelete is passed, remote files and directories which do not exist under
+// srcDir are removed before sending. Local entries rejected by acceptFn are not sent,
+// but the corresponding remote entries are not removed.
+// Without WithDelete, the transfer fails if a remote entry is a directory while the
+// local one is a file or vice versa.
+//
+// SyncDir supports WithDryRun. The removals and the files to be sent are
+// reported to the plan without changing the remote.
+//
+// The remote must have the find command with the -printf action like GNU findutils.
+func (s *SCP) SyncDir(srcDir, destDir string, acceptFn AcceptFunc, opts ...Option) error {
+	o := s.newTransferOptions(opts)
+	srcDir = filepath.Clean(srcDir)
+	destDir = realPath(filepath.Clean(destDir))
+	if acceptFn == nil {
+		acceptFn = acceptAny
+	}
+	policy := o.overwrite
+	if policy == OverwriteAlways {
+		policy = OverwriteIfDifferent
+	}
+
+	destInfos, err := s.listRemote(destDir, true)
+	if err != nil {
+		return err
+	}
+
+	var extraneous []string
+	if o.delete {
+		extraneous, err = extraneousRemotePaths(srcDir, destInfos)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.plan != nil {
+		for _, relPath := range extraneous {
+			o.addPlan(path.Join(destDir, relPath), PlanRemove, destInfos[relPath])
+		}
+		forgetRemotePaths(destInfos, extraneous)
+		return o.planSendDir(srcDir, destDir, destInfos, acceptFn, policy)
+	}
+
+	if len(extraneous) > 0 {
+		paths := make([]string, len(extraneous))
+		for i, relPath := range extraneous {
+			paths[i] = path.Join(destDir, relPath)
+		}
+		err = s.removeRemote(paths)
+		if err != nil {
+			return err
+		}
+		forgetRemotePaths(destInfos, extraneous)
+	}
+
+	return runSourceSession(s.commandTransport(), path.Dir(destDir), false, s.SCPCommand, true, o.setsRemoteMode(), o, func(s *sourceSession) error {
+		return sendDir(s, srcDir, path.Base(destDir), acceptFn, func(relPath string, info *FileInfo) bool {
+			return policy.shouldWrite(info, destInfos[relPath], o.compareModTimes)
+		})
+	})
+}
+
+// extraneousRemotePaths returns the sorted relative paths of remote entries
+// which do not exist under srcDir or have a different type.
+// Entries under an extraneous directory are not included.
+func extraneousRemotePaths(srcDir string, destInfos map[string]*FileInfo) ([]string, error) {
+	extraneous := make(map[string]bool)
+	for relPath, info := range destInfos {
+		if relPath == "" {
+			continue
+		}
+		localInfo, err := os.Stat(filepath.Join(srcDir, filepath.FromSlash(relPath)))
+		if os.IsNotExist(err) {
+			extraneous[relPath] = true
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get information of source file: %w", err)
+		} else if localInfo.IsDir() != info.IsDir() {
+			extraneous[relPath] = true
+		}
+	}
+
+	var relPaths []string
+	for relPath := range extraneous {
+		if !hasAncestorIn(path.Dir(relPath), extraneous) {
+			relPaths = append(relPaths, relPath)
+		}
+	}
+	sort.Strings(relPaths)
+	return relPaths, nil
+}
+
+// forgetRemotePaths deletes the entries at relPaths and under them from destInfos.
+func forgetRemotePaths(destInfos map[string]*FileInfo, relPaths []string) {
+	removed := make(map[string]bool)
+	for _, relPath := range relPaths {
+		removed[relPath] = true
+	}
+	for relPath := range destInfos {
+		if relPath != "" && hasAncestorIn(relPath, removed) {
+			delete(destInfos, relPath)
+		}
+	}
+}
+
+// hasAncestorIn returns whether relPath or one of its ancestors
+// is in set.
+func hasAncestorIn(relPath string, set map[string]bool) bool {
+	for ; relPath != "." && relPath != "/"; relPath = path.Dir(relPath) {
+		if set[relPath] {
+			return true
+		}
+	}
+	return false
+}
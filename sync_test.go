@@ -0,0 +1,148 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestSyncDir(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	setup := func(t *testing.T) (localDir, remoteDir string) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSyncDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		remoteDir, err = ioutil.TempDir("", "go-scp-TestSyncDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+
+		for _, dir := range []string{"sub", "replaced"} {
+			err = os.Mkdir(filepath.Join(localDir, dir), 0755)
+			if err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+		}
+		for _, dir := range []string{"sub", "extra"} {
+			err = os.Mkdir(filepath.Join(remoteDir, dir), 0755)
+			if err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+		}
+		files := []struct {
+			path    string
+			content string
+			modTime time.Time
+		}{
+			{path: filepath.Join(localDir, "same"), content: "local", modTime: modTime},
+			{path: filepath.Join(localDir, "sub", "changed"), content: "local", modTime: modTime},
+			{path: filepath.Join(localDir, "new"), content: "local", modTime: modTime},
+			{path: filepath.Join(remoteDir, "same"), content: "other", modTime: modTime},
+			{path: filepath.Join(remoteDir, "sub", "changed"), content: "other", modTime: modTime.Add(time.Hour)},
+			{path: filepath.Join(remoteDir, "sub", "extra"), content: "other", modTime: modTime},
+			{path: filepath.Join(remoteDir, "extra", "file"), content: "other", modTime: modTime},
+			{path: filepath.Join(remoteDir, "replaced"), content: "other", modTime: modTime},
+		}
+		for _, f := range files {
+			err = writeFileWithModTime(f.path, []byte(f.content), f.modTime)
+			if err != nil {
+				t.Fatalf("fail to write file; %s", err)
+			}
+		}
+		return localDir, remoteDir
+	}
+
+	t.Run("without delete", func(t *testing.T) {
+		localDir, remoteDir := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		err := os.Remove(filepath.Join(remoteDir, "replaced"))
+		if err != nil {
+			t.Fatalf("fail to remove file; %s", err)
+		}
+		err = scp.NewSCP(c).SyncDir(localDir, remoteDir, nil)
+		if err != nil {
+			t.Errorf("fail to SyncDir; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{
+			"same":        "other",
+			"sub/changed": "local",
+			"sub/extra":   "other",
+			"new":         "local",
+			"extra/file":  "other",
+		})
+	})
+
+	t.Run("with delete", func(t *testing.T) {
+		localDir, remoteDir := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		err := scp.NewSCP(c).SyncDir(localDir, remoteDir, nil, scp.WithDelete())
+		if err != nil {
+			t.Errorf("fail to SyncDir; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{
+			"same":        "other",
+			"sub/changed": "local",
+			"new":         "local",
+		})
+		for _, name := range []string{"sub/extra", "extra"} {
+			if _, err := os.Stat(filepath.Join(remoteDir, name)); !os.IsNotExist(err) {
+				t.Errorf("extraneous entry %s is not removed; %v", name, err)
+			}
+		}
+		fi, err := os.Stat(filepath.Join(remoteDir, "replaced"))
+		if err != nil || !fi.IsDir() {
+			t.Errorf("file is not replaced with directory; %v", err)
+		}
+	})
+
+	t.Run("dest dir not exist", func(t *testing.T) {
+		localDir, remoteDir := setup(t)
+		defer os.RemoveAll(localDir)
+		defer os.RemoveAll(remoteDir)
+
+		remoteDestDir := filepath.Join(remoteDir, "dest")
+		err := scp.NewSCP(c).SyncDir(localDir, remoteDestDir, nil)
+		if err != nil {
+			t.Errorf("fail to SyncDir; %s", err)
+		}
+		sameDirTreeContent(t, localDir, remoteDestDir)
+	})
+}
+
+func checkFileContents(t *testing.T, dir string, want map[string]string) {
+	for name, wantContent := range want {
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("fail to read file; %s", err)
+			continue
+		}
+		if string(got) != wantContent {
+			t.Errorf("unmatch content of %s, got:%q, want:%q", name, got, wantContent)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestTimestamps(t *testing.T) {
+	l, err := newTestSFTPServer()
+	if err != nil {
+		t.Fatalf("fail to create test sftp server; %s", err)
+	}
+	defer l.Close()
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sftp server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestTimestamps-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestTimestamps-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	localFile := filepath.Join(localDir, "file1")
+	err = writeFileWithModTime(localFile, []byte("hello"), modTime)
+	if err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
+	fi, err := os.Stat(localFile)
+	if err != nil {
+		t.Fatalf("fail to stat file; %s", err)
+	}
+	if !fi.ModTime().Equal(modTime) {
+		t.Skipf("file system does not keep nanoseconds; got=%s", fi.ModTime())
+	}
+	checkModTime := func(t *testing.T, name string, want time.Time) {
+		t.Helper()
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if got := fi.ModTime(); !got.Equal(want) {
+			t.Errorf("modTime unmatch; got=%s, want=%s", got, want)
+		}
+	}
+
+	t.Run("Send with scp in microseconds", func(t *testing.T) {
+		s := scp.NewSCPWithTransport(&scp.ExecTransport{})
+		remoteFile := filepath.Join(remoteDir, "scp")
+		err := s.SendFile(localFile, remoteFile)
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		checkModTime(t, remoteFile, modTime.Truncate(time.Microsecond))
+
+		// Sending again is skipped with the exact comparison since both
+		// times are the same in microseconds.
+		err = writeFileWithModTime(remoteFile, []byte("world"), modTime.Truncate(time.Microsecond))
+		if err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		err = s.SendFile(localFile, remoteFile, scp.WithOverwrite(scp.OverwriteIfDifferent), scp.WithModTimeTolerance(0))
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		got, err := ioutil.ReadFile(remoteFile)
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		if string(got) != "world" {
+			t.Errorf("file is sent again; got=%q", got)
+		}
+	})
+
+	t.Run("Send with sftp in seconds", func(t *testing.T) {
+		s := scp.NewSCP(c)
+		s.Protocol = scp.ProtocolSFTP
+		remoteFile := filepath.Join(remoteDir, "sftp")
+		err := s.SendFile(localFile, remoteFile)
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		checkModTime(t, remoteFile, modTime.Truncate(time.Second))
+	})
+
+	t.Run("Mod time tolerance", func(t *testing.T) {
+		s := scp.NewSCPWithTransport(&scp.ExecTransport{})
+		remoteFile := filepath.Join(remoteDir, "tolerance")
+		testCases := []struct {
+			name  string
+			opts  []scp.Option
+			write bool
+		}{
+			{name: "default", write: false},
+			{name: "exact", opts: []scp.Option{scp.WithModTimeTolerance(0)}, write: true},
+			{name: "one second", opts: []scp.Option{scp.WithModTimeTolerance(time.Second)}, write: false},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				remoteModTime := modTime.Add(-100 * time.Millisecond)
+				err := writeFileWithModTime(remoteFile, []byte("world"), remoteModTime)
+				if err != nil {
+					t.Fatalf("fail to write file; %s", err)
+				}
+				opts := append([]scp.Option{scp.WithOverwrite(scp.OverwriteIfDifferent)}, tc.opts...)
+				err = s.SendFile(localFile, remoteFile, opts...)
+				if err != nil {
+					t.Fatalf("fail to send file; %s", err)
+				}
+				want := "world"
+				if tc.write {
+					want = "hello"
+				}
+				got, err := ioutil.ReadFile(remoteFile)
+				if err != nil {
+					t.Fatalf("fail to read file; %s", err)
+				}
+				if string(got) != want {
+					t.Errorf("contents unmatch; got=%q, want=%q", got, want)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,243 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Transport starts the commands which SCP runs on the remote, including the
+// scp command. The default transport used by NewSCP runs them with ssh
+// sessions. ExecTransport runs them as local processes, which can be used
+// to run scp through commands like docker exec or kubectl exec.
+type Transport interface {
+	// NewSession creates a session to run a command.
+	NewSession() (Session, error)
+}
+
+// Session is a command run by a Transport. *ssh.Session implements Session.
+//
+// The pipes are requested before Start, and Wait is called after Start
+// returns nil. Close is always called, and it should terminate the command
+// if it is still running.
+type Session interface {
+	// StdinPipe returns a pipe connected to the standard input of the command.
+	StdinPipe() (io.WriteCloser, error)
+	// StdoutPipe returns a pipe connected to the standard output of the command.
+	StdoutPipe() (io.Reader, error)
+	// StderrPipe returns a pipe connected to the standard error of the command.
+	StderrPipe() (io.Reader, error)
+	// Start starts cmd, which is a command line for a POSIX shell.
+	Start(cmd string) error
+	// Wait waits for the command to exit. It returns an error which has
+	// an ExitStatus method like *ssh.ExitError if the command fails.
+	Wait() error
+	// Close releases the resources of the session.
+	Close() error
+}
+
+// subsystemSession is a Session which can start a subsystem like sftp
+// instead of a command. *ssh.Session implements it.
+type subsystemSession interface {
+	Session
+	// RequestSubsystem starts the subsystem in place of Start.
+	RequestSubsystem(subsystem string) error
+}
+
+// NewSCPWithTransport creates the SCP client which runs the remote commands
+// with t. It is caller's responsibility to release the resources of t
+// after using SCP.
+func NewSCPWithTransport(t Transport) *SCP {
+	return &SCP{
+		transport: t,
+	}
+}
+
+type sshTransport struct {
+	client *ssh.Client
+}
+
+func (t sshTransport) NewSession() (Session, error) {
+	session, err := t.client.NewSession()
+	if err != nil {
+		// NOTE: Return untyped nil so that the session is compared to nil.
+		return nil, err
+	}
+	return session, nil
+}
+
+// ExecTransport is a Transport which runs commands as local processes.
+// The command line is appended to Command as the last argument.
+type ExecTransport struct {
+	// Command is the program and arguments to run a command line, like
+	// []string{"kubectl", "exec", "-i", "mypod", "--", "sh", "-c"}.
+	// If it is empty, []string{"sh", "-c"} is used to run commands on the
+	// local machine.
+	Command []string
+	// Env is the environment of the processes. If it is nil, the
+	// environment of the current process is used.
+	Env []string
+}
+
+// NewSession implements Transport.
+func (t *ExecTransport) NewSession() (Session, error) {
+	args := t.Command
+	if len(args) == 0 {
+		args = []string{"sh", "-c"}
+	}
+	return &execSession{args: args, env: t.Env}, nil
+}
+
+// ExitError is the error returned by Wait of a session of ExecTransport
+// when the command exits with a non-zero status.
+type ExitError struct {
+	*exec.ExitError
+}
+
+// ExitStatus returns the exit status of the command.
+func (e *ExitError) ExitStatus() int {
+	return e.ExitCode()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.ExitError
+}
+
+type execSession struct {
+	args []string
+	env  []string
+
+	mu  sync.Mutex
+	cmd *exec.Cmd
+	// childFiles are the ends of the pipes for the process.
+	childFiles []*os.File
+	// parentFiles are the ends of the pipes for this process.
+	parentFiles []*os.File
+	stdin       *os.File
+	stdout      *os.File
+	stderr      *os.File
+	// waiting is true after Wait of exec.Cmd is called.
+	waiting bool
+}
+
+func (s *execSession) StdinPipe() (io.WriteCloser, error) {
+	r, w, err := s.pipe()
+	if err != nil {
+		return nil, err
+	}
+	s.stdin = r
+	s.childFiles = append(s.childFiles, r)
+	s.parentFiles = append(s.parentFiles, w)
+	return w, nil
+}
+
+func (s *execSession) StdoutPipe() (io.Reader, error) {
+	r, w, err := s.pipe()
+	if err != nil {
+		return nil, err
+	}
+	s.stdout = w
+	s.childFiles = append(s.childFiles, w)
+	s.parentFiles = append(s.parentFiles, r)
+	return r, nil
+}
+
+func (s *execSession) StderrPipe() (io.Reader, error) {
+	r, w, err := s.pipe()
+	if err != nil {
+		return nil, err
+	}
+	s.stderr = w
+	s.childFiles = append(s.childFiles, w)
+	s.parentFiles = append(s.parentFiles, r)
+	return r, nil
+}
+
+func (s *execSession) pipe() (r, w *os.File, err error) {
+	if s.cmd != nil {
+		return nil, nil, errors.New("scp: pipe requested after process started")
+	}
+	return os.Pipe()
+}
+
+func (s *execSession) Start(cmd string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd != nil {
+		return errors.New("scp: process already started")
+	}
+	args := append(append([]string{}, s.args[1:]...), cmd)
+	s.cmd = exec.Command(s.args[0], args...)
+	s.cmd.Env = s.env
+	// NOTE: Nil files of exec.Cmd are connected to the null device.
+	if s.stdin != nil {
+		s.cmd.Stdin = s.stdin
+	}
+	if s.stdout != nil {
+		s.cmd.Stdout = s.stdout
+	}
+	if s.stderr != nil {
+		s.cmd.Stderr = s.stderr
+	}
+	err := s.cmd.Start()
+	// The ends for the process are not needed after it starts, and closing
+	// them lets the readers get EOF when the process exits.
+	for _, f := range s.childFiles {
+		f.Close()
+	}
+	s.childFiles = nil
+	return err
+}
+
+func (s *execSession) Wait() error {
+	s.mu.Lock()
+	if s.waiting {
+		s.mu.Unlock()
+		return errors.New("scp: Wait was already called")
+	}
+	s.waiting = true
+	s.mu.Unlock()
+
+	err := s.cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{ExitError: exitErr}
+	}
+	return err
+}
+
+func (s *execSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range append(s.childFiles, s.parentFiles...) {
+		f.Close()
+	}
+	s.childFiles = nil
+	s.parentFiles = nil
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+		if !s.waiting {
+			// Reap the process since Wait is not called.
+			s.waiting = true
+			s.cmd.Wait()
+		}
+	}
+	return nil
+}
+
+// exitStatus returns the exit status if err is the error of a command
+// which exits with a non-zero status.
+func exitStatus(err error) (status int, ok bool) {
+	var exitErr interface {
+		error
+		ExitStatus() int
+	}
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,81 @@
+//go:build !windows
+// +build !windows
+
+package scp_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	scp "github.com/hnakamur/go-scp"
+)
+
+func TestExecTransport(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "go-scp-TestExecTransport-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestExecTransport-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = writeFileWithModTime(filepath.Join(localDir, "file1"), []byte("hello"), modTime)
+	if err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
+
+	sc := scp.NewSCPWithTransport(&scp.ExecTransport{Command: []string{"sh", "-c"}})
+
+	t.Run("SendFile and ReceiveFile", func(t *testing.T) {
+		remotePath := filepath.Join(remoteDir, "file1")
+		err := sc.SendFile(filepath.Join(localDir, "file1"), remotePath)
+		if err != nil {
+			t.Fatalf("fail to send file; %s", err)
+		}
+		checkFileContents(t, remoteDir, map[string]string{"file1": "hello"})
+
+		err = sc.ReceiveFile(remotePath, filepath.Join(localDir, "file2"))
+		if err != nil {
+			t.Fatalf("fail to receive file; %s", err)
+		}
+		checkFileContents(t, localDir, map[string]string{"file2": "hello"})
+		fi, err := os.Stat(filepath.Join(localDir, "file2"))
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if !fi.ModTime().Equal(modTime) {
+			t.Errorf("modTime unmatch; got=%s, want=%s", fi.ModTime(), modTime)
+		}
+	})
+
+	t.Run("SyncDir", func(t *testing.T) {
+		destDir := filepath.Join(remoteDir, "synced")
+		err := sc.SyncDir(localDir, destDir, nil)
+		if err != nil {
+			t.Fatalf("fail to sync directory; %s", err)
+		}
+		checkFileContents(t, destDir, map[string]string{"file1": "hello", "file2": "hello"})
+	})
+
+	t.Run("Exit status", func(t *testing.T) {
+		sc := scp.NewSCPWithTransport(&scp.ExecTransport{})
+		// The command reads the first reply and exits without sending a file.
+		sc.SCPCommand = "sh -c 'head -c 1 >/dev/null; exit 3'"
+		err := sc.ReceiveFile(filepath.Join(remoteDir, "file1"), filepath.Join(localDir, "file3"))
+		var exitErr *scp.ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("unexpected error; got=%v, want ExitError", err)
+		}
+		if exitErr.ExitStatus() != 3 {
+			t.Errorf("exit status unmatch; got=%d, want=3", exitErr.ExitStatus())
+		}
+	})
+}